@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -18,6 +21,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,6 +29,9 @@ import (
 	"unicode"
 )
 
+// version is overridden at build time via -ldflags "-X main.version=...".
+var version = "dev"
+
 type GlobalOptions struct {
 	Target  string
 	Timeout time.Duration
@@ -34,6 +41,11 @@ type GlobalOptions struct {
 
 type App struct {
 	opts GlobalOptions
+	// batch is set while `ui batch` runs; see batchSession.
+	batch *batchSession
+	// includeKeyboard keeps software keyboard keys in ui element captures
+	// (`ui ... --include-keyboard`).
+	includeKeyboard bool
 }
 
 type AppError struct {
@@ -61,11 +73,12 @@ type CommandResult struct {
 }
 
 type SimTarget struct {
-	Name      string `json:"name"`
-	UDID      string `json:"udid"`
-	Runtime   string `json:"runtime"`
-	State     string `json:"state"`
-	Available bool   `json:"available"`
+	Name       string `json:"name"`
+	UDID       string `json:"udid"`
+	Runtime    string `json:"runtime"`
+	State      string `json:"state"`
+	Available  bool   `json:"available"`
+	DeviceType string `json:"deviceType,omitempty"`
 }
 
 type SavedTarget struct {
@@ -116,6 +129,7 @@ type Element struct {
 	Label       string        `json:"label,omitempty"`
 	Value       string        `json:"value,omitempty"`
 	NearbyLabel string        `json:"nearbyLabel,omitempty"`
+	Placeholder string        `json:"placeholder,omitempty"`
 	Enabled     bool          `json:"enabled"`
 	Focused     bool          `json:"focused,omitempty"`
 	Visible     bool          `json:"visible"`
@@ -137,8 +151,9 @@ type Transform struct {
 		H    int    `json:"h"`
 		Unit string `json:"unit"`
 	} `json:"screenshot"`
-	Scale    float64 `json:"scale"`
-	SafeArea struct {
+	Scale       float64 `json:"scale"`
+	Orientation string  `json:"orientation,omitempty"`
+	SafeArea    struct {
 		Top    float64 `json:"top"`
 		Bottom float64 `json:"bottom"`
 		Left   float64 `json:"left"`
@@ -147,6 +162,25 @@ type Transform struct {
 	} `json:"safeArea"`
 }
 
+type KeyboardState struct {
+	Visible bool       `json:"visible"`
+	Frame   *FrameRect `json:"frame,omitempty"`
+}
+
+type AlertButton struct {
+	Label  string     `json:"label"`
+	Frame  FrameRect  `json:"frame"`
+	Center FramePoint `json:"center"`
+}
+
+type AlertState struct {
+	Kind    string        `json:"kind"`
+	Title   string        `json:"title,omitempty"`
+	Message string        `json:"message,omitempty"`
+	Buttons []AlertButton `json:"buttons"`
+	Frame   FrameRect     `json:"frame"`
+}
+
 type FrameResult struct {
 	Target    SimTarget `json:"target"`
 	OutDir    string    `json:"outDir"`
@@ -156,11 +190,46 @@ type FrameResult struct {
 		UIRaw      string `json:"uiRaw,omitempty"`
 		Elements   string `json:"elements,omitempty"`
 		Transform  string `json:"transform,omitempty"`
+		Manifest   string `json:"manifest,omitempty"`
 	} `json:"artifacts"`
 	Counts struct {
 		All         int `json:"all"`
 		Interactive int `json:"interactive"`
 	} `json:"counts"`
+	Keyboard KeyboardState `json:"keyboard"`
+	Alert    *AlertState   `json:"alert,omitempty"`
+}
+
+type FrameManifest struct {
+	SimagentVersion string `json:"simagentVersion"`
+	CreatedAt       string `json:"createdAt"`
+	Device          struct {
+		Name        string `json:"name"`
+		UDID        string `json:"udid"`
+		Type        string `json:"type,omitempty"`
+		Runtime     string `json:"runtime"`
+		State       string `json:"state"`
+		Orientation string `json:"orientation,omitempty"`
+		Appearance  string `json:"appearance,omitempty"`
+	} `json:"device"`
+	App struct {
+		BundleID string `json:"bundleId,omitempty"`
+		Name     string `json:"name,omitempty"`
+	} `json:"app"`
+	Screenshot struct {
+		File   string `json:"file,omitempty"`
+		SHA256 string `json:"sha256,omitempty"`
+		W      int    `json:"w,omitempty"`
+		H      int    `json:"h,omitempty"`
+	} `json:"screenshot"`
+	UIHash      string `json:"uiHash,omitempty"`
+	DurationsMs struct {
+		Screenshot int64 `json:"screenshot"`
+		UI         int64 `json:"ui"`
+		Annotate   int64 `json:"annotate"`
+		Total      int64 `json:"total"`
+	} `json:"durationsMs"`
+	Options map[string]any `json:"options"`
 }
 
 type frameOptions struct {
@@ -177,6 +246,7 @@ type frameOptions struct {
 	MinArea         float64
 	IncludeRoles    map[string]bool
 	ExcludeRoles    map[string]bool
+	IncludeKeyboard bool
 	EmitJSON        bool
 }
 
@@ -195,8 +265,28 @@ type uiFlowStep struct {
 	Replace        bool            `json:"replace,omitempty"`
 	ASCII          bool            `json:"ascii,omitempty"`
 	Paste          bool            `json:"paste,omitempty"`
+	Submit         bool            `json:"submit,omitempty"`
+	ChunkSize      int             `json:"chunkSize,omitempty"`
+	ChunkDelay     string          `json:"chunkDelay,omitempty"`
+	VerifyMode     string          `json:"verifyMode,omitempty"`
+	Strategy       string          `json:"strategy,omitempty"`
+	Value          string          `json:"value,omitempty"`
+	Wheel          int             `json:"wheel,omitempty"`
+	On             *bool           `json:"on,omitempty"`
+	HitTest        bool            `json:"hitTest,omitempty"`
+	Key            string          `json:"key,omitempty"`
+	Match          string          `json:"match,omitempty"`
+	Count          int             `json:"count,omitempty"`
+	Container      string          `json:"container,omitempty"`
+	MaxSwipes      int             `json:"maxSwipes,omitempty"`
+	Tap            bool            `json:"tap,omitempty"`
+	Duration       string          `json:"duration,omitempty"`
 	Direction      string          `json:"direction,omitempty"`
-	Distance       float64         `json:"distance,omitempty"`
+	Distance       flowLength      `json:"distance,omitempty"`
+	FromPoint      string          `json:"fromPoint,omitempty"`
+	ToPoint        string          `json:"toPoint,omitempty"`
+	To             flowLength      `json:"to,omitempty"`
+	Preset         string          `json:"preset,omitempty"`
 	Unit           string          `json:"unit,omitempty"`
 	X              *float64        `json:"x,omitempty"`
 	Y              *float64        `json:"y,omitempty"`
@@ -207,15 +297,52 @@ type uiFlowStep struct {
 	Wait           uiFlowWait      `json:"wait,omitempty"`
 }
 
+// flowLength accepts a JSON number or a string such as "40%" or "x,y".
+type flowLength string
+
+func (l *flowLength) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*l = flowLength(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("expected a number or a string like \"40%%\"")
+	}
+	*l = flowLength(n.String())
+	return nil
+}
+
 type uiFlowSelectors struct {
-	Index    *int   `json:"index,omitempty"`
-	ID       string `json:"id,omitempty"`
-	Label    string `json:"label,omitempty"`
-	Contains string `json:"contains,omitempty"`
+	Index      *int   `json:"index,omitempty"`
+	ID         string `json:"id,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Contains   string `json:"contains,omitempty"`
+	LabelRegex string `json:"labelRegex,omitempty"`
+	ValueRegex string `json:"valueRegex,omitempty"`
+	Select     string `json:"select,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Below      string `json:"below,omitempty"`
+	Above      string `json:"above,omitempty"`
+	RightOf    string `json:"rightOf,omitempty"`
+	LeftOf     string `json:"leftOf,omitempty"`
+	Inside     string `json:"inside,omitempty"`
+	Normalize  bool   `json:"normalize,omitempty"`
+	Nth        int    `json:"nth,omitempty"`
+	First      bool   `json:"first,omitempty"`
+	Last       bool   `json:"last,omitempty"`
 }
 
 type uiFlowWait struct {
 	HasText        string `json:"hasText,omitempty"`
+	GoneText       string `json:"goneText,omitempty"`
+	Select         string `json:"select,omitempty"`
+	Element        string `json:"element,omitempty"`
+	State          string `json:"state,omitempty"`
+	Count          string `json:"count,omitempty"`
+	Stable         string `json:"stable,omitempty"`
+	Any            bool   `json:"any,omitempty"`
 	InteractiveMin *int   `json:"interactiveMin,omitempty"`
 	Timeout        string `json:"timeout,omitempty"`
 	Interval       string `json:"interval,omitempty"`
@@ -229,9 +356,63 @@ var textInputRoleHints = []string{
 	"textfield", "securetextfield", "searchfield", "textarea", "textview",
 }
 
+// hidKeyCodes maps key names for `ui key` to USB HID usage codes, which is
+// what `idb ui key` expects. Letters and digits are added in init.
+var hidKeyCodes = map[string]int{
+	"return": 40, "enter": 40,
+	"escape": 41, "esc": 41,
+	"delete": 42, "backspace": 42,
+	"tab":           43,
+	"space":         44,
+	"forwarddelete": 76, "forward-delete": 76,
+	"home": 74, "end": 77,
+	"pageup": 75, "page-up": 75, "pagedown": 78, "page-down": 78,
+	"right": 79, "left": 80, "down": 81, "up": 82,
+	"minus": 45, "equal": 46, "comma": 54, "period": 55, "slash": 56,
+}
+
+var hidModifierCodes = map[string]int{
+	"ctrl": 224, "control": 224,
+	"shift": 225,
+	"alt":   226, "option": 226, "opt": 226,
+	"cmd": 227, "command": 227, "meta": 227,
+}
+
+func init() {
+	for c := 'a'; c <= 'z'; c++ {
+		hidKeyCodes[string(c)] = 4 + int(c-'a')
+	}
+	for c := '1'; c <= '9'; c++ {
+		hidKeyCodes[string(c)] = 30 + int(c-'1')
+	}
+	hidKeyCodes["0"] = 39
+}
+
+var keyboardDismissLabels = []string{
+	"hide keyboard", "dismiss keyboard", "キーボードを閉じる",
+}
+
+var keyboardAccessoryDismissLabels = []string{
+	"done", "close", "完了", "閉じる",
+}
+
+var alertAcceptLabels = []string{
+	"allow", "allow while using app", "allow once", "allow full access", "ok", "continue", "yes", "accept", "open", "confirm",
+	"許可", "appの使用中は許可", "1度だけ許可", "はい", "続ける", "開く", "同意する", "確認",
+}
+
+var alertDismissLabels = []string{
+	"don't allow", "don't allow tracking", "ask app not to track", "cancel", "not now", "no", "deny", "close", "later", "dismiss",
+	"許可しない", "appにトラッキングしないように要求", "キャンセル", "今はしない", "いいえ", "閉じる", "後で",
+}
+
 const (
 	backspaceKeyCode = "42"
-	defaultClearKeys = 72
+	returnKeyCode    = "40"
+	// keyComboStepDelay separates the key events of a modifier combo so
+	// UIKit sees the modifier down before the key.
+	keyComboStepDelay = 30 * time.Millisecond
+	defaultClearKeys  = 72
 )
 
 func main() {
@@ -314,7 +495,7 @@ func parseGlobalOptions(args []string) (GlobalOptions, []string, error) {
 
 func printUsage(w io.Writer) {
 	fmt.Fprintln(w, "Usage: simagent [--target booted|<UDID>] [--timeout 10s] [--json] [--quiet] <command> [args]")
-	fmt.Fprintln(w, "Commands: target, frame, ui, app, raw")
+	fmt.Fprintln(w, "Commands: target, frame, ui, app, pasteboard, raw")
 }
 
 func (a *App) dispatch(args []string) (bool, error) {
@@ -331,6 +512,8 @@ func (a *App) dispatch(args []string) (bool, error) {
 		return a.cmdUI(args[1:])
 	case "app":
 		return a.cmdApp(args[1:])
+	case "pasteboard":
+		return a.cmdPasteboard(args[1:])
 	case "raw":
 		return a.cmdRaw(args[1:])
 	default:
@@ -428,6 +611,7 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 	fs.StringVar(&opts.Order, "order", "reading", "reading|z|stable")
 	fs.StringVar(&opts.Format, "format", "png", "png|jpg")
 	fs.Float64Var(&opts.MinArea, "min-area", 0, "minimum area in pt^2")
+	fs.BoolVar(&opts.IncludeKeyboard, "include-keyboard", false, "keep software keyboard keys in elements")
 	includeRoles := fs.String("include-roles", "", "comma separated roles")
 	excludeRoles := fs.String("exclude-roles", "", "comma separated roles")
 	localJSON := fs.Bool("json", false, "")
@@ -468,21 +652,26 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 		return opts.EmitJSON, wrapErr("IO_ERROR", "failed to create output directory", err)
 	}
 
+	started := time.Now()
 	result := FrameResult{Target: target, OutDir: opts.OutDir}
 	artifacts := map[string]string{}
+	var manifest FrameManifest
 
 	screenshotPath := filepath.Join(opts.OutDir, "screen."+opts.Format)
 	uiRawPath := filepath.Join(opts.OutDir, "ui.raw.json")
 	elementsPath := filepath.Join(opts.OutDir, "elements.json")
 	transformPath := filepath.Join(opts.OutDir, "transform.json")
 	annotatedPath := filepath.Join(opts.OutDir, "annotated.png")
+	manifestPath := filepath.Join(opts.OutDir, "manifest.json")
 
 	var screenshotSize image.Point
 	if opts.Screenshot {
+		stepStarted := time.Now()
 		_, err := a.runSimctl("io", target.UDID, "screenshot", screenshotPath)
 		if err != nil {
 			return opts.EmitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "failed to capture screenshot")
 		}
+		manifest.DurationsMs.Screenshot = time.Since(stepStarted).Milliseconds()
 		screenshotSize, _ = imageSize(screenshotPath)
 		artifacts["screenshot"] = screenshotPath
 		result.Artifacts.Screenshot = filepath.Base(screenshotPath)
@@ -492,7 +681,11 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 	var allElements []Element
 	allCount := 0
 	interactiveCount := 0
+	uiHash := ""
+	keyboard := KeyboardState{}
+	var alert *AlertState
 	if opts.UI {
+		stepStarted := time.Now()
 		if _, lookErr := exec.LookPath("idb"); lookErr != nil {
 			return opts.EmitJSON, &AppError{Code: "IDB_NOT_FOUND", Message: "idb is not installed or not in PATH"}
 		}
@@ -506,6 +699,9 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 			allElements = lastSample.Elements
 			allCount = lastSample.AllCount
 			interactiveCount = lastSample.InteractiveCount
+			uiHash = lastSample.Hash
+			keyboard = lastSample.Keyboard
+			alert = lastSample.Alert
 			for i, sample := range samples {
 				samplePath := filepath.Join(opts.OutDir, fmt.Sprintf("ui.sample-%02d.raw.json", i+1))
 				if writeErr := writeJSONFile(samplePath, sample.Raw); writeErr == nil {
@@ -528,11 +724,15 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 				allElements = sample.Elements
 				allCount = sample.AllCount
 				interactiveCount = sample.InteractiveCount
+				uiHash = sample.Hash
+				keyboard = sample.Keyboard
+				alert = sample.Alert
 				if writeErr := writeJSONFile(uiRawPath, rawUI); writeErr != nil {
 					return opts.EmitJSON, writeErr
 				}
 			}
 		}
+		manifest.DurationsMs.UI = time.Since(stepStarted).Milliseconds()
 		artifacts["uiRaw"] = uiRawPath
 		result.Artifacts.UIRaw = filepath.Base(uiRawPath)
 	}
@@ -541,7 +741,7 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 		allElements = []Element{}
 	}
 
-	transform := deriveTransform(rawUI, allElements, screenshotSize)
+	transform := deriveTransform(rawUI, allElements, screenshotSize, target.DeviceType)
 	if err := writeJSONFile(transformPath, transform); err != nil {
 		return opts.EmitJSON, err
 	}
@@ -555,15 +755,35 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 	result.Artifacts.Elements = filepath.Base(elementsPath)
 
 	if opts.Annotate && opts.Screenshot {
+		stepStarted := time.Now()
 		if err := createAnnotatedImage(screenshotPath, annotatedPath, allElements, transform); err != nil {
 			return opts.EmitJSON, wrapErr("ANNOTATE_FAILED", "failed to create annotated image", err)
 		}
+		manifest.DurationsMs.Annotate = time.Since(stepStarted).Milliseconds()
 		artifacts["annotated"] = annotatedPath
 		result.Artifacts.Annotated = filepath.Base(annotatedPath)
 	}
 
 	result.Counts.All = allCount
 	result.Counts.Interactive = interactiveCount
+	result.Keyboard = keyboard
+	result.Alert = alert
+
+	a.fillFrameManifest(&manifest, target, opts, rawUI, transform, uiHash)
+	if opts.Screenshot {
+		manifest.Screenshot.File = filepath.Base(screenshotPath)
+		manifest.Screenshot.W = screenshotSize.X
+		manifest.Screenshot.H = screenshotSize.Y
+		if sum, sumErr := fileSHA256(screenshotPath); sumErr == nil {
+			manifest.Screenshot.SHA256 = sum
+		}
+	}
+	manifest.DurationsMs.Total = time.Since(started).Milliseconds()
+	if err := writeJSONFile(manifestPath, manifest); err != nil {
+		return opts.EmitJSON, err
+	}
+	artifacts["manifest"] = manifestPath
+	result.Artifacts.Manifest = filepath.Base(manifestPath)
 
 	last := LastFrame{
 		OutDir:    opts.OutDir,
@@ -595,11 +815,17 @@ func (a *App) cmdFrame(args []string) (bool, error) {
 
 func (a *App) cmdUI(args []string) (bool, error) {
 	if len(args) == 0 {
-		return a.opts.JSON, &AppError{Code: "USAGE", Message: "ui subcommand required: tap|type|clear|swipe|wait|button|flow"}
+		return a.opts.JSON, &AppError{Code: "USAGE", Message: "ui subcommand required: tap|doubletap|longpress|type|key|clear|swipe|drag|scroll-to|pick|set-slider|toggle|inspect|wait|button|keyboard|alert|flow|batch"}
 	}
 	sub := args[0]
 	args = args[1:]
 	emitJSON := a.opts.JSON || hasJSONFlag(args)
+	if hasFlag(args, "--include-keyboard") {
+		// Scoped to this command, or to every line of a `ui batch`.
+		args = stripFlag(args, "--include-keyboard")
+		defer func(prev bool) { a.includeKeyboard = prev }(a.includeKeyboard)
+		a.includeKeyboard = true
+	}
 
 	target, err := a.resolveTarget(a.opts.Target)
 	if err != nil {
@@ -611,15 +837,16 @@ func (a *App) cmdUI(args []string) (bool, error) {
 	}
 
 	switch sub {
-	case "tap":
-		fs := flag.NewFlagSet("ui tap", flag.ContinueOnError)
+	case "tap", "doubletap", "longpress":
+		fs := flag.NewFlagSet("ui "+sub, flag.ContinueOnError)
 		fs.SetOutput(io.Discard)
 		unit := fs.String("unit", "pt", "pt|px")
-		index := fs.Int("index", -1, "element index")
-		id := fs.String("id", "", "element id")
-		label := fs.String("label", "", "tap by exact label")
-		contains := fs.String("contains", "", "tap by partial label/value")
+		sel := addSelectorFlags(fs, sub)
 		from := fs.String("from", "", "path to elements.json")
+		count := fs.Int("count", 0, "number of taps (tap/doubletap)")
+		duration := fs.Duration("duration", 0, "press duration for longpress (default 1s)")
+		hitTest := fs.Bool("hit-test", false, "check the element at the tap point before tapping")
+		expect := addExpectFlags(fs)
 		localJSON := fs.Bool("json", false, "")
 		if err := fs.Parse(args); err != nil {
 			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
@@ -628,97 +855,40 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		if *unit != "pt" && *unit != "px" {
 			return emitJSON, &AppError{Code: "USAGE", Message: "--unit must be pt|px"}
 		}
-
-		selectorCount := 0
-		if *index >= 0 {
-			selectorCount++
-		}
-		if strings.TrimSpace(*id) != "" {
-			selectorCount++
-		}
-		if strings.TrimSpace(*label) != "" {
-			selectorCount++
-		}
-		if strings.TrimSpace(*contains) != "" {
-			selectorCount++
+		gesture, err := newTapGesture(sub, *count, *duration)
+		if err != nil {
+			return emitJSON, err
 		}
-		if selectorCount > 1 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "choose only one selector: --index|--id|--label|--contains"}
+		sel.normalize()
+		if sel.count() > 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "choose only one selector: " + selectorFlagsUsage}
 		}
 
 		var x float64
 		var y float64
 		by := "coord"
 		fallbackUsed := false
-		usedIndex := -1
-		usedID := ""
-		usedLabel := strings.TrimSpace(*label)
-		usedContains := strings.TrimSpace(*contains)
-
-		if selectorCount > 0 {
-			elements := []Element{}
-			if strings.TrimSpace(*from) != "" || *index >= 0 || strings.TrimSpace(*id) != "" {
-				loadedElements, _, loadErr := loadElementsAndTransform(*from)
-				if loadErr != nil {
-					return emitJSON, loadErr
-				}
-				elements = loadedElements
-			} else if loadedElements, _, loadErr := loadElementsAndTransform(*from); loadErr == nil {
-				elements = loadedElements
-			}
-			elem, err := pickElementBySelectors(elements, *index, *id, usedLabel, usedContains)
+		var tapMatch elementMatch
+
+		if sel.count() > 0 {
+			match, err := a.resolveElement(target.UDID, *from, *sel)
 			if err != nil {
-				snapshot, snapErr := a.captureElements(target.UDID)
-				if snapErr == nil {
-					elem, err = pickElementBySelectors(snapshot.Elements, *index, *id, usedLabel, usedContains)
-					if err == nil {
-						by = "live-scan"
-					}
-					if err != nil && (usedLabel != "" || usedContains != "") {
-						if fallback, ok := pickIntentFallbackElement(snapshot.Elements, usedLabel, usedContains); ok {
-							elem = fallback
-							err = nil
-							by = "intent-fallback"
-							fallbackUsed = true
-						}
-					}
-					if err != nil && (usedLabel != "" || usedContains != "") {
-						if fallback, ok := pickSystemFallbackElement(snapshot.Elements, usedLabel, usedContains); ok {
-							elem = fallback
-							err = nil
-							by = "system-fallback"
-							fallbackUsed = true
-						}
-					}
-				}
-				if err != nil {
-					return emitJSON, err
-				}
+				return emitJSON, err
 			}
+			tapMatch = match
+			elem := match.Element
+			by = match.By
+			fallbackUsed = match.Fallback
 			tapPoint := elem.Center
 			if isTextInputRole(elem.Role) {
 				tapPoint = focusPointForElement(elem)
 			}
 			x = tapPoint.X
 			y = tapPoint.Y
-			if *index >= 0 {
-				by = "index"
-				usedIndex = *index
-			}
-			if *id != "" {
-				by = "id"
-				usedID = *id
-			}
-			if usedLabel != "" && !fallbackUsed {
-				by = "label"
-			}
-			if usedContains != "" && !fallbackUsed {
-				by = "contains"
-			}
 		} else {
 			vals := fs.Args()
 			if len(vals) != 2 {
-				return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui tap <x> <y> [--unit pt|px] | --index <n> | --id <id> | --label <text> | --contains <text>"}
+				return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui " + sub + " <x> <y> [--unit pt|px] | --index <n> | --id <id> | --label <text> | --contains <text> | --select <expr> [--count <n>] [--duration <d>]"}
 			}
 			var errX error
 			var errY error
@@ -740,23 +910,40 @@ func (a *App) cmdUI(args []string) (bool, error) {
 			}
 		}
 
-		_, err = a.runIDB(target.UDID, "ui", "tap", idbCoordArg(x), idbCoordArg(y))
+		var hitInfo map[string]any
+		if *hitTest {
+			hitInfo, err = a.hitTest(target.UDID, FramePoint{X: x, Y: y, Unit: "pt"}, tapMatch.Element, sel.count() > 0)
+			if err != nil {
+				return emitJSON, err
+			}
+		}
+		before, err := a.expectBaseline(target.UDID, *expect)
 		if err != nil {
-			return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "tap failed")
+			return emitJSON, err
+		}
+		if err := a.performTap(target.UDID, x, y, gesture); err != nil {
+			return emitJSON, err
 		}
 
-		resp := map[string]any{"ok": true, "action": "tap", "by": by, "targetPt": map[string]any{"x": x, "y": y}}
-		if usedIndex >= 0 {
-			resp["index"] = usedIndex
+		resp := map[string]any{"ok": true, "action": sub, "by": by, "targetPt": map[string]any{"x": x, "y": y}, "gesture": gesture.details()}
+		if kind := sel.kind(); kind != "" {
+			resp["selectorKind"] = kind
 		}
-		if usedID != "" {
-			resp["id"] = usedID
+		if hitInfo != nil {
+			resp["hitTest"] = hitInfo
+		}
+		if expect.active() {
+			result, err := a.awaitExpectation(target.UDID, *expect, before)
+			if err != nil {
+				return emitJSON, err
+			}
+			resp["expect"] = result
 		}
-		if usedLabel != "" {
-			resp["label"] = usedLabel
+		for k, v := range sel.responseFields() {
+			resp[k] = v
 		}
-		if usedContains != "" {
-			resp["contains"] = usedContains
+		if sel.Explain {
+			tapMatch.explain(resp)
 		}
 		if fallbackUsed {
 			resp["fallback"] = "system-ui"
@@ -764,7 +951,7 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		if emitJSON {
 			a.printJSON(resp)
 		} else {
-			fmt.Printf("tap %.2f %.2f\n", x, y)
+			fmt.Printf("%s %.2f %.2f\n", sub, x, y)
 		}
 		return emitJSON, nil
 
@@ -776,7 +963,7 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		emitJSON = emitJSON || opts.JSON
 		text := strings.TrimSpace(opts.Text)
 		if text == "" {
-			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui type --text \"...\" [--into --index <n>|--id <id>|--label <text>|--contains <text>] [--replace] [--ascii|--paste] [--verify]"}
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui type --text \"...\" [--into --index <n>|--id <id>|--label <text>|--contains <text>|--select <expr>] [--replace] [--ascii|--paste] [--verify]"}
 		}
 		if opts.Replace && !opts.Into {
 			return emitJSON, &AppError{Code: "USAGE", Message: "--replace requires --into"}
@@ -785,9 +972,10 @@ func (a *App) cmdUI(args []string) (bool, error) {
 			return emitJSON, &AppError{Code: "USAGE", Message: "--paste is not supported with --legacy-type-parsing"}
 		}
 
-		selectorCount := countElementSelectors(opts.Index, opts.ID, opts.Label, opts.Contains)
+		sel := opts.selector()
+		selectorCount := sel.count()
 		if opts.Into && selectorCount != 1 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "--into requires exactly one selector: --index|--id|--label|--contains"}
+			return emitJSON, &AppError{Code: "USAGE", Message: "--into requires exactly one selector: " + selectorFlagsUsage}
 		}
 		if !opts.Into && selectorCount > 0 {
 			return emitJSON, &AppError{Code: "USAGE", Message: "selector flags require --into"}
@@ -798,13 +986,19 @@ func (a *App) cmdUI(args []string) (bool, error) {
 			return emitJSON, err
 		}
 
+		if opts.ClearStrategy != clearStrategyAuto && !opts.Replace {
+			return emitJSON, &AppError{Code: "USAGE", Message: "--strategy requires --replace"}
+		}
 		var focused *Element
+		var match elementMatch
+		var clearResult map[string]any
 		if opts.Into {
-			elem, resolveErr := a.resolveElementForInput(target.UDID, opts.From, opts.Index, opts.ID, opts.Label, opts.Contains)
+			resolved, resolveErr := a.resolveElement(target.UDID, opts.From, sel)
 			if resolveErr != nil {
 				return emitJSON, resolveErr
 			}
-			focusedElem, focusErr := a.focusElementWithRetry(target.UDID, elem, opts.FocusRetries)
+			match = resolved
+			focusedElem, focusErr := a.focusElementWithRetry(target.UDID, match.Element, opts.FocusRetries)
 			if focusErr != nil {
 				return emitJSON, focusErr
 			}
@@ -814,14 +1008,20 @@ func (a *App) cmdUI(args []string) (bool, error) {
 				if _, err := a.runIDB(target.UDID, "ui", "tap", idbCoordArg(clearPoint.X), idbCoordArg(clearPoint.Y)); err != nil {
 					return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "focus tap failed before replace")
 				}
-				estimate := estimateClearBackspaces(focusedElem)
-				if clearErr := a.clearFocusedInput(target.UDID, estimate); clearErr != nil {
+				cleared, clearErr := a.clearInputField(target.UDID, focusedElem, opts.ClearStrategy, 0)
+				if clearErr != nil {
 					return emitJSON, clearErr
 				}
+				clearResult = cleared
 			}
 		}
 
-		if err := a.submitTextInput(target.UDID, prepared, opts.Paste, focused); err != nil {
+		before, err := a.expectBaseline(target.UDID, opts.Expect)
+		if err != nil {
+			return emitJSON, err
+		}
+		input := textInputOptions{Paste: opts.Paste, Chunking: opts.Chunking, VerifyMode: opts.VerifyMode, SecureBaseline: a.secureBaseline(target.UDID, focused)}
+		if err := a.submitTextInput(target.UDID, prepared, focused, input); err != nil {
 			return emitJSON, err
 		}
 
@@ -835,14 +1035,36 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		if opts.Replace {
 			resp["replace"] = true
 		}
+		if clearResult != nil {
+			resp["clear"] = clearResult
+		}
+		if opts.VerifyMode.Kind != "" {
+			resp["verifyMode"] = opts.VerifyMode.String()
+		}
+		if sel.Explain {
+			match.explain(resp)
+		}
 		if opts.Verify {
-			verify, err := a.verifyTypeResult(target.UDID, prepared, focused)
+			verify, err := a.verifyTypeResult(target.UDID, prepared, focused, input)
 			if err != nil {
 				return emitJSON, err
 			}
 			resp["verified"] = true
 			resp["verify"] = verify
 		}
+		if opts.Submit {
+			if err := a.pressKeyCombo(target.UDID, keyCombo{Name: "return", Key: 40}); err != nil {
+				return emitJSON, err
+			}
+			resp["submitted"] = true
+		}
+		if opts.Expect.active() {
+			result, err := a.awaitExpectation(target.UDID, opts.Expect, before)
+			if err != nil {
+				return emitJSON, err
+			}
+			resp["expect"] = result
+		}
 		if emitJSON {
 			a.printJSON(resp)
 		} else {
@@ -850,15 +1072,47 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		}
 		return emitJSON, nil
 
+	case "key":
+		fs := flag.NewFlagSet("ui key", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		repeat := fs.Int("repeat", 1, "number of presses")
+		localJSON := fs.Bool("json", false, "")
+		if err := parseInterspersedFlags(fs, args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		if fs.NArg() != 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui key <name|cmd+a|code> [--repeat N]"}
+		}
+		combo, err := parseKeyCombo(fs.Arg(0))
+		if err != nil {
+			return emitJSON, err
+		}
+		if *repeat < 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "--repeat must be >= 1"}
+		}
+		for i := 0; i < *repeat; i++ {
+			if err := a.pressKeyCombo(target.UDID, combo); err != nil {
+				return emitJSON, err
+			}
+		}
+		resp := combo.details()
+		resp["ok"] = true
+		resp["repeat"] = *repeat
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("key %s\n", combo.Name)
+		}
+		return emitJSON, nil
+
 	case "clear":
 		fs := flag.NewFlagSet("ui clear", flag.ContinueOnError)
 		fs.SetOutput(io.Discard)
-		index := fs.Int("index", -1, "element index")
-		id := fs.String("id", "", "element id")
-		label := fs.String("label", "", "clear by exact label")
-		contains := fs.String("contains", "", "clear by partial label/value")
+		sel := addSelectorFlags(fs, "clear")
 		from := fs.String("from", "", "path to elements.json")
 		backspaces := fs.Int("max-backspaces", defaultClearKeys, "maximum backspaces to send")
+		strategy := fs.String("strategy", clearStrategyAuto, "auto|select-all|backspace")
 		localJSON := fs.Bool("json", false, "")
 		if err := fs.Parse(args); err != nil {
 			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
@@ -870,14 +1124,19 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		if *backspaces <= 0 {
 			return emitJSON, &AppError{Code: "USAGE", Message: "--max-backspaces must be > 0"}
 		}
-		if countElementSelectors(*index, *id, *label, *contains) != 1 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "ui clear requires exactly one selector: --index|--id|--label|--contains"}
+		if err := validateClearStrategy(*strategy); err != nil {
+			return emitJSON, err
+		}
+		sel.normalize()
+		if sel.count() != 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "ui clear requires exactly one selector: " + selectorFlagsUsage}
 		}
 
-		elem, err := a.resolveElementForInput(target.UDID, *from, *index, *id, *label, *contains)
+		match, err := a.resolveElement(target.UDID, *from, *sel)
 		if err != nil {
 			return emitJSON, err
 		}
+		elem := match.Element
 		if _, err := a.focusElementWithRetry(target.UDID, elem, 2); err != nil {
 			return emitJSON, err
 		}
@@ -885,41 +1144,105 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		if _, err := a.runIDB(target.UDID, "ui", "tap", idbCoordArg(clearPoint.X), idbCoordArg(clearPoint.Y)); err != nil {
 			return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "focus tap failed before clear")
 		}
-		estimate := *backspaces
-		auto := estimateClearBackspaces(elem)
-		if auto > estimate {
-			estimate = auto
-		}
-		if err := a.clearFocusedInput(target.UDID, estimate); err != nil {
+		resp, err := a.clearInputField(target.UDID, elem, *strategy, *backspaces)
+		if err != nil {
 			return emitJSON, err
 		}
-
-		resp := map[string]any{
-			"ok":         true,
-			"action":     "clear",
-			"backspaces": estimate,
-			"selector": map[string]any{
-				"index":    *index,
-				"id":       strings.TrimSpace(*id),
-				"label":    strings.TrimSpace(*label),
-				"contains": strings.TrimSpace(*contains),
-			},
+		resp["ok"] = true
+		resp["action"] = "clear"
+		resp["selector"] = sel.details()
+		if sel.Explain {
+			match.explain(resp)
 		}
 		if emitJSON {
 			a.printJSON(resp)
 		} else {
-			fmt.Printf("cleared (%d backspaces)\n", estimate)
+			fmt.Printf("cleared (%s)\n", resp["method"])
 		}
 		return emitJSON, nil
 
 	case "flow":
 		return a.cmdUIFlow(target, args, emitJSON)
 
+	case "batch":
+		return a.cmdUIBatch(target, args, emitJSON)
+
+	case "alert":
+		if len(args) == 0 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui alert accept|dismiss|tap --button <label>"}
+		}
+		action := args[0]
+		if action != "accept" && action != "dismiss" && action != "tap" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "ui alert action must be accept|dismiss|tap"}
+		}
+		fs := flag.NewFlagSet("ui alert", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		button := fs.String("button", "", "button label for tap")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args[1:]); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		if action == "tap" && strings.TrimSpace(*button) == "" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "ui alert tap requires --button <label>"}
+		}
+		if action != "tap" && strings.TrimSpace(*button) != "" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "--button is only valid with ui alert tap"}
+		}
+		snapshot, err := a.captureElements(target.UDID)
+		if err != nil {
+			return emitJSON, err
+		}
+		resp, err := a.handleAlert(target.UDID, snapshot.Alert, action, strings.TrimSpace(*button))
+		if err != nil {
+			return emitJSON, err
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("alert %s: %s\n", action, resp["button"])
+		}
+		return emitJSON, nil
+
+	case "keyboard":
+		if len(args) == 0 || args[0] != "dismiss" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui keyboard dismiss [--allow-return]"}
+		}
+		fs := flag.NewFlagSet("ui keyboard dismiss", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		allowReturn := fs.Bool("allow-return", false, "fall back to the return key, which may submit the form")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args[1:]); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		if fs.NArg() != 0 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "ui keyboard dismiss does not accept positional args"}
+		}
+		resp, err := a.dismissKeyboard(target.UDID, *allowReturn)
+		if err != nil {
+			return emitJSON, err
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("keyboard dismissed (%v)\n", resp["method"])
+		}
+		return emitJSON, nil
+
 	case "wait":
 		fs := flag.NewFlagSet("ui wait", flag.ContinueOnError)
 		fs.SetOutput(io.Discard)
 		hasText := fs.String("has-text", "", "substring to wait for (label/value)")
 		interactiveMin := fs.Int("interactive-min", -1, "minimum interactive count")
+		selectExpr := fs.String("select", "", "selector expression that must match at least one element")
+		goneText := fs.String("gone-text", "", "substring that must disappear (label/value)")
+		element := fs.String("element", "", "selector expression for --state")
+		state := fs.String("state", "", "comma-separated element states: exists|visible|enabled|focused|value=<text>")
+		count := fs.String("count", "", "'<selector expr> >= N' match count condition")
+		stable := fs.Duration("stable", 0, "UI unchanged for this long")
+		anyCond := fs.Bool("any", false, "succeed when any condition holds")
+		allCond := fs.Bool("all", false, "succeed when all conditions hold (default)")
 		timeout := fs.Duration("timeout", 20*time.Second, "maximum wait duration")
 		interval := fs.Duration("interval", 700*time.Millisecond, "poll interval")
 		localJSON := fs.Bool("json", false, "")
@@ -930,8 +1253,22 @@ func (a *App) cmdUI(args []string) (bool, error) {
 		if fs.NArg() != 0 {
 			return emitJSON, &AppError{Code: "USAGE", Message: "ui wait does not accept positional args"}
 		}
-		if strings.TrimSpace(*hasText) == "" && *interactiveMin < 0 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "ui wait requires --has-text and/or --interactive-min"}
+		if *anyCond && *allCond {
+			return emitJSON, &AppError{Code: "USAGE", Message: "choose only one of --any|--all"}
+		}
+		cond := waitConditions{
+			HasText:        strings.TrimSpace(*hasText),
+			GoneText:       strings.TrimSpace(*goneText),
+			InteractiveMin: *interactiveMin,
+			Select:         strings.TrimSpace(*selectExpr),
+			Element:        strings.TrimSpace(*element),
+			State:          strings.TrimSpace(*state),
+			Count:          strings.TrimSpace(*count),
+			Stable:         *stable,
+			Any:            *anyCond,
+		}
+		if cond.empty() {
+			return emitJSON, &AppError{Code: "USAGE", Message: "ui wait requires at least one of --has-text|--gone-text|--interactive-min|--select|--element|--count|--stable"}
 		}
 		if *timeout <= 0 {
 			return emitJSON, &AppError{Code: "USAGE", Message: "--timeout must be > 0"}
@@ -940,7 +1277,7 @@ func (a *App) cmdUI(args []string) (bool, error) {
 			return emitJSON, &AppError{Code: "USAGE", Message: "--interval must be > 0"}
 		}
 
-		waitResp, err := a.waitForCondition(target.UDID, strings.TrimSpace(*hasText), *interactiveMin, *timeout, *interval)
+		waitResp, err := a.waitForCondition(target.UDID, cond, *timeout, *interval)
 		if err != nil {
 			return emitJSON, err
 		}
@@ -954,161 +1291,540 @@ func (a *App) cmdUI(args []string) (bool, error) {
 	case "swipe":
 		fs := flag.NewFlagSet("ui swipe", flag.ContinueOnError)
 		fs.SetOutput(io.Discard)
-		index := fs.Int("index", -1, "element index")
-		id := fs.String("id", "", "element id")
+		sel := addSelectorFlags(fs, "swipe from")
 		from := fs.String("from", "", "path to elements.json")
-		distance := fs.Float64("distance", 220, "distance in pt")
+		fromPoint := fs.String("from-point", "", "start point x,y (pt, px or %)")
+		toPoint := fs.String("to-point", "", "end point x,y (pt, px or %)")
+		elementsPath := fs.String("elements", "", "path to elements.json")
+		distance := fs.String("distance", "", "distance in pt, px (--unit px) or % of screen (default 220pt)")
+		unit := fs.String("unit", "pt", "pt|px")
+		duration := fs.Duration("duration", 0, "swipe duration")
+		preset := fs.String("preset", "", "back|notifications|control-center|refresh")
 		localJSON := fs.Bool("json", false, "")
 		if err := fs.Parse(args); err != nil {
 			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
 		}
 		emitJSON = emitJSON || *localJSON
-		vals := fs.Args()
-		if len(vals) < 1 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui swipe up|down|left|right [--index <n>|--id <id>]"}
+		req := swipeRequest{
+			Distance: strings.TrimSpace(*distance),
+			Unit:     *unit,
+			From:     strings.TrimSpace(*fromPoint),
+			To:       strings.TrimSpace(*toPoint),
+			Preset:   strings.ToLower(strings.TrimSpace(*preset)),
+			Duration: *duration,
 		}
-		direction := strings.ToLower(vals[0])
-		if direction != "up" && direction != "down" && direction != "left" && direction != "right" {
-			return emitJSON, &AppError{Code: "USAGE", Message: "direction must be up|down|left|right"}
+		if vals := fs.Args(); len(vals) > 0 {
+			req.Direction = strings.ToLower(vals[0])
 		}
-
-		startX := 196.0
-		startY := 426.0
-		_, transform, err := loadElementsAndTransform(*from)
-		if err == nil {
-			if transform.Screen.W > 0 {
-				startX = transform.Screen.W / 2
-			}
-			if transform.Screen.H > 0 {
-				startY = transform.Screen.H / 2
-			}
+		path := *elementsPath
+		if path == "" {
+			path = strings.TrimSpace(*from)
+		}
+		if req.Direction == "" && req.Preset == "" && req.To == "" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui swipe up|down|left|right [selector|--from-point x,y] [--distance 220|40%] [--to-point x,y] [--unit pt|px] [--duration 300ms] | --preset back|notifications|control-center|refresh"}
 		}
 
-		if *index >= 0 || *id != "" {
-			elements, _, err := loadElementsAndTransform(*from)
-			if err != nil {
-				return emitJSON, err
-			}
-			elem, err := pickElement(elements, *index, *id)
+		sel.normalize()
+		if sel.count() > 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "choose only one selector: " + selectorFlagsUsage}
+		}
+		if sel.count() == 1 {
+			match, err := a.resolveElement(target.UDID, path, *sel)
 			if err != nil {
 				return emitJSON, err
 			}
-			startX = elem.Center.X
-			startY = elem.Center.Y
+			req.Start = &match.Element.Center
 		}
 
-		endX := startX
-		endY := startY
-		switch direction {
-		case "up":
-			endY -= *distance
-		case "down":
-			endY += *distance
-		case "left":
-			endX -= *distance
-		case "right":
-			endX += *distance
+		plan, err := planSwipe(req, a.swipeTransform(target.UDID, path, req))
+		if err != nil {
+			return emitJSON, err
 		}
-
-		if _, err := a.runIDB(target.UDID, "ui", "swipe", idbCoordArg(startX), idbCoordArg(startY), idbCoordArg(endX), idbCoordArg(endY)); err != nil {
-			return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "swipe failed")
+		if err := a.performSwipe(target.UDID, plan); err != nil {
+			return emitJSON, err
 		}
 
-		resp := map[string]any{
-			"ok":        true,
-			"action":    "swipe",
-			"direction": direction,
-			"fromPt":    map[string]any{"x": startX, "y": startY},
-			"toPt":      map[string]any{"x": endX, "y": endY},
+		resp := plan.details()
+		resp["ok"] = true
+		for k, v := range sel.responseFields() {
+			resp[k] = v
 		}
 		if emitJSON {
 			a.printJSON(resp)
 		} else {
-			fmt.Printf("swipe %s\n", direction)
+			fmt.Printf("swipe %s\n", plan.Direction)
 		}
 		return emitJSON, nil
 
-	case "button":
-		fs := flag.NewFlagSet("ui button", flag.ContinueOnError)
+	case "scroll-to":
+		fs := flag.NewFlagSet("ui scroll-to", flag.ContinueOnError)
 		fs.SetOutput(io.Discard)
+		sel := addSelectorFlags(fs, "scroll to")
+		container := fs.String("container", "", "selector expression for the scroll container")
+		direction := fs.String("direction", "down", "scroll direction: up|down|left|right")
+		maxSwipes := fs.Int("max-swipes", 10, "maximum number of swipes")
+		tap := fs.Bool("tap", false, "tap the element once visible")
 		localJSON := fs.Bool("json", false, "")
 		if err := fs.Parse(args); err != nil {
 			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
 		}
 		emitJSON = emitJSON || *localJSON
-		vals := fs.Args()
-		if len(vals) != 1 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui button HOME|LOCK|SIRI"}
-		}
-		button := strings.ToUpper(vals[0])
-		if _, err := a.runIDB(target.UDID, "ui", "button", button); err != nil {
-			return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "button failed")
+		sel.normalize()
+		if sel.count() != 1 || sel.Index >= 0 || sel.ID != "" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui scroll-to --label <text>|--contains <text>|--select <expr> [--container <expr>] [--direction down] [--max-swipes 10] [--tap]"}
+		}
+		resp, err := a.scrollTo(target.UDID, *sel, scrollToOptions{
+			Container: *container,
+			Direction: *direction,
+			MaxSwipes: *maxSwipes,
+			Tap:       *tap,
+		})
+		if err != nil {
+			return emitJSON, err
 		}
-		resp := map[string]any{"ok": true, "action": "button", "button": button}
 		if emitJSON {
 			a.printJSON(resp)
 		} else {
-			fmt.Printf("button %s\n", button)
+			fmt.Printf("scrolled to element after %v swipes\n", resp["swipes"])
 		}
 		return emitJSON, nil
 
-	default:
-		return emitJSON, &AppError{Code: "USAGE", Message: "unknown ui subcommand: " + sub}
-	}
-}
-
-type frameUISample struct {
-	Raw              any
-	Elements         []Element
-	AllCount         int
-	InteractiveCount int
-	Hash             string
-}
-
-func (a *App) captureUISample(udid string, opts frameOptions) (frameUISample, error) {
-	cmd, runErr := a.runIDB(udid, "ui", "describe-all", "--json")
-	if runErr != nil {
-		return frameUISample{}, wrapAppErrCode(runErr, "IDB_UI_FAILED", "failed to capture ui tree")
-	}
-	parsed, parseErr := decodeJSONOrWrap(cmd.Stdout)
-	if parseErr != nil {
-		parsed = map[string]any{"raw": cmd.Stdout}
-	}
-	elements, allCount, interactiveCount := normalizeElements(parsed, opts)
-	return frameUISample{
-		Raw:              parsed,
-		Elements:         elements,
-		AllCount:         allCount,
-		InteractiveCount: interactiveCount,
-		Hash:             hashElementSet(elements),
-	}, nil
-}
-
-func (a *App) captureStableUISamples(udid string, opts frameOptions) ([]frameUISample, error) {
-	samples := make([]frameUISample, 0, opts.StableSamples)
-	hashes := make([]string, 0, opts.StableSamples)
-	for i := 0; i < opts.StableSamples; i++ {
-		sample, err := a.captureUISample(udid, opts)
+	case "inspect":
+		fs := flag.NewFlagSet("ui inspect", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		unit := fs.String("unit", "pt", "pt|px")
+		from := fs.String("from", "", "path to frame dir or elements.json for px conversion")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		if *unit != "pt" && *unit != "px" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "--unit must be pt|px"}
+		}
+		if fs.NArg() != 2 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui inspect <x> <y> [--unit pt|px]"}
+		}
+		x, errX := strconv.ParseFloat(fs.Arg(0), 64)
+		y, errY := strconv.ParseFloat(fs.Arg(1), 64)
+		if errX != nil || errY != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: "x and y must be numbers"}
+		}
+		if *unit == "px" {
+			_, transform, err := loadElementsAndTransform(*from)
+			if err != nil {
+				return emitJSON, err
+			}
+			if transform.Scale <= 0 {
+				return emitJSON, &AppError{Code: "COORD_TRANSFORM_FAILED", Message: "invalid transform scale"}
+			}
+			x = x / transform.Scale
+			y = y / transform.Scale
+		}
+		elem, found, err := a.describePoint(target.UDID, x, y)
 		if err != nil {
-			return nil, err
+			return emitJSON, err
 		}
-		samples = append(samples, sample)
-		hashes = append(hashes, sample.Hash)
-		if i+1 < opts.StableSamples && opts.StableInterval > 0 {
-			time.Sleep(opts.StableInterval)
+		resp := map[string]any{"ok": true, "action": "inspect", "point": map[string]any{"x": x, "y": y, "unit": "pt"}, "found": found}
+		if found {
+			resp["element"] = elem
 		}
-	}
-	if !allStringsEqual(hashes) {
-		return nil, &AppError{
-			Code:    "FRAME_UNSTABLE",
-			Message: "ui tree changed during stable sampling",
-			Details: map[string]any{
-				"hashes":   hashes,
-				"samples":  opts.StableSamples,
-				"interval": opts.StableInterval.String(),
-			},
+		if emitJSON {
+			a.printJSON(resp)
+		} else if found {
+			fmt.Printf("%s %q value=%q frame=%.0f,%.0f %.0fx%.0f\n", elem.Role, elem.Label, elem.Value, elem.Frame.X, elem.Frame.Y, elem.Frame.W, elem.Frame.H)
+		} else {
+			fmt.Println("no element at point")
 		}
-	}
+		return emitJSON, nil
+
+	case "pick":
+		fs := flag.NewFlagSet("ui pick", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		sel := addSelectorFlags(fs, "picker")
+		from := fs.String("from", "", "path to elements.json")
+		value := fs.String("value", "", "value to select")
+		wheel := fs.Int("wheel", 0, "wheel number, left to right (1-based), when the picker has several")
+		maxSwipes := fs.Int("max-swipes", defaultPickSwipes, "maximum number of swipes")
+		rowHeight := fs.Float64("row-height", 0, "wheel row height in pt (estimated from the wheel frame by default)")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		sel.normalize()
+		if sel.count() != 1 || strings.TrimSpace(*value) == "" || fs.NArg() != 0 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui pick <selector> --value <text> [--wheel N] [--max-swipes 20] [--row-height pt]"}
+		}
+		match, err := a.resolveElement(target.UDID, *from, *sel)
+		if err != nil {
+			return emitJSON, err
+		}
+		resp, err := a.pickWheelValue(target.UDID, match.Element, pickOptions{
+			Value:     *value,
+			Wheel:     *wheel,
+			MaxSwipes: *maxSwipes,
+			RowHeight: *rowHeight,
+			Normalize: sel.Normalize,
+		})
+		if err != nil {
+			return emitJSON, err
+		}
+		if sel.Explain {
+			match.explain(resp)
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("picked %q after %v swipes\n", resp["value"], resp["swipes"])
+		}
+		return emitJSON, nil
+
+	case "set-slider":
+		fs := flag.NewFlagSet("ui set-slider", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		sel := addSelectorFlags(fs, "slider")
+		from := fs.String("from", "", "path to elements.json")
+		to := fs.Float64("to", -1, "target value between 0 and 1")
+		tolerance := fs.Float64("tolerance", defaultSliderTolerance, "accepted difference from --to")
+		attempts := fs.Int("attempts", 3, "maximum drags")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		sel.normalize()
+		if sel.count() != 1 || fs.NArg() != 0 || *to < 0 || *to > 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui set-slider <selector> --to <0..1> [--tolerance 0.02] [--attempts 3]"}
+		}
+		match, err := a.resolveElement(target.UDID, *from, *sel)
+		if err != nil {
+			return emitJSON, err
+		}
+		resp, err := a.setSlider(target.UDID, match.Element, *to, *tolerance, *attempts)
+		if err != nil {
+			return emitJSON, err
+		}
+		if sel.Explain {
+			match.explain(resp)
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("slider %v\n", resp["value"])
+		}
+		return emitJSON, nil
+
+	case "toggle":
+		fs := flag.NewFlagSet("ui toggle", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		sel := addSelectorFlags(fs, "switch")
+		from := fs.String("from", "", "path to elements.json")
+		on := fs.Bool("on", false, "turn the switch on")
+		off := fs.Bool("off", false, "turn the switch off")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		sel.normalize()
+		if sel.count() != 1 || fs.NArg() != 0 || *on == *off {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui toggle <selector> --on|--off"}
+		}
+		match, err := a.resolveElement(target.UDID, *from, *sel)
+		if err != nil {
+			return emitJSON, err
+		}
+		resp, err := a.setSwitch(target.UDID, match.Element, *on)
+		if err != nil {
+			return emitJSON, err
+		}
+		if sel.Explain {
+			match.explain(resp)
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("switch %v (changed: %v)\n", resp["state"], resp["changed"])
+		}
+		return emitJSON, nil
+
+	case "drag":
+		fs := flag.NewFlagSet("ui drag", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fromSel := addEndpointSelectorFlags(fs, "from")
+		toSel := addEndpointSelectorFlags(fs, "to")
+		fromPoint := fs.String("from-point", "", "start point x,y")
+		toPoint := fs.String("to-point", "", "end point x,y")
+		unit := fs.String("unit", "pt", "pt|px for --from-point/--to-point")
+		elementsPath := fs.String("elements", "", "path to elements.json")
+		duration := fs.Duration("duration", defaultDragDuration, "move duration")
+		hold := fs.Duration("hold", 0, "press duration before moving")
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		if *unit != "pt" && *unit != "px" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "--unit must be pt|px"}
+		}
+		if *duration <= 0 || *hold < 0 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "--duration must be > 0 and --hold >= 0"}
+		}
+
+		start, startInfo, err := a.resolveDragEndpoint(target.UDID, "from", *fromPoint, *fromSel, *unit, *elementsPath)
+		if err != nil {
+			return emitJSON, err
+		}
+		end, endInfo, err := a.resolveDragEndpoint(target.UDID, "to", *toPoint, *toSel, *unit, *elementsPath)
+		if err != nil {
+			return emitJSON, err
+		}
+
+		plan := planDrag(start, end, *duration)
+		if *hold > 0 {
+			// idb's swipe cannot pause before moving, so a held drag is sent
+			// as explicit touch events.
+			if err := a.runHIDEvents(target.UDID, plan.heldEvents(*hold)); err != nil {
+				return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "drag failed")
+			}
+		} else if _, err := a.runIDB(target.UDID, plan.idbArgs()...); err != nil {
+			return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "drag failed")
+		}
+
+		resp := map[string]any{
+			"ok":         true,
+			"action":     "drag",
+			"from":       startInfo,
+			"to":         endInfo,
+			"fromPt":     map[string]any{"x": start.X, "y": start.Y},
+			"toPt":       map[string]any{"x": end.X, "y": end.Y},
+			"durationMs": duration.Milliseconds(),
+			"holdMs":     hold.Milliseconds(),
+			"steps":      plan.Steps,
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("drag %.2f,%.2f -> %.2f,%.2f\n", start.X, start.Y, end.X, end.Y)
+		}
+		return emitJSON, nil
+
+	case "button":
+		fs := flag.NewFlagSet("ui button", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		expect := addExpectFlags(fs)
+		localJSON := fs.Bool("json", false, "")
+		if err := fs.Parse(args); err != nil {
+			return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+		}
+		emitJSON = emitJSON || *localJSON
+		vals := fs.Args()
+		if len(vals) != 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui button HOME|LOCK|SIRI"}
+		}
+		button := strings.ToUpper(vals[0])
+		before, err := a.expectBaseline(target.UDID, *expect)
+		if err != nil {
+			return emitJSON, err
+		}
+		if _, err := a.runIDB(target.UDID, "ui", "button", button); err != nil {
+			return emitJSON, wrapAppErrCode(err, "IDB_UI_FAILED", "button failed")
+		}
+		resp := map[string]any{"ok": true, "action": "button", "button": button}
+		if expect.active() {
+			result, err := a.awaitExpectation(target.UDID, *expect, before)
+			if err != nil {
+				return emitJSON, err
+			}
+			resp["expect"] = result
+		}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("button %s\n", button)
+		}
+		return emitJSON, nil
+
+	default:
+		return emitJSON, &AppError{Code: "USAGE", Message: "unknown ui subcommand: " + sub}
+	}
+}
+
+// fillFrameManifest records the device and app context needed to reproduce a frame.
+// Appearance and foreground app lookups are best-effort and left empty on failure.
+func (a *App) fillFrameManifest(m *FrameManifest, target SimTarget, opts frameOptions, rawUI any, transform Transform, uiHash string) {
+	m.SimagentVersion = version
+	m.CreatedAt = time.Now().Format(time.RFC3339)
+	m.Device.Name = target.Name
+	m.Device.UDID = target.UDID
+	m.Device.Type = target.DeviceType
+	m.Device.Runtime = target.Runtime
+	m.Device.State = target.State
+	m.Device.Orientation = transform.Orientation
+	if cmd, err := a.runSimctl("ui", target.UDID, "appearance"); err == nil {
+		m.Device.Appearance = strings.TrimSpace(cmd.Stdout)
+	}
+	if cmd, err := a.runSimctl("spawn", target.UDID, "launchctl", "list"); err == nil {
+		m.App.BundleID = foregroundBundleIDFromLaunchctl(cmd.Stdout)
+	}
+	if app, ok := findApplicationNode(rawUI); ok {
+		m.App.Name = firstString(app, []string{"label", "AXLabel", "title", "name"})
+	}
+	m.UIHash = uiHash
+	m.Options = opts.manifestOptions()
+}
+
+func (o frameOptions) manifestOptions() map[string]any {
+	return map[string]any{
+		"screenshot":      o.Screenshot,
+		"ui":              o.UI,
+		"annotate":        o.Annotate,
+		"interactiveOnly": o.InteractiveOnly,
+		"stable":          o.Stable,
+		"stableSamples":   o.StableSamples,
+		"stableInterval":  o.StableInterval.String(),
+		"order":           o.Order,
+		"format":          o.Format,
+		"minArea":         o.MinArea,
+		"includeKeyboard": o.IncludeKeyboard,
+		"includeRoles":    sortedSetKeys(o.IncludeRoles),
+		"excludeRoles":    sortedSetKeys(o.ExcludeRoles),
+	}
+}
+
+// foregroundBundleIDFromLaunchctl picks the running UIKit application from
+// `launchctl list` output. Third-party apps win over com.apple.* ones and the
+// most recently started process (highest PID) wins among equals.
+func foregroundBundleIDFromLaunchctl(out string) string {
+	const prefix = "UIKitApplication:"
+	best := ""
+	bestPID := -1
+	bestThirdParty := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[2], prefix) {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		bundleID := strings.TrimPrefix(fields[2], prefix)
+		if i := strings.Index(bundleID, "["); i >= 0 {
+			bundleID = bundleID[:i]
+		}
+		if bundleID == "" {
+			continue
+		}
+		thirdParty := !strings.HasPrefix(bundleID, "com.apple.")
+		if best == "" || (thirdParty && !bestThirdParty) || (thirdParty == bestThirdParty && pid > bestPID) {
+			best = bundleID
+			bestPID = pid
+			bestThirdParty = thirdParty
+		}
+	}
+	return best
+}
+
+func findApplicationNode(rawUI any) (map[string]any, bool) {
+	nodes := make([]candidateNode, 0, 16)
+	order := 0
+	walkCandidates(rawUI, "", &order, &nodes)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].Order < nodes[j].Order
+	})
+	for _, node := range nodes {
+		role := strings.ToLower(firstString(node.Map, []string{"type", "role", "role_description", "AXRole"}))
+		if !strings.Contains(role, "application") {
+			continue
+		}
+		if rect, ok := findRect(node.Map); ok && rect.W > 0 && rect.H > 0 {
+			return node.Map, true
+		}
+	}
+	return nil, false
+}
+
+func orientationForSize(w, h float64) string {
+	if w <= 0 || h <= 0 {
+		return ""
+	}
+	if w > h {
+		return "landscape"
+	}
+	return "portrait"
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type frameUISample struct {
+	Raw              any
+	Elements         []Element
+	AllCount         int
+	InteractiveCount int
+	Keyboard         KeyboardState
+	Alert            *AlertState
+	Hash             string
+}
+
+func (a *App) captureUISample(udid string, opts frameOptions) (frameUISample, error) {
+	cmd, runErr := a.runIDB(udid, "ui", "describe-all", "--json")
+	if runErr != nil {
+		return frameUISample{}, wrapAppErrCode(runErr, "IDB_UI_FAILED", "failed to capture ui tree")
+	}
+	parsed, parseErr := decodeJSONOrWrap(cmd.Stdout)
+	if parseErr != nil {
+		parsed = map[string]any{"raw": cmd.Stdout}
+	}
+	normalized := normalizeElements(parsed, opts)
+	return frameUISample{
+		Raw:              parsed,
+		Elements:         normalized.Elements,
+		AllCount:         normalized.AllCount,
+		InteractiveCount: normalized.InteractiveCount,
+		Keyboard:         normalized.Keyboard,
+		Alert:            normalized.Alert,
+		Hash:             hashElementSet(normalized.Elements),
+	}, nil
+}
+
+func (a *App) captureStableUISamples(udid string, opts frameOptions) ([]frameUISample, error) {
+	samples := make([]frameUISample, 0, opts.StableSamples)
+	hashes := make([]string, 0, opts.StableSamples)
+	for i := 0; i < opts.StableSamples; i++ {
+		sample, err := a.captureUISample(udid, opts)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+		hashes = append(hashes, sample.Hash)
+		if i+1 < opts.StableSamples && opts.StableInterval > 0 {
+			time.Sleep(opts.StableInterval)
+		}
+	}
+	if !allStringsEqual(hashes) {
+		return nil, &AppError{
+			Code:    "FRAME_UNSTABLE",
+			Message: "ui tree changed during stable sampling",
+			Details: map[string]any{
+				"hashes":   hashes,
+				"samples":  opts.StableSamples,
+				"interval": opts.StableInterval.String(),
+			},
+		}
+	}
 	return samples, nil
 }
 
@@ -1145,52 +1861,257 @@ func allStringsEqual(values []string) bool {
 	return true
 }
 
-func (a *App) cmdUIFlow(target SimTarget, args []string, emitJSON bool) (bool, error) {
-	if len(args) == 0 {
-		return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui flow run --file <path> [--resume-from <step>]"}
-	}
-	sub := args[0]
-	if sub != "run" {
-		return emitJSON, &AppError{Code: "USAGE", Message: "unknown ui flow subcommand: " + sub}
-	}
+const (
+	// batchSnapshotTTL bounds how old a cached UI snapshot may be when a
+	// batch command reuses it.
+	batchSnapshotTTL  = time.Second
+	maxBatchLineBytes = 1 << 20
+)
 
-	fs := flag.NewFlagSet("ui flow run", flag.ContinueOnError)
+// batchSession is the state `ui batch` shares across its commands: the
+// resolved target and the last UI snapshot. The snapshot is served at most
+// once, only to the first capture of a new line, only while younger than
+// batchSnapshotTTL, and is dropped by any command that may change the UI.
+// Captures later in the same line (wait or verification polls) are always
+// live.
+type batchSession struct {
+	target    SimTarget
+	line      int
+	lineStart bool
+	cache     *elementSnapshot
+	cacheUDID string
+	cacheKB   bool
+	cachedAt  time.Time
+	hits      int
+}
+
+// beginLine marks the start of a batch line so its first capture may reuse
+// the previous line's snapshot.
+func (b *batchSession) beginLine(lineNo int) {
+	b.line = lineNo
+	b.lineStart = true
+}
+
+func (b *batchSession) cached(udid string, includeKeyboard bool) (elementSnapshot, bool) {
+	first := b.lineStart
+	b.lineStart = false
+	if !first || b.cache == nil || b.cacheUDID != udid || b.cacheKB != includeKeyboard || time.Since(b.cachedAt) > batchSnapshotTTL {
+		return elementSnapshot{}, false
+	}
+	snapshot := *b.cache
+	b.cache = nil
+	b.hits++
+	return snapshot, true
+}
+
+func (b *batchSession) store(udid string, includeKeyboard bool, snapshot elementSnapshot) {
+	b.cache = &snapshot
+	b.cacheUDID = udid
+	b.cacheKB = includeKeyboard
+	b.cachedAt = time.Now()
+}
+
+func (b *batchSession) invalidate() {
+	b.cache = nil
+}
+
+// readOnlySimctl lists simctl subcommands that cannot change the UI.
+var readOnlySimctl = map[string]bool{"list": true, "listapps": true, "pbpaste": true, "io": true}
+
+// cmdUIBatch runs newline-delimited commands from stdin in this process and
+// streams one compact JSON result per line. A line is either CLI arguments
+// (with or without the leading "ui") or a JSON flow step.
+func (a *App) cmdUIBatch(target SimTarget, args []string, emitJSON bool) (bool, error) {
+	fs := flag.NewFlagSet("ui batch", flag.ContinueOnError)
 	fs.SetOutput(io.Discard)
-	file := fs.String("file", "", "path to flow json")
-	resumeFrom := fs.Int("resume-from", 1, "1-based step index to resume from")
-	localJSON := fs.Bool("json", false, "")
-	if err := fs.Parse(args[1:]); err != nil {
-		return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
-	}
-	emitJSON = emitJSON || *localJSON
-	if strings.TrimSpace(*file) == "" {
-		return emitJSON, &AppError{Code: "USAGE", Message: "--file is required"}
-	}
-	if *resumeFrom <= 0 {
-		return emitJSON, &AppError{Code: "USAGE", Message: "--resume-from must be >= 1"}
+	stopOnError := fs.Bool("stop-on-error", false, "stop at the first failing command")
+	fs.Bool("json", false, "")
+	if err := fs.Parse(args); err != nil {
+		return true, &AppError{Code: "USAGE", Message: err.Error()}
 	}
 	if fs.NArg() != 0 {
-		return emitJSON, &AppError{Code: "USAGE", Message: "ui flow run does not accept positional args"}
+		return true, &AppError{Code: "USAGE", Message: "usage: simagent ui batch [--stop-on-error] < commands"}
 	}
+	if a.batch != nil {
+		return true, &AppError{Code: "USAGE", Message: "ui batch cannot be nested"}
+	}
+	a.batch = &batchSession{target: target}
+	a.opts.JSON = true
 
-	b, err := os.ReadFile(*file)
-	if err != nil {
-		return emitJSON, wrapErr("IO_ERROR", "failed to read flow file", err)
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLineBytes)
+	commands, failed := 0, 0
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands++
+		a.batch.beginLine(lineNo)
+		if err := a.runBatchLine(target, line); err != nil {
+			failed++
+			a.printJSON(map[string]any{"ok": false, "error": toAppError(err)})
+			if *stopOnError {
+				break
+			}
+		}
 	}
-	var flow uiFlowFile
-	if err := json.Unmarshal(b, &flow); err != nil {
-		return emitJSON, wrapErr("IO_ERROR", "failed to parse flow file json", err)
+	a.batch.line = 0
+	if err := scanner.Err(); err != nil {
+		return true, wrapErr("IO_ERROR", "failed to read batch input", err)
 	}
-	if len(flow.Steps) == 0 {
-		return emitJSON, &AppError{Code: "USAGE", Message: "flow file must include at least one step"}
+	summary := map[string]any{"commands": commands, "failed": failed, "snapshotCacheHits": a.batch.hits}
+	if failed > 0 {
+		return true, &AppError{Code: "BATCH_FAILED", Message: fmt.Sprintf("%d of %d batch commands failed", failed, commands), Details: summary}
 	}
-	if *resumeFrom > len(flow.Steps) {
-		return emitJSON, &AppError{Code: "USAGE", Message: "--resume-from exceeds number of steps"}
+	summary["ok"] = true
+	summary["action"] = "batch"
+	a.printJSON(summary)
+	return true, nil
+}
+
+func (a *App) runBatchLine(target SimTarget, line string) error {
+	if strings.HasPrefix(line, "{") {
+		var step uiFlowStep
+		if err := json.Unmarshal([]byte(line), &step); err != nil {
+			return wrapErr("USAGE", "invalid batch json line", err)
+		}
+		result, err := a.executeFlowStep(target, step)
+		if err != nil {
+			return err
+		}
+		result["ok"] = true
+		a.printJSON(result)
+		return nil
+	}
+	tokens, err := splitCommandLine(line)
+	if err != nil {
+		return err
+	}
+	if len(tokens) > 0 && tokens[0] == "simagent" {
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return &AppError{Code: "USAGE", Message: "empty batch command"}
+	}
+	switch tokens[0] {
+	case "target", "frame", "app", "pasteboard", "raw":
+		_, err = a.dispatch(tokens)
+	case "ui":
+		_, err = a.cmdUI(tokens[1:])
+	default:
+		_, err = a.cmdUI(tokens)
+	}
+	return err
+}
+
+// splitCommandLine splits a batch line into arguments like a POSIX shell:
+// whitespace separates words, single quotes are literal, and double quotes
+// and backslashes escape.
+func splitCommandLine(line string) ([]string, error) {
+	words := make([]string, 0, 8)
+	var word strings.Builder
+	inWord := false
+	quote := rune(0)
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, &AppError{Code: "USAGE", Message: "unterminated quote or escape in batch line"}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func (a *App) cmdUIFlow(target SimTarget, args []string, emitJSON bool) (bool, error) {
+	if len(args) == 0 {
+		return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent ui flow run --file <path> [--resume-from <step>]"}
+	}
+	sub := args[0]
+	if sub != "run" {
+		return emitJSON, &AppError{Code: "USAGE", Message: "unknown ui flow subcommand: " + sub}
+	}
+
+	fs := flag.NewFlagSet("ui flow run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	file := fs.String("file", "", "path to flow json")
+	resumeFrom := fs.Int("resume-from", 1, "1-based step index to resume from")
+	autoDismissAlerts := fs.Bool("auto-dismiss-alerts", false, "handle system alerts before each step")
+	alertAction := fs.String("alert-action", "dismiss", "accept|dismiss for --auto-dismiss-alerts")
+	localJSON := fs.Bool("json", false, "")
+	if err := fs.Parse(args[1:]); err != nil {
+		return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+	}
+	emitJSON = emitJSON || *localJSON
+	if strings.TrimSpace(*file) == "" {
+		return emitJSON, &AppError{Code: "USAGE", Message: "--file is required"}
+	}
+	if *resumeFrom <= 0 {
+		return emitJSON, &AppError{Code: "USAGE", Message: "--resume-from must be >= 1"}
+	}
+	if fs.NArg() != 0 {
+		return emitJSON, &AppError{Code: "USAGE", Message: "ui flow run does not accept positional args"}
+	}
+	if *alertAction != "accept" && *alertAction != "dismiss" {
+		return emitJSON, &AppError{Code: "USAGE", Message: "--alert-action must be accept|dismiss"}
+	}
+
+	b, err := os.ReadFile(*file)
+	if err != nil {
+		return emitJSON, wrapErr("IO_ERROR", "failed to read flow file", err)
+	}
+	var flow uiFlowFile
+	if err := json.Unmarshal(b, &flow); err != nil {
+		return emitJSON, wrapErr("IO_ERROR", "failed to parse flow file json", err)
+	}
+	if len(flow.Steps) == 0 {
+		return emitJSON, &AppError{Code: "USAGE", Message: "flow file must include at least one step"}
+	}
+	if *resumeFrom > len(flow.Steps) {
+		return emitJSON, &AppError{Code: "USAGE", Message: "--resume-from exceeds number of steps"}
 	}
 
 	results := make([]map[string]any, 0, len(flow.Steps)-(*resumeFrom-1))
 	for i := *resumeFrom - 1; i < len(flow.Steps); i++ {
 		step := flow.Steps[i]
+		var handledAlerts []map[string]any
+		if *autoDismissAlerts {
+			handledAlerts = a.autoHandleAlerts(target.UDID, *alertAction)
+		}
 		stepResult, stepErr := a.executeFlowStep(target, step)
 		if stepErr != nil {
 			outDir := filepath.Join(os.TempDir(), "simagent", fmt.Sprintf("flow-failure-%s-step-%02d", time.Now().Format("2006-01-02T15-04-05"), i+1))
@@ -1210,6 +2131,9 @@ func (a *App) cmdUIFlow(target SimTarget, args []string, emitJSON bool) (bool, e
 		}
 		stepResult["step"] = i + 1
 		stepResult["name"] = strings.TrimSpace(step.Name)
+		if len(handledAlerts) > 0 {
+			stepResult["alertsHandled"] = handledAlerts
+		}
 		results = append(results, stepResult)
 	}
 
@@ -1232,45 +2156,81 @@ func (a *App) cmdUIFlow(target SimTarget, args []string, emitJSON bool) (bool, e
 func (a *App) executeFlowStep(target SimTarget, step uiFlowStep) (map[string]any, error) {
 	action := strings.ToLower(strings.TrimSpace(step.Action))
 	switch action {
-	case "tap":
+	case "tap", "doubletap", "longpress":
+		count := step.Count
+		var duration time.Duration
+		if strings.TrimSpace(step.Duration) != "" {
+			parsed, err := time.ParseDuration(strings.TrimSpace(step.Duration))
+			if err != nil {
+				return nil, &AppError{Code: "USAGE", Message: "invalid duration: " + step.Duration}
+			}
+			duration = parsed
+		}
+		gesture, err := newTapGesture(action, count, duration)
+		if err != nil {
+			return nil, err
+		}
 		if step.X != nil && step.Y != nil {
-			if _, err := a.runIDB(target.UDID, "ui", "tap", idbCoordArg(*step.X), idbCoordArg(*step.Y)); err != nil {
-				return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "tap failed")
+			point := FramePoint{X: *step.X, Y: *step.Y, Unit: "pt"}
+			var hitInfo map[string]any
+			if step.HitTest {
+				if hitInfo, err = a.hitTest(target.UDID, point, Element{}, false); err != nil {
+					return nil, err
+				}
+			}
+			if err := a.performTap(target.UDID, point.X, point.Y, gesture); err != nil {
+				return nil, err
+			}
+			result := map[string]any{"action": action, "by": "coord", "targetPt": map[string]any{"x": point.X, "y": point.Y}, "gesture": gesture.details()}
+			if hitInfo != nil {
+				result["hitTest"] = hitInfo
 			}
-			return map[string]any{"action": "tap", "by": "coord", "targetPt": map[string]any{"x": *step.X, "y": *step.Y}}, nil
+			return result, nil
 		}
-		index, id, label, contains := selectorsFromFlowStep(step)
-		if countElementSelectors(index, id, label, contains) != 1 {
-			return nil, &AppError{Code: "USAGE", Message: "flow tap requires x/y or exactly one selector"}
+		sel := selectorsFromFlowStep(step)
+		if sel.count() != 1 {
+			return nil, &AppError{Code: "USAGE", Message: "flow " + action + " requires x/y or exactly one selector"}
 		}
-		elem, err := a.resolveElementForInput(target.UDID, "", index, id, label, contains)
+		match, err := a.resolveElement(target.UDID, "", sel)
 		if err != nil {
 			return nil, err
 		}
+		elem := match.Element
 		tapPoint := elem.Center
 		if isTextInputRole(elem.Role) {
 			tapPoint = focusPointForElement(elem)
 		}
-		if _, err := a.runIDB(target.UDID, "ui", "tap", idbCoordArg(tapPoint.X), idbCoordArg(tapPoint.Y)); err != nil {
-			return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "tap failed")
+		var hitInfo map[string]any
+		if step.HitTest {
+			if hitInfo, err = a.hitTest(target.UDID, tapPoint, elem, true); err != nil {
+				return nil, err
+			}
+		}
+		if err := a.performTap(target.UDID, tapPoint.X, tapPoint.Y, gesture); err != nil {
+			return nil, err
 		}
-		return map[string]any{
-			"action":   "tap",
-			"by":       "selector",
-			"selector": map[string]any{"index": index, "id": id, "label": label, "contains": contains},
+		result := map[string]any{
+			"action":   action,
+			"by":       match.By,
+			"selector": sel.details(),
 			"targetPt": map[string]any{"x": tapPoint.X, "y": tapPoint.Y},
-		}, nil
+			"gesture":  gesture.details(),
+		}
+		if hitInfo != nil {
+			result["hitTest"] = hitInfo
+		}
+		return result, nil
 	case "type":
 		text := strings.TrimSpace(step.Text)
 		if text == "" {
 			return nil, &AppError{Code: "USAGE", Message: "flow type requires text"}
 		}
-		index, id, label, contains := selectorsFromFlowStep(step)
+		sel := selectorsFromFlowStep(step)
 		into := step.Into != nil && *step.Into
-		if step.Into == nil && countElementSelectors(index, id, label, contains) == 1 {
+		if step.Into == nil && sel.count() == 1 {
 			into = true
 		}
-		if into && countElementSelectors(index, id, label, contains) != 1 {
+		if into && sel.count() != 1 {
 			return nil, &AppError{Code: "USAGE", Message: "flow type --into requires exactly one selector"}
 		}
 
@@ -1278,14 +2238,19 @@ func (a *App) executeFlowStep(target SimTarget, step uiFlowStep) (map[string]any
 		if err != nil {
 			return nil, err
 		}
+		chunking, err := newInputChunking(step.ChunkSize, step.ChunkDelay)
+		if err != nil {
+			return nil, err
+		}
 
 		var focused *Element
+		var clearResult map[string]any
 		if into {
-			elem, err := a.resolveElementForInput(target.UDID, "", index, id, label, contains)
+			match, err := a.resolveElement(target.UDID, "", sel)
 			if err != nil {
 				return nil, err
 			}
-			focusedElem, err := a.focusElementWithRetry(target.UDID, elem, 2)
+			focusedElem, err := a.focusElementWithRetry(target.UDID, match.Element, 2)
 			if err != nil {
 				return nil, err
 			}
@@ -1295,32 +2260,65 @@ func (a *App) executeFlowStep(target SimTarget, step uiFlowStep) (map[string]any
 				if _, err := a.runIDB(target.UDID, "ui", "tap", idbCoordArg(clearPoint.X), idbCoordArg(clearPoint.Y)); err != nil {
 					return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "focus tap failed before replace")
 				}
-				if err := a.clearFocusedInput(target.UDID, estimateClearBackspaces(focusedElem)); err != nil {
+				strategy := flowClearStrategy(step)
+				if err := validateClearStrategy(strategy); err != nil {
+					return nil, err
+				}
+				cleared, err := a.clearInputField(target.UDID, focusedElem, strategy, 0)
+				if err != nil {
 					return nil, err
 				}
+				clearResult = cleared
 			}
 		}
-		if err := a.submitTextInput(target.UDID, prepared, step.Paste, focused); err != nil {
+		mode, err := parseVerifyMode(step.VerifyMode)
+		if err != nil {
+			return nil, err
+		}
+		input := textInputOptions{Paste: step.Paste, Chunking: chunking, VerifyMode: mode, SecureBaseline: a.secureBaseline(target.UDID, focused)}
+		if err := a.submitTextInput(target.UDID, prepared, focused, input); err != nil {
 			return nil, err
 		}
 		result := map[string]any{"action": "type", "text": prepared, "inputMode": inputMode}
+		if mode.Kind != "" {
+			result["verifyMode"] = mode.String()
+		}
+		if clearResult != nil {
+			result["clear"] = clearResult
+		}
 		if step.Verify {
-			verify, err := a.verifyTypeResult(target.UDID, prepared, focused)
+			verify, err := a.verifyTypeResult(target.UDID, prepared, focused, input)
 			if err != nil {
 				return nil, err
 			}
 			result["verify"] = verify
 		}
+		if step.Submit {
+			if err := a.pressKeyCombo(target.UDID, keyCombo{Name: "return", Key: 40}); err != nil {
+				return nil, err
+			}
+			result["submitted"] = true
+		}
 		return result, nil
+	case "key":
+		combo, err := parseKeyCombo(step.Key)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.pressKeyCombo(target.UDID, combo); err != nil {
+			return nil, err
+		}
+		return combo.details(), nil
 	case "clear":
-		index, id, label, contains := selectorsFromFlowStep(step)
-		if countElementSelectors(index, id, label, contains) != 1 {
+		sel := selectorsFromFlowStep(step)
+		if sel.count() != 1 {
 			return nil, &AppError{Code: "USAGE", Message: "flow clear requires exactly one selector"}
 		}
-		elem, err := a.resolveElementForInput(target.UDID, "", index, id, label, contains)
+		match, err := a.resolveElement(target.UDID, "", sel)
 		if err != nil {
 			return nil, err
 		}
+		elem := match.Element
 		if _, err := a.focusElementWithRetry(target.UDID, elem, 2); err != nil {
 			return nil, err
 		}
@@ -1328,56 +2326,67 @@ func (a *App) executeFlowStep(target SimTarget, step uiFlowStep) (map[string]any
 		if _, err := a.runIDB(target.UDID, "ui", "tap", idbCoordArg(clearPoint.X), idbCoordArg(clearPoint.Y)); err != nil {
 			return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "focus tap failed before clear")
 		}
-		count := estimateClearBackspaces(elem)
-		if err := a.clearFocusedInput(target.UDID, count); err != nil {
+		strategy := flowClearStrategy(step)
+		if err := validateClearStrategy(strategy); err != nil {
+			return nil, err
+		}
+		result, err := a.clearInputField(target.UDID, elem, strategy, 0)
+		if err != nil {
 			return nil, err
 		}
-		return map[string]any{"action": "clear", "backspaces": count}, nil
+		result["action"] = "clear"
+		return result, nil
 	case "swipe":
-		direction := strings.ToLower(strings.TrimSpace(step.Direction))
-		if direction == "" {
-			direction = "up"
-		}
-		if direction != "up" && direction != "down" && direction != "left" && direction != "right" {
-			return nil, &AppError{Code: "USAGE", Message: "flow swipe direction must be up|down|left|right"}
-		}
-		distance := step.Distance
-		if distance <= 0 {
-			distance = 220
-		}
-		startX := 196.0
-		startY := 426.0
-		index, id, _, _ := selectorsFromFlowStep(step)
-		if countElementSelectors(index, id, "", "") == 1 {
-			elem, err := a.resolveElementForInput(target.UDID, "", index, id, "", "")
+		if step.To != "" {
+			return nil, &AppError{Code: "USAGE", Message: "flow swipe takes its end point as toPoint"}
+		}
+		req := swipeRequest{
+			Direction: strings.ToLower(strings.TrimSpace(step.Direction)),
+			Distance:  string(step.Distance),
+			Unit:      step.Unit,
+			From:      strings.TrimSpace(step.FromPoint),
+			To:        strings.TrimSpace(step.ToPoint),
+			Preset:    strings.ToLower(strings.TrimSpace(step.Preset)),
+		}
+		if req.Direction == "" && req.Preset == "" && req.To == "" {
+			req.Direction = "up"
+		}
+		if strings.TrimSpace(step.Duration) != "" {
+			parsed, err := time.ParseDuration(strings.TrimSpace(step.Duration))
+			if err != nil {
+				return nil, &AppError{Code: "USAGE", Message: "invalid duration: " + step.Duration}
+			}
+			req.Duration = parsed
+		}
+		sel := selectorsFromFlowStep(step)
+		if sel.count() > 1 {
+			return nil, &AppError{Code: "USAGE", Message: "flow swipe accepts at most one selector"}
+		}
+		if sel.count() == 1 {
+			match, err := a.resolveElement(target.UDID, "", sel)
 			if err != nil {
 				return nil, err
 			}
-			startX = elem.Center.X
-			startY = elem.Center.Y
-		}
-		endX := startX
-		endY := startY
-		switch direction {
-		case "up":
-			endY -= distance
-		case "down":
-			endY += distance
-		case "left":
-			endX -= distance
-		case "right":
-			endX += distance
-		}
-		if _, err := a.runIDB(target.UDID, "ui", "swipe", idbCoordArg(startX), idbCoordArg(startY), idbCoordArg(endX), idbCoordArg(endY)); err != nil {
-			return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "swipe failed")
+			req.Start = &match.Element.Center
+		}
+		plan, err := planSwipe(req, a.swipeTransform(target.UDID, "", req))
+		if err != nil {
+			return nil, err
+		}
+		if err := a.performSwipe(target.UDID, plan); err != nil {
+			return nil, err
 		}
-		return map[string]any{"action": "swipe", "direction": direction}, nil
+		return plan.details(), nil
 	case "wait":
 		hasText := strings.TrimSpace(step.HasText)
 		interactiveMin := -1
 		if step.InteractiveMin != nil {
 			interactiveMin = *step.InteractiveMin
 		}
+		selectExpr := strings.TrimSpace(step.Selectors.Select)
+		if strings.TrimSpace(step.Wait.Select) != "" {
+			selectExpr = strings.TrimSpace(step.Wait.Select)
+		}
 		timeoutRaw := strings.TrimSpace(step.Timeout)
 		intervalRaw := strings.TrimSpace(step.Interval)
 		if strings.TrimSpace(step.Wait.HasText) != "" {
@@ -1407,18 +2416,152 @@ func (a *App) executeFlowStep(target SimTarget, step uiFlowStep) (map[string]any
 				return nil, &AppError{Code: "USAGE", Message: "invalid flow wait interval: " + intervalRaw}
 			}
 		}
-		return a.waitForCondition(target.UDID, hasText, interactiveMin, timeout, interval)
+		cond := waitConditions{
+			HasText:        hasText,
+			GoneText:       strings.TrimSpace(step.Wait.GoneText),
+			InteractiveMin: interactiveMin,
+			Select:         selectExpr,
+			Element:        strings.TrimSpace(step.Wait.Element),
+			State:          strings.TrimSpace(step.Wait.State),
+			Count:          strings.TrimSpace(step.Wait.Count),
+			Any:            step.Wait.Any,
+		}
+		if raw := strings.TrimSpace(step.Wait.Stable); raw != "" {
+			cond.Stable, err = time.ParseDuration(raw)
+			if err != nil {
+				return nil, &AppError{Code: "USAGE", Message: "invalid flow wait stable: " + raw}
+			}
+		}
+		return a.waitForCondition(target.UDID, cond, timeout, interval)
+	case "scroll-to":
+		sel := selectorsFromFlowStep(step)
+		if sel.count() != 1 || sel.Index >= 0 || sel.ID != "" {
+			return nil, &AppError{Code: "USAGE", Message: "flow scroll-to requires one label/contains/select selector"}
+		}
+		maxSwipes := step.MaxSwipes
+		if maxSwipes == 0 {
+			maxSwipes = 10
+		}
+		direction := step.Direction
+		if strings.TrimSpace(direction) == "" {
+			direction = "down"
+		}
+		return a.scrollTo(target.UDID, sel, scrollToOptions{
+			Container: step.Container,
+			Direction: direction,
+			MaxSwipes: maxSwipes,
+			Tap:       step.Tap,
+		})
+	case "pick":
+		sel := selectorsFromFlowStep(step)
+		if sel.count() != 1 || strings.TrimSpace(step.Value) == "" {
+			return nil, &AppError{Code: "USAGE", Message: "flow pick requires one selector and value"}
+		}
+		match, err := a.resolveElement(target.UDID, "", sel)
+		if err != nil {
+			return nil, err
+		}
+		maxSwipes := step.MaxSwipes
+		if maxSwipes == 0 {
+			maxSwipes = defaultPickSwipes
+		}
+		return a.pickWheelValue(target.UDID, match.Element, pickOptions{
+			Value:     step.Value,
+			Wheel:     step.Wheel,
+			MaxSwipes: maxSwipes,
+			Normalize: sel.Normalize,
+		})
+	case "set-slider":
+		sel := selectorsFromFlowStep(step)
+		to, err := strconv.ParseFloat(strings.TrimSpace(string(step.To)), 64)
+		if sel.count() != 1 || err != nil || to < 0 || to > 1 {
+			return nil, &AppError{Code: "USAGE", Message: "flow set-slider requires one selector and to between 0 and 1"}
+		}
+		match, err := a.resolveElement(target.UDID, "", sel)
+		if err != nil {
+			return nil, err
+		}
+		return a.setSlider(target.UDID, match.Element, to, defaultSliderTolerance, 3)
+	case "toggle":
+		sel := selectorsFromFlowStep(step)
+		if sel.count() != 1 || step.On == nil {
+			return nil, &AppError{Code: "USAGE", Message: "flow toggle requires one selector and on"}
+		}
+		match, err := a.resolveElement(target.UDID, "", sel)
+		if err != nil {
+			return nil, err
+		}
+		return a.setSwitch(target.UDID, match.Element, *step.On)
+	case "pasteboard-set":
+		if err := a.writePasteboard(target.UDID, step.Text); err != nil {
+			return nil, err
+		}
+		return map[string]any{"action": "pasteboard-set", "text": step.Text}, nil
+	case "assert-pasteboard":
+		content, err := a.readPasteboard(target.UDID)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := pasteboardMatches(content, step.Text, step.Match)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, &AppError{
+				Code:    "PASTEBOARD_MISMATCH",
+				Message: "pasteboard content does not match",
+				Details: map[string]any{"expected": step.Text, "match": step.Match, "actual": content},
+			}
+		}
+		return map[string]any{"action": "assert-pasteboard", "text": content}, nil
 	default:
 		return nil, &AppError{Code: "USAGE", Message: "unsupported flow action: " + action}
 	}
 }
 
-func selectorsFromFlowStep(step uiFlowStep) (int, string, string, string) {
-	index := -1
+// autoHandleAlerts clears up to three stacked alerts using the given action.
+// Failures are ignored so the step itself reports what went wrong.
+func (a *App) autoHandleAlerts(udid, action string) []map[string]any {
+	handled := make([]map[string]any, 0)
+	for i := 0; i < 3; i++ {
+		snapshot, err := a.captureElements(udid)
+		if err != nil || snapshot.Alert == nil {
+			break
+		}
+		resp, err := a.handleAlert(udid, snapshot.Alert, action, "")
+		if err != nil {
+			break
+		}
+		handled = append(handled, map[string]any{"title": resp["title"], "button": resp["button"]})
+	}
+	return handled
+}
+
+func selectorsFromFlowStep(step uiFlowStep) elementSelector {
+	sel := elementSelector{
+		Index:      -1,
+		ID:         step.Selectors.ID,
+		Label:      step.Selectors.Label,
+		Contains:   step.Selectors.Contains,
+		LabelRegex: step.Selectors.LabelRegex,
+		ValueRegex: step.Selectors.ValueRegex,
+		Select:     step.Selectors.Select,
+		Role:       step.Selectors.Role,
+		Below:      step.Selectors.Below,
+		Above:      step.Selectors.Above,
+		RightOf:    step.Selectors.RightOf,
+		LeftOf:     step.Selectors.LeftOf,
+		Inside:     step.Selectors.Inside,
+		Normalize:  step.Selectors.Normalize,
+		Nth:        step.Selectors.Nth,
+		First:      step.Selectors.First,
+		Last:       step.Selectors.Last,
+	}
 	if step.Selectors.Index != nil {
-		index = *step.Selectors.Index
+		sel.Index = *step.Selectors.Index
 	}
-	return index, strings.TrimSpace(step.Selectors.ID), strings.TrimSpace(step.Selectors.Label), strings.TrimSpace(step.Selectors.Contains)
+	sel.normalize()
+	return sel
 }
 
 func (a *App) captureFailureArtifacts(udid, outDir string) map[string]any {
@@ -1442,1457 +2585,5887 @@ func (a *App) captureFailureArtifacts(udid, outDir string) map[string]any {
 	return out
 }
 
-func (a *App) resolveElementForInput(udid, from string, index int, id, label, contains string) (Element, error) {
-	elements := []Element{}
-	if strings.TrimSpace(from) != "" || index >= 0 || strings.TrimSpace(id) != "" {
-		loadedElements, _, loadErr := loadElementsAndTransform(from)
-		if loadErr != nil {
-			return Element{}, loadErr
-		}
-		elements = loadedElements
-	} else if loadedElements, _, loadErr := loadElementsAndTransform(from); loadErr == nil {
-		elements = loadedElements
+// dismissKeyboard tries, in order, a dedicated hide-keyboard key, an accessory
+// Done button and an interactive swipe-down, checking the tree after each
+// attempt. The return key can submit a form, so it is tried last and only
+// when allowReturn is set.
+func (a *App) dismissKeyboard(udid string, allowReturn bool) (map[string]any, error) {
+	snapshot, err := a.captureElementsWithKeyboard(udid, true)
+	if err != nil {
+		return nil, err
 	}
-	elem, err := pickElementBySelectors(elements, index, id, label, contains)
-	if err == nil {
-		return elem, nil
+	if !snapshot.Keyboard.Visible || snapshot.Keyboard.Frame == nil {
+		return map[string]any{"ok": true, "action": "keyboard-dismiss", "method": "none", "wasVisible": false}, nil
 	}
+	kb := *snapshot.Keyboard.Frame
 
-	snapshot, snapErr := a.captureElements(udid)
-	if snapErr != nil {
-		return Element{}, err
+	type attempt struct {
+		Method string
+		Run    func() error
 	}
-	elem, err = pickElementBySelectors(snapshot.Elements, index, id, label, contains)
-	if err == nil {
-		return elem, nil
+	attempts := make([]attempt, 0, 4)
+	if key, ok := findKeyboardDismissElement(snapshot.Elements, kb); ok {
+		attempts = append(attempts, attempt{Method: "hide-key", Run: func() error {
+			_, err := a.runIDB(udid, "ui", "tap", idbCoordArg(key.Center.X), idbCoordArg(key.Center.Y))
+			return err
+		}})
 	}
-	if fallback, ok := pickIntentFallbackElement(snapshot.Elements, label, contains); ok {
-		return fallback, nil
+	if button, ok := findKeyboardAccessoryDismissElement(snapshot.Elements, kb); ok {
+		attempts = append(attempts, attempt{Method: "accessory-button", Run: func() error {
+			_, err := a.runIDB(udid, "ui", "tap", idbCoordArg(button.Center.X), idbCoordArg(button.Center.Y))
+			return err
+		}})
 	}
-	if fallback, ok := pickSystemFallbackElement(snapshot.Elements, label, contains); ok {
-		return fallback, nil
+	attempts = append(attempts, attempt{Method: "swipe-down", Run: func() error {
+		x := kb.X + kb.W/2
+		_, err := a.runIDB(udid, "ui", "swipe", idbCoordArg(x), idbCoordArg(kb.Y-12), idbCoordArg(x), idbCoordArg(kb.Y+kb.H*0.8))
+		return err
+	}})
+	if allowReturn {
+		attempts = append(attempts, attempt{Method: "return-key", Run: func() error {
+			_, err := a.runIDB(udid, "ui", "key", returnKeyCode)
+			return err
+		}})
 	}
-	return Element{}, err
-}
 
-func (a *App) focusElementWithRetry(udid string, elem Element, retries int) (Element, error) {
-	if retries <= 0 {
-		retries = 1
-	}
-	target := elem
-	focusPoint := focusPointForElement(target)
-	var lastReason string
-	var lastSnapshot *elementSnapshot
+	tried := make([]string, 0, len(attempts))
 	var lastErr error
-
-	for attempt := 1; attempt <= retries; attempt++ {
-		if _, err := a.runIDB(udid, "ui", "tap", idbCoordArg(focusPoint.X), idbCoordArg(focusPoint.Y)); err != nil {
-			lastErr = wrapAppErrCode(err, "IDB_UI_FAILED", "focus tap failed")
+	for _, at := range attempts {
+		tried = append(tried, at.Method)
+		if err := at.Run(); err != nil {
+			lastErr = wrapAppErrCode(err, "IDB_UI_FAILED", "keyboard dismiss action failed")
 			continue
 		}
-		time.Sleep(120 * time.Millisecond)
-		snapshot, err := a.captureElements(udid)
+		time.Sleep(300 * time.Millisecond)
+		after, err := a.captureElementsWithKeyboard(udid, true)
 		if err != nil {
 			lastErr = err
 			continue
 		}
-		lastSnapshot = &snapshot
-		matched, ok := findBestVerificationTarget(snapshot.Elements, target)
-		if !ok {
-			lastReason = "target element not found after tap"
-			continue
-		}
-		target = matched
-		focusPoint = focusPointForElement(target)
-		if canTrustFocus(snapshot.Elements, matched) {
-			target.Center = focusPoint
-			return target, nil
+		if !after.Keyboard.Visible {
+			return map[string]any{"ok": true, "action": "keyboard-dismiss", "method": at.Method, "wasVisible": true, "tried": tried}, nil
 		}
-		lastReason = "focus moved to different element"
-	}
-
-	details := map[string]any{
-		"selectorId": strings.TrimSpace(elem.ID),
-		"attempts":   retries,
-	}
-	if strings.TrimSpace(lastReason) != "" {
-		details["reason"] = lastReason
 	}
+	details := map[string]any{"tried": tried, "keyboard": kb}
 	if lastErr != nil {
 		details["lastError"] = renderError(lastErr)
 	}
-	if lastSnapshot != nil {
-		details["interactive"] = lastSnapshot.InteractiveCount
-	}
-	return Element{}, &AppError{Code: "TYPE_FOCUS_FAILED", Message: "failed to verify focus target after retries", Details: details}
+	return nil, &AppError{Code: "KEYBOARD_DISMISS_FAILED", Message: "keyboard is still visible after dismiss attempts", Details: details}
 }
 
-func canTrustFocus(elements []Element, target Element) bool {
-	hasFocused := false
+func findKeyboardDismissElement(elements []Element, kb FrameRect) (Element, bool) {
 	for _, elem := range elements {
-		if !elem.Focused {
+		if !elem.Enabled || !rectContainsPoint(kb, elem.Center) {
 			continue
 		}
-		hasFocused = true
-		if strings.TrimSpace(target.ID) == "" {
-			dx := elem.Center.X - target.Center.X
-			dy := elem.Center.Y - target.Center.Y
-			if math.Hypot(dx, dy) <= 24 {
-				return true
+		label := strings.ToLower(strings.TrimSpace(elem.Label))
+		for _, candidate := range keyboardDismissLabels {
+			if label == candidate {
+				return elem, true
 			}
 		}
-		if elem.ID == target.ID {
-			return true
-		}
 	}
-	return !hasFocused
+	return Element{}, false
 }
 
-func estimateClearBackspaces(elem Element) int {
-	runes := len([]rune(strings.TrimSpace(elem.Value)))
-	switch {
-	case runes <= 0:
-		return defaultClearKeys
-	case runes < 16:
-		return 24
-	case runes < 40:
-		return runes + 12
-	default:
-		return minInt(runes+16, 220)
+func findKeyboardAccessoryDismissElement(elements []Element, kb FrameRect) (Element, bool) {
+	for _, elem := range elements {
+		if !elem.Enabled || !elem.Visible || !isInteractiveRole(elem.Role) {
+			continue
+		}
+		if elem.Center.Y >= kb.Y || elem.Center.Y < kb.Y-60 {
+			continue
+		}
+		label := strings.ToLower(strings.TrimSpace(elem.Label))
+		for _, candidate := range keyboardAccessoryDismissLabels {
+			if label == candidate {
+				return elem, true
+			}
+		}
 	}
+	return Element{}, false
 }
 
-func (a *App) clearFocusedInput(udid string, count int) error {
-	if count <= 0 {
-		count = defaultClearKeys
+const (
+	defaultLongPressDuration = time.Second
+	// tapPressDuration and multiTapInterval shape each touch of a
+	// double/multi tap. They are sent as one touch sequence so the taps land
+	// inside UIKit's double-tap window.
+	tapPressDuration = 50 * time.Millisecond
+	multiTapInterval = 40 * time.Millisecond
+	maxTapCount      = 10
+)
+
+// tapGesture describes how a resolved point is tapped: Count taps in quick
+// succession, or a single press held for Duration when Kind is longpress.
+type tapGesture struct {
+	Kind     string
+	Count    int
+	Duration time.Duration
+}
+
+// newTapGesture validates a gesture. A zero count or duration means the flag
+// was not given: doubletap defaults to 2 taps, longpress to
+// defaultLongPressDuration, and a count on longpress or a duration on a tap
+// is rejected rather than ignored.
+func newTapGesture(kind string, count int, duration time.Duration) (tapGesture, error) {
+	g := tapGesture{Kind: kind, Count: count}
+	switch kind {
+	case "longpress":
+		if count != 0 {
+			return g, &AppError{Code: "USAGE", Message: "--count is not supported for longpress"}
+		}
+		if duration == 0 {
+			duration = defaultLongPressDuration
+		}
+		if duration < 0 {
+			return g, &AppError{Code: "USAGE", Message: "--duration must be > 0"}
+		}
+		g.Count = 1
+		g.Duration = duration
+	case "tap", "doubletap":
+		if duration != 0 {
+			return g, &AppError{Code: "USAGE", Message: "--duration is only supported for longpress"}
+		}
+		if count == 0 {
+			count = 1
+			if kind == "doubletap" {
+				count = 2
+			}
+			g.Count = count
+		}
+		if count < 1 || count > maxTapCount {
+			return g, &AppError{Code: "USAGE", Message: fmt.Sprintf("--count must be between 1 and %d", maxTapCount)}
+		}
+	default:
+		return g, &AppError{Code: "USAGE", Message: "unknown tap gesture: " + kind}
 	}
-	args := make([]string, 0, count+2)
-	args = append(args, "ui", "key-sequence")
-	for i := 0; i < count; i++ {
-		args = append(args, backspaceKeyCode)
+	return g, nil
+}
+
+func (g tapGesture) details() map[string]any {
+	out := map[string]any{"kind": g.Kind, "count": g.Count}
+	if g.Kind == "longpress" {
+		out["durationMs"] = g.Duration.Milliseconds()
 	}
-	if _, err := a.runIDB(udid, args...); err == nil {
-		return nil
+	return out
+}
+
+// describePoint returns the element idb reports at (x, y) in points.
+func (a *App) describePoint(udid string, x, y float64) (Element, bool, error) {
+	cmd, err := a.runIDB(udid, "ui", "describe-point", "--json", idbCoordArg(x), idbCoordArg(y))
+	if err != nil {
+		return Element{}, false, wrapAppErrCode(err, "IDB_UI_FAILED", "describe-point failed")
 	}
-	for i := 0; i < count; i++ {
-		if _, err := a.runIDB(udid, "ui", "key", backspaceKeyCode); err != nil {
-			return wrapAppErrCode(err, "IDB_UI_FAILED", "clear text failed")
-		}
+	if strings.TrimSpace(cmd.Stdout) == "" {
+		return Element{}, false, nil
 	}
-	return nil
+	parsed, err := decodeJSONOrWrap(cmd.Stdout)
+	if err != nil {
+		return Element{}, false, wrapErr("IDB_UI_FAILED", "failed to parse describe-point json", err)
+	}
+	if list, ok := parsed.([]any); ok && len(list) > 0 {
+		parsed = list[0]
+	}
+	node, ok := parsed.(map[string]any)
+	if !ok {
+		return Element{}, false, nil
+	}
+	elem, ok := elementFromCandidate(candidateNode{Path: "point", Map: node})
+	if ok {
+		elem.Source.Method = "describe-point"
+	}
+	return elem, ok, nil
 }
 
-func prepareTypedText(text string, asciiMode, pasteMode bool) (string, string, error) {
-	out := strings.TrimSpace(text)
-	if asciiMode {
-		out = asciiOnly(out)
-		if strings.TrimSpace(out) == "" {
-			return "", "", &AppError{Code: "TYPE_ASCII_EMPTY", Message: "text became empty after ASCII normalization"}
-		}
+// hitTest checks what is under point before a tap. With a selected target,
+// the hit element must be the target, inside it, or a container that is not
+// screen-sized; the keyboard or an alert covering the point always fails.
+func (a *App) hitTest(udid string, point FramePoint, target Element, hasTarget bool) (map[string]any, error) {
+	snapshot, err := a.captureElements(udid)
+	if err != nil {
+		return nil, err
 	}
-	mode := "type"
-	if pasteMode && asciiMode {
-		mode = "paste-ascii"
-	} else if pasteMode {
-		mode = "paste"
-	} else if asciiMode {
-		mode = "ascii"
+	hit, found, err := a.describePoint(udid, point.X, point.Y)
+	if err != nil {
+		return nil, err
 	}
-	return out, mode, nil
+	info := map[string]any{"found": found}
+	if found {
+		info["element"] = hit
+	}
+	if reason := hitTestOcclusion(point, target, hasTarget, hit, found, snapshot); reason != "" {
+		details := map[string]any{"reason": reason, "point": map[string]any{"x": point.X, "y": point.Y}}
+		if found {
+			details["hit"] = hit
+		}
+		if hasTarget {
+			details["target"] = target
+		}
+		message := "tap point is covered by " + reason
+		if reason == "unknown" {
+			message = "nothing found at tap point; cannot verify it is not covered"
+		}
+		return nil, &AppError{Code: "TAP_OCCLUDED", Message: message, Details: details}
+	}
+	return info, nil
 }
 
-func asciiOnly(s string) string {
-	var b strings.Builder
-	for _, r := range s {
-		if r >= 32 && r <= 126 {
-			b.WriteRune(r)
-		}
+// hitTestOcclusion returns what covers point ("keyboard", "alert",
+// "overlay"), "unknown" when describe-point found nothing to check, or ""
+// when the tap would reach target.
+func hitTestOcclusion(point FramePoint, target Element, hasTarget bool, hit Element, found bool, snapshot elementSnapshot) string {
+	if snapshot.Keyboard.Frame != nil && rectContainsPoint(*snapshot.Keyboard.Frame, point) {
+		return "keyboard"
 	}
-	return b.String()
+	if snapshot.Alert != nil && snapshot.Alert.Frame.W > 0 && !rectContainsPoint(snapshot.Alert.Frame, point) {
+		return "alert"
+	}
+	if !found {
+		return "unknown"
+	}
+	if !hasTarget || hitBelongsToTarget(hit, target, snapshot.Screen) {
+		return ""
+	}
+	return "overlay"
 }
 
-func (a *App) submitTextInput(udid, text string, pasteMode bool, focused *Element) error {
-	_ = pasteMode
-	if strings.TrimSpace(text) == "" {
-		return nil
+func hitBelongsToTarget(hit, target Element, screen FrameRect) bool {
+	if hit.ID == target.ID && !strings.HasPrefix(hit.ID, "axpath:") {
+		return true
 	}
-	if err := a.typeTextInChunks(udid, text, 4); err != nil {
-		return err
+	if rectInsideRect(hit.Frame, target.Frame, 1) {
+		return true
+	}
+	label := strings.TrimSpace(target.Label)
+	if label != "" && strings.EqualFold(strings.TrimSpace(hit.Label), label) && rectDistance(hit.Frame, target.Frame) == 0 {
+		return true
 	}
+	if rectInsideRect(target.Frame, hit.Frame, 1) {
+		// A cell around a selected label is fine; a screen-sized view on top
+		// of it is an overlay.
+		screenArea := screen.W * screen.H
+		return screenArea <= 0 || hit.Frame.W*hit.Frame.H < screenArea/2
+	}
+	return false
+}
 
-	target := focused
-	if target == nil {
-		if snapshot, err := a.captureElements(udid); err == nil {
-			if focusedElem, ok := findFocusedTextInput(snapshot.Elements); ok {
-				target = &focusedElem
-			}
+func (a *App) performTap(udid string, x, y float64, g tapGesture) error {
+	if g.Kind == "longpress" {
+		seconds := strconv.FormatFloat(g.Duration.Seconds(), 'f', -1, 64)
+		if _, err := a.runIDB(udid, "ui", "tap", "--duration", seconds, idbCoordArg(x), idbCoordArg(y)); err != nil {
+			return wrapAppErrCode(err, "IDB_UI_FAILED", "longpress failed")
 		}
+		return nil
 	}
-	if target == nil || isSecureTextInputRole(target.Role) {
+	if g.Count <= 1 {
+		if _, err := a.runIDB(udid, "ui", "tap", idbCoordArg(x), idbCoordArg(y)); err != nil {
+			return wrapAppErrCode(err, "IDB_UI_FAILED", "tap failed")
+		}
 		return nil
 	}
+	// Separate `idb ui tap` processes are too far apart for UIKit to see a
+	// double tap, so multi taps go out as one touch sequence.
+	if err := a.runHIDEvents(udid, multiTapEvents(FramePoint{X: x, Y: y}, g.Count)); err != nil {
+		return wrapAppErrCode(err, "IDB_UI_FAILED", fmt.Sprintf("%d-tap failed", g.Count))
+	}
+	return nil
+}
 
-	lastObserved := ""
-	for attempt := 1; attempt <= 4; attempt++ {
-		time.Sleep(90 * time.Millisecond)
-		snapshot, err := a.captureElements(udid)
+func multiTapEvents(p FramePoint, count int) []hidEvent {
+	var events []hidEvent
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			events = append(events, hidDelay(multiTapInterval))
+		}
+		events = append(events, touchDown(p), hidDelay(tapPressDuration), touchUp(p))
+	}
+	return events
+}
+
+const defaultDragDuration = 800 * time.Millisecond
+
+// addEndpointSelectorFlags registers --<prefix>-index|id|label|contains|select
+// for commands that resolve two elements, such as ui drag.
+func addEndpointSelectorFlags(fs *flag.FlagSet, prefix string) *elementSelector {
+	sel := &elementSelector{}
+	fs.IntVar(&sel.Index, prefix+"-index", -1, prefix+" element index")
+	fs.StringVar(&sel.ID, prefix+"-id", "", prefix+" element id")
+	fs.StringVar(&sel.Label, prefix+"-label", "", prefix+" element by exact label")
+	fs.StringVar(&sel.Contains, prefix+"-contains", "", prefix+" element by partial label/value")
+	fs.StringVar(&sel.Select, prefix+"-select", "", prefix+" element by selector expression")
+	return sel
+}
+
+// resolveDragEndpoint returns the point for one end of a drag: either an
+// explicit --<name>-point "x,y" (converted from px when unit is px) or the center of the
+// element selected by --<name>-*.
+func (a *App) resolveDragEndpoint(udid, name, point string, sel elementSelector, unit, elementsPath string) (FramePoint, map[string]any, error) {
+	sel.normalize()
+	point = strings.TrimSpace(point)
+	switch {
+	case point != "" && sel.count() > 0:
+		return FramePoint{}, nil, &AppError{Code: "USAGE", Message: fmt.Sprintf("use either --%s-point x,y or one --%s-* selector", name, name)}
+	case point != "":
+		p, err := parsePointArg(point)
 		if err != nil {
-			return err
+			return FramePoint{}, nil, &AppError{Code: "USAGE", Message: fmt.Sprintf("--%s-point: %s", name, err.Error())}
 		}
-		matched, ok := findBestVerificationTarget(snapshot.Elements, *target)
-		if !ok {
-			if focusedElem, hasFocus := findFocusedTextInput(snapshot.Elements); hasFocus {
-				matched = focusedElem
-				ok = true
+		if unit == "px" {
+			_, transform, err := loadElementsAndTransform(elementsPath)
+			if err != nil {
+				return FramePoint{}, nil, err
 			}
-		}
-		if !ok {
-			return &AppError{
-				Code:    "TYPE_VERIFY_FAILED",
-				Message: "typed text verification target not found",
-				Details: map[string]any{"intended": text, "attempt": attempt},
+			if transform.Scale <= 0 {
+				return FramePoint{}, nil, &AppError{Code: "COORD_TRANSFORM_FAILED", Message: "invalid transform scale"}
 			}
+			p.X /= transform.Scale
+			p.Y /= transform.Scale
 		}
-		target = &matched
-		if isSecureTextInputRole(matched.Role) {
-			return nil
-		}
-		observed := strings.TrimSpace(matched.Value)
-		if observed == "" {
-			observed = strings.TrimSpace(matched.Label)
+		return p, map[string]any{"by": "coord"}, nil
+	case sel.count() == 1:
+		match, err := a.resolveElement(udid, elementsPath, sel)
+		if err != nil {
+			return FramePoint{}, nil, err
 		}
-		lastObserved = observed
-		missing, comparable := typedMissingSuffix(text, observed)
-		if !comparable {
-			return &AppError{
-				Code:    "TYPE_INCOMPLETE",
-				Message: "typed text does not match target value prefix",
-				Details: map[string]any{"intended": text, "observed": observed, "attempt": attempt, "elementId": matched.ID},
+		return match.Element.Center, map[string]any{"by": match.By, "index": match.Element.Index, "label": match.Element.Label, "selector": sel.responseFields()}, nil
+	case sel.count() > 1:
+		return FramePoint{}, nil, &AppError{Code: "USAGE", Message: fmt.Sprintf("choose only one --%s-* selector", name)}
+	default:
+		return FramePoint{}, nil, &AppError{Code: "USAGE", Message: fmt.Sprintf("drag requires --%s-point x,y or --%s-index|-id|-label|-contains|-select", name, name)}
+	}
+}
+
+func parsePointArg(raw string) (FramePoint, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 2 {
+		return FramePoint{}, fmt.Errorf("point must be x,y")
+	}
+	x, errX := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	y, errY := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errX != nil || errY != nil {
+		return FramePoint{}, fmt.Errorf("point must be numeric x,y")
+	}
+	return FramePoint{X: x, Y: y}, nil
+}
+
+// dragPlan maps a drag onto a single `idb ui swipe`, which moves the touch
+// in steps of Delta whole points spread evenly over Duration.
+type dragPlan struct {
+	Start    FramePoint
+	End      FramePoint
+	Duration time.Duration
+	Delta    int
+	Steps    int
+}
+
+func planDrag(start, end FramePoint, move time.Duration) dragPlan {
+	distance := math.Hypot(end.X-start.X, end.Y-start.Y)
+	plan := dragPlan{Start: start, End: end, Duration: move}
+	plan.Steps = int(math.Max(1, math.Round(distance/10)))
+	plan.Delta = int(math.Max(1, math.Ceil(distance/float64(plan.Steps))))
+	return plan
+}
+
+// heldEvents is the plan as touch events: touch down at Start, wait for
+// hold, then move to End in Steps even steps and lift.
+func (p dragPlan) heldEvents(hold time.Duration) []hidEvent {
+	events := []hidEvent{touchDown(p.Start), hidDelay(hold)}
+	stepDelay := p.Duration / time.Duration(p.Steps)
+	for i := 1; i <= p.Steps; i++ {
+		f := float64(i) / float64(p.Steps)
+		point := FramePoint{X: p.Start.X + (p.End.X-p.Start.X)*f, Y: p.Start.Y + (p.End.Y-p.Start.Y)*f}
+		events = append(events, touchDown(point), hidDelay(stepDelay))
+	}
+	return append(events, touchUp(p.End))
+}
+
+func (p dragPlan) idbArgs() []string {
+	return []string{
+		"ui", "swipe",
+		"--duration", strconv.FormatFloat(p.Duration.Seconds(), 'f', -1, 64),
+		"--delta", strconv.Itoa(p.Delta),
+		idbCoordArg(p.Start.X), idbCoordArg(p.Start.Y), idbCoordArg(p.End.X), idbCoordArg(p.End.Y),
+	}
+}
+
+// hidEvent is one step of a touch or key sequence sent by runHIDEvents. As
+// with idb's own swipe, a "down" while already touching moves the touch.
+type hidEvent struct {
+	Type    string  `json:"type"`
+	X       float64 `json:"x,omitempty"`
+	Y       float64 `json:"y,omitempty"`
+	Key     int     `json:"key,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+}
+
+func touchDown(p FramePoint) hidEvent { return hidEvent{Type: "down", X: p.X, Y: p.Y} }
+func touchUp(p FramePoint) hidEvent   { return hidEvent{Type: "up", X: p.X, Y: p.Y} }
+func keyDown(code int) hidEvent       { return hidEvent{Type: "keydown", Key: code} }
+func keyUp(code int) hidEvent         { return hidEvent{Type: "keyup", Key: code} }
+func hidDelay(d time.Duration) hidEvent {
+	return hidEvent{Type: "delay", Seconds: d.Seconds()}
+}
+
+// hidEventsScript replays HID events read from stdin through idb's Python
+// client in one connection, so their timing is not skewed by process start.
+const hidEventsScript = `import asyncio, json, sys
+from idb.common.types import HIDDelay, HIDDirection, HIDKey, HIDPress, HIDTouch, Point
+from idb.grpc.management import ClientManager
+
+async def events(spec):
+    for e in spec:
+        if e["type"] == "delay":
+            yield HIDDelay(duration=e.get("seconds", 0))
+        elif e["type"] in ("keydown", "keyup"):
+            direction = HIDDirection.DOWN if e["type"] == "keydown" else HIDDirection.UP
+            yield HIDPress(action=HIDKey(keycode=e["key"]), direction=direction)
+        else:
+            direction = HIDDirection.DOWN if e["type"] == "down" else HIDDirection.UP
+            yield HIDPress(action=HIDTouch(point=Point(x=e.get("x", 0), y=e.get("y", 0))), direction=direction)
+
+async def main():
+    spec = json.load(sys.stdin)
+    async with ClientManager().from_udid(udid=sys.argv[1]) as client:
+        await client.hid(events(spec))
+
+asyncio.run(main())
+`
+
+// runHIDEvents sends a touch or key sequence in a single idb client session. It
+// needs the fb-idb Python package (installed with the idb CLI) importable by
+// python3.
+func (a *App) runHIDEvents(udid string, events []hidEvent) error {
+	if a.batch != nil {
+		a.batch.invalidate()
+	}
+	payload, err := json.Marshal(events)
+	if err != nil {
+		return wrapErr("IDB_UI_FAILED", "failed to encode HID events", err)
+	}
+	if _, err := a.runCommandInput(string(payload), "python3", "-c", hidEventsScript, udid); err != nil {
+		return wrapAppErrCode(err, "IDB_UI_FAILED", "HID events failed (needs the fb-idb Python package for python3)")
+	}
+	return nil
+}
+
+const (
+	defaultSliderTolerance = 0.02
+	sliderMoveDuration     = 500 * time.Millisecond
+	sliderSettleDelay      = 300 * time.Millisecond
+)
+
+// parseSliderValue reads a slider's accessibility value ("75%", "0.75") as a
+// fraction between 0 and 1.
+func parseSliderValue(value string) (float64, bool) {
+	s := strings.TrimSpace(strings.Map(foldFullWidthRune, value))
+	percent := strings.HasSuffix(s, "%")
+	s = strings.TrimSpace(strings.TrimSuffix(s, "%"))
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	if percent || v > 1 {
+		v /= 100
+	}
+	if v < 0 || v > 1 {
+		return 0, false
+	}
+	return v, true
+}
+
+// sliderPoint is where the thumb of slider sits at fraction v. The track is
+// inset by the thumb radius on both ends.
+func sliderPoint(slider Element, v float64) FramePoint {
+	inset := math.Min(14, slider.Frame.W/4)
+	x := slider.Frame.X + inset + v*(slider.Frame.W-2*inset)
+	return FramePoint{X: x, Y: slider.Center.Y, Unit: "pt"}
+}
+
+// setSlider drags the slider thumb from its current position to to, re-reads
+// the value and corrects until it is within tolerance.
+func (a *App) setSlider(udid string, slider Element, to, tolerance float64, attempts int) (map[string]any, error) {
+	if attempts < 1 {
+		return nil, &AppError{Code: "USAGE", Message: "--attempts must be >= 1"}
+	}
+	current, ok := parseSliderValue(slider.Value)
+	if !ok {
+		return nil, &AppError{Code: "SLIDER_FAILED", Message: "slider value is not readable: " + slider.Value, Details: map[string]any{"element": slider}}
+	}
+	initial := current
+	drags := 0
+	for math.Abs(current-to) > tolerance {
+		if drags >= attempts {
+			return nil, &AppError{
+				Code:    "SLIDER_FAILED",
+				Message: fmt.Sprintf("slider is at %.3f after %d drags, wanted %.3f", current, drags, to),
+				Details: map[string]any{"to": to, "value": current, "tolerance": tolerance, "drags": drags},
 			}
 		}
-		if missing == "" {
-			return nil
+		plan := planDrag(sliderPoint(slider, current), sliderPoint(slider, to), sliderMoveDuration)
+		if _, err := a.runIDB(udid, plan.idbArgs()...); err != nil {
+			return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "slider drag failed")
 		}
-		if err := a.typeTextInChunks(udid, missing, 4); err != nil {
-			return err
+		drags++
+		time.Sleep(sliderSettleDelay)
+		snapshot, err := a.captureElements(udid)
+		if err != nil {
+			return nil, err
 		}
+		next, ok := findElementAgain(snapshot.Elements, slider)
+		if !ok {
+			return nil, &AppError{Code: "SLIDER_FAILED", Message: "slider disappeared after drag", Details: map[string]any{"drags": drags}}
+		}
+		slider = next
+		if current, ok = parseSliderValue(slider.Value); !ok {
+			return nil, &AppError{Code: "SLIDER_FAILED", Message: "slider value is not readable: " + slider.Value, Details: map[string]any{"drags": drags}}
+		}
+	}
+	return map[string]any{
+		"ok":       true,
+		"action":   "set-slider",
+		"to":       to,
+		"value":    current,
+		"previous": initial,
+		"raw":      slider.Value,
+		"drags":    drags,
+		"element":  slider,
+	}, nil
+}
+
+// parseSwitchState reads a switch value; iOS reports "1"/"0".
+func parseSwitchState(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "on", "true", "yes", "オン":
+		return true, true
+	case "0", "off", "false", "no", "オフ":
+		return false, true
 	}
+	return false, false
+}
 
-	if missing, _ := typedMissingSuffix(text, lastObserved); missing != "" {
-		return &AppError{
-			Code:    "TYPE_INCOMPLETE",
-			Message: "typed text remains incomplete after retries",
-			Details: map[string]any{"intended": text, "observed": lastObserved, "missing": missing},
-		}
+// switchTapPoint taps the control itself: table cells expose their switch
+// as an element spanning the whole row, with the control at the trailing edge.
+func switchTapPoint(elem Element) FramePoint {
+	if elem.Frame.W <= 100 {
+		return elem.Center
 	}
-	return nil
+	return FramePoint{X: elem.Frame.X + elem.Frame.W - 32, Y: elem.Center.Y, Unit: "pt"}
 }
 
-func (a *App) typeTextInChunks(udid, text string, chunkRunes int) error {
-	chunks := splitIntoInputChunks(text, chunkRunes)
-	for _, chunk := range chunks {
-		if chunk == "" {
-			continue
+// setSwitch taps the switch only when its state differs from on, then waits
+// for the reported value to flip.
+func (a *App) setSwitch(udid string, sw Element, on bool) (map[string]any, error) {
+	state, ok := parseSwitchState(sw.Value)
+	if !ok {
+		return nil, &AppError{Code: "TOGGLE_FAILED", Message: "switch state is not readable: " + sw.Value, Details: map[string]any{"element": sw}}
+	}
+	resp := map[string]any{"ok": true, "action": "toggle", "state": on, "previous": state, "changed": false}
+	if state == on {
+		resp["element"] = sw
+		return resp, nil
+	}
+	point := switchTapPoint(sw)
+	if _, err := a.runIDB(udid, "ui", "tap", idbCoordArg(point.X), idbCoordArg(point.Y)); err != nil {
+		return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "switch tap failed")
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		time.Sleep(sliderSettleDelay)
+		snapshot, err := a.captureElements(udid)
+		if err != nil {
+			return nil, err
 		}
-		if _, err := a.runIDB(udid, "ui", "text", chunk); err != nil {
-			return wrapAppErrCode(err, "IDB_UI_FAILED", "text input failed")
+		next, ok := findElementAgain(snapshot.Elements, sw)
+		if !ok {
+			continue
 		}
-		if len(chunks) > 1 {
-			time.Sleep(60 * time.Millisecond)
+		if state, ok := parseSwitchState(next.Value); ok && state == on {
+			resp["changed"] = true
+			resp["element"] = next
+			resp["targetPt"] = map[string]any{"x": point.X, "y": point.Y}
+			return resp, nil
 		}
 	}
-	return nil
+	return nil, &AppError{Code: "TOGGLE_FAILED", Message: "switch did not change state after tap", Details: map[string]any{"want": on, "targetPt": map[string]any{"x": point.X, "y": point.Y}}}
 }
 
-func splitIntoInputChunks(text string, chunkRunes int) []string {
-	runes := []rune(text)
-	if len(runes) == 0 {
-		return nil
-	}
-	if chunkRunes <= 0 || len(runes) <= chunkRunes {
-		return []string{text}
-	}
-	chunks := make([]string, 0, (len(runes)+chunkRunes-1)/chunkRunes)
-	for i := 0; i < len(runes); i += chunkRunes {
-		end := i + chunkRunes
-		if end > len(runes) {
-			end = len(runes)
+// findElementAgain locates elem in a fresh snapshot by stable id, falling
+// back to the nearest element of the same role.
+func findElementAgain(elements []Element, elem Element) (Element, bool) {
+	best := Element{}
+	bestDist := math.MaxFloat64
+	for _, candidate := range elements {
+		if candidate.ID == elem.ID && !strings.HasPrefix(elem.ID, "axpath:") {
+			return candidate, true
+		}
+		if normalizeSelectorRole(candidate.Role) != normalizeSelectorRole(elem.Role) {
+			continue
+		}
+		if d := math.Hypot(candidate.Center.X-elem.Center.X, candidate.Center.Y-elem.Center.Y); d < bestDist {
+			best, bestDist = candidate, d
 		}
-		chunks = append(chunks, string(runes[i:end]))
 	}
-	return chunks
+	return best, bestDist < 24
 }
 
-func findFocusedTextInput(elements []Element) (Element, bool) {
-	for _, elem := range elements {
-		if elem.Enabled && elem.Focused && isTextInputRole(elem.Role) {
-			return elem, true
+const (
+	defaultPickSwipes = 20
+	pickMoveDuration  = 600 * time.Millisecond
+	pickSettleDelay   = 500 * time.Millisecond
+)
+
+var pickerWheelRoleHints = []string{"pickerwheel", "adjustable"}
+
+func isPickerWheelRole(role string) bool {
+	r := normalizeSelectorRole(role)
+	for _, hint := range pickerWheelRoleHints {
+		if strings.Contains(r, hint) {
+			return true
 		}
 	}
-	return Element{}, false
+	return false
 }
 
-func typedMissingSuffix(intended, observed string) (string, bool) {
-	intendedRunes := []rune(intended)
-	observedRunes := []rune(observed)
-	intendedComparable, intendedMap := comparableRunesWithMap(intendedRunes)
-	observedComparable, _ := comparableRunesWithMap(observedRunes)
-	if len(observedComparable) > len(intendedComparable) {
-		return "", false
+type pickOptions struct {
+	Value     string
+	Wheel     int
+	MaxSwipes int
+	RowHeight float64
+	Normalize bool
+}
+
+// pickerWheels returns the wheels of picker, left to right. A selected wheel
+// is returned as is.
+func pickerWheels(elements []Element, picker Element) []Element {
+	if isPickerWheelRole(picker.Role) {
+		return []Element{picker}
 	}
-	for i := 0; i < len(observedComparable); i++ {
-		if observedComparable[i] != intendedComparable[i] {
-			return "", false
+	wheels := make([]Element, 0, 3)
+	for _, elem := range elements {
+		if isPickerWheelRole(elem.Role) && rectContainsPoint(picker.Frame, elem.Center) {
+			wheels = append(wheels, elem)
 		}
 	}
-	if len(observedComparable) == len(intendedComparable) {
-		return "", true
+	sort.SliceStable(wheels, func(i, j int) bool { return wheels[i].Center.X < wheels[j].Center.X })
+	return wheels
+}
+
+// pickerPositionSuffix matches the ", 3 of 12" position VoiceOver appends to
+// wheel values.
+var pickerPositionSuffix = regexp.MustCompile(`\s*[,、]\s*\d+\s*(?:of|/)\s*\d+\s*$`)
+
+func pickerWheelValue(wheel Element) string {
+	value := strings.TrimSpace(wheel.Value)
+	if value == "" {
+		value = strings.TrimSpace(wheel.Label)
 	}
-	start := intendedMap[len(observedComparable)]
-	if start < 0 || start > len(intendedRunes) {
-		return "", false
+	return pickerPositionSuffix.ReplaceAllString(value, "")
+}
+
+var pickerMonthNames = map[string]int{
+	"january": 1, "february": 2, "march": 3, "april": 4, "may": 5, "june": 6,
+	"july": 7, "august": 8, "september": 9, "october": 10, "november": 11, "december": 12,
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "sept": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var pickerNumber = regexp.MustCompile(`\d+`)
+
+// pickerOrdinal estimates the row position of a wheel value: month names map
+// to 1-12 and anything else to its first number ("2024年", "15日", "08").
+func pickerOrdinal(value string) (int, bool) {
+	folded := strings.ToLower(strings.TrimSpace(strings.Map(foldFullWidthRune, value)))
+	if n, ok := pickerMonthNames[strings.TrimSuffix(folded, ".")]; ok {
+		return n, true
 	}
-	return string(intendedRunes[start:]), true
+	digits := pickerNumber.FindString(folded)
+	if digits == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	return n, err == nil
 }
 
-func comparableRunesWithMap(runes []rune) ([]rune, []int) {
-	comparable := make([]rune, 0, len(runes))
-	indexMap := make([]int, 0, len(runes))
-	for i, r := range runes {
-		if isIgnoredCompareRune(r) {
-			continue
-		}
-		comparable = append(comparable, r)
-		indexMap = append(indexMap, i)
+// pickerRowDelta returns how many rows to move from current to want and
+// whether that is an estimate from ordinals (false means search row by row).
+func pickerRowDelta(current, want string) (int, bool) {
+	cur, okCur := pickerOrdinal(current)
+	tgt, okTgt := pickerOrdinal(want)
+	if !okCur || !okTgt || cur == tgt {
+		return 0, false
 	}
-	return comparable, indexMap
+	return tgt - cur, true
 }
 
-func isIgnoredCompareRune(r rune) bool {
-	return unicode.IsSpace(r)
+func estimatePickerRowHeight(wheel Element) float64 {
+	return math.Max(24, math.Min(wheel.Frame.H/7, 44))
 }
 
-func (a *App) waitForCondition(udid, hasText string, interactiveMin int, timeout, interval time.Duration) (map[string]any, error) {
-	started := time.Now()
-	attempts := 0
-	lastInteractive := 0
-	lastMatches := []string{}
-	var lastErr error
-	targetText := strings.ToLower(strings.TrimSpace(hasText))
+// pickerDragVector moves a wheel by rows: positive rows bring later values
+// into the selection band, which means dragging up.
+func pickerDragVector(wheel Element, rows int, rowHeight float64) (FramePoint, FramePoint) {
+	maxRows := int(math.Max(1, math.Floor(wheel.Frame.H*0.8/rowHeight)))
+	if rows > maxRows {
+		rows = maxRows
+	} else if rows < -maxRows {
+		rows = -maxRows
+	}
+	distance := float64(rows) * rowHeight
+	start := FramePoint{X: wheel.Center.X, Y: wheel.Center.Y + distance/2, Unit: "pt"}
+	end := FramePoint{X: wheel.Center.X, Y: wheel.Center.Y - distance/2, Unit: "pt"}
+	return start, end
+}
 
-	for {
-		attempts++
-		snapshot, snapErr := a.captureElements(udid)
-		if snapErr != nil {
-			lastErr = snapErr
-		} else {
-			lastErr = nil
-			lastInteractive = snapshot.InteractiveCount
-			textMatches := matchingTextSamples(snapshot.Elements, targetText)
-			lastMatches = textMatches
-			interactiveOK := interactiveMin < 0 || snapshot.InteractiveCount >= interactiveMin
-			textOK := targetText == "" || len(textMatches) > 0
-			if interactiveOK && textOK {
-				resp := map[string]any{
-					"ok":          true,
-					"action":      "wait",
-					"attempts":    attempts,
-					"elapsedMs":   time.Since(started).Milliseconds(),
-					"interactive": snapshot.InteractiveCount,
-				}
-				if targetText != "" {
-					resp["hasText"] = hasText
-					resp["matches"] = textMatches
-				}
-				return resp, nil
-			}
+func findWheelAgain(elements []Element, prev Element) (Element, bool) {
+	best := Element{}
+	bestDist := math.MaxFloat64
+	for _, elem := range elements {
+		if elem.ID == prev.ID && !strings.HasPrefix(elem.ID, "axpath:") {
+			return elem, true
 		}
-
-		if time.Since(started) >= timeout {
-			details := map[string]any{
-				"attempts":       attempts,
-				"elapsedMs":      time.Since(started).Milliseconds(),
-				"interactive":    lastInteractive,
-				"interactiveMin": interactiveMin,
-			}
-			if targetText != "" {
-				details["hasText"] = hasText
-				details["lastMatches"] = lastMatches
-			}
-			if lastErr != nil {
-				details["lastError"] = renderError(lastErr)
-			}
-			return nil, &AppError{Code: "WAIT_TIMEOUT", Message: "wait condition not met before timeout", Details: details}
+		if !isPickerWheelRole(elem.Role) {
+			continue
+		}
+		if d := math.Hypot(elem.Center.X-prev.Center.X, elem.Center.Y-prev.Center.Y); d < bestDist {
+			best, bestDist = elem, d
 		}
-		time.Sleep(interval)
 	}
+	return best, bestDist < math.Max(prev.Frame.W, 24)/2
 }
 
-func (a *App) cmdApp(args []string) (bool, error) {
-	if len(args) == 0 {
-		return a.opts.JSON, &AppError{Code: "USAGE", Message: "app subcommand required: openurl|launch|terminate|list"}
+// pickWheelValue turns a picker wheel until it reports opts.Value. When both
+// the current and wanted values have ordinals (numbers, months) it drags by
+// the estimated number of rows and corrects from the re-read value;
+// otherwise it steps one row at a time, reversing at the end of the wheel.
+func (a *App) pickWheelValue(udid string, picker Element, opts pickOptions) (map[string]any, error) {
+	if opts.MaxSwipes < 0 {
+		return nil, &AppError{Code: "USAGE", Message: "--max-swipes must be >= 0"}
 	}
-	emitJSON := a.opts.JSON || hasJSONFlag(args[1:])
-	target, err := a.resolveTarget(a.opts.Target)
+	snapshot, err := a.captureElements(udid)
 	if err != nil {
-		return emitJSON, err
+		return nil, err
+	}
+	wheels := pickerWheels(snapshot.Elements, picker)
+	if len(wheels) == 0 {
+		return nil, &AppError{Code: "PICKER_NOT_FOUND", Message: "no picker wheel in the selected element", Details: map[string]any{"element": picker}}
+	}
+	values := make([]string, 0, len(wheels))
+	for _, w := range wheels {
+		values = append(values, pickerWheelValue(w))
+	}
+	if opts.Wheel == 0 && len(wheels) > 1 {
+		return nil, &AppError{Code: "USAGE", Message: fmt.Sprintf("picker has %d wheels; pass --wheel 1-%d", len(wheels), len(wheels)), Details: map[string]any{"wheels": values}}
+	}
+	if opts.Wheel < 0 || opts.Wheel > len(wheels) {
+		return nil, &AppError{Code: "USAGE", Message: fmt.Sprintf("--wheel must be between 1 and %d", len(wheels)), Details: map[string]any{"wheels": values}}
+	}
+	wheelIndex := opts.Wheel
+	if wheelIndex == 0 {
+		wheelIndex = 1
+	}
+	wheel := wheels[wheelIndex-1]
+	rowHeight := opts.RowHeight
+	if rowHeight <= 0 {
+		rowHeight = estimatePickerRowHeight(wheel)
 	}
 
-	sub := args[0]
-	subArgs := args[1:]
-	if sub == "list" {
-		cmd, err := a.runSimctl("listapps", target.UDID)
+	want := foldSelectorText(opts.Value, opts.Normalize)
+	initial := pickerWheelValue(wheel)
+	seen := []string{initial}
+	direction := 1
+	reversed := false
+	swipes := 0
+	for {
+		current := pickerWheelValue(wheel)
+		if foldSelectorText(current, opts.Normalize) == want {
+			return map[string]any{
+				"ok":        true,
+				"action":    "pick",
+				"value":     current,
+				"previous":  initial,
+				"swipes":    swipes,
+				"wheel":     wheelIndex,
+				"rowHeight": rowHeight,
+				"element":   wheel,
+			}, nil
+		}
+		if swipes >= opts.MaxSwipes {
+			break
+		}
+		rows, estimated := pickerRowDelta(current, opts.Value)
+		if !estimated {
+			rows = direction
+		}
+		start, end := pickerDragVector(wheel, rows, rowHeight)
+		plan := planDrag(start, end, pickMoveDuration)
+		if _, err := a.runIDB(udid, plan.idbArgs()...); err != nil {
+			return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "picker swipe failed")
+		}
+		swipes++
+		time.Sleep(pickSettleDelay)
+
+		snapshot, err := a.captureElements(udid)
 		if err != nil {
-			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "list apps failed")
+			return nil, err
 		}
-		if emitJSON {
-			a.printJSON(map[string]any{"ok": true, "apps": cmd.Stdout})
-		} else {
-			fmt.Print(cmd.Stdout)
+		next, ok := findWheelAgain(snapshot.Elements, wheel)
+		if !ok {
+			return nil, &AppError{Code: "PICKER_NOT_FOUND", Message: "picker wheel disappeared while picking", Details: map[string]any{"swipes": swipes}}
+		}
+		wheel = next
+		value := pickerWheelValue(wheel)
+		seen = append(seen, value)
+		if value == current && !estimated {
+			// The wheel did not move: this end is reached, search the other way.
+			if reversed {
+				break
+			}
+			direction, reversed = -direction, true
 		}
-		return emitJSON, nil
 	}
+	return nil, &AppError{
+		Code:    "PICK_FAILED",
+		Message: fmt.Sprintf("picker did not reach %q after %d swipes", opts.Value, swipes),
+		Details: map[string]any{"value": opts.Value, "last": pickerWheelValue(wheel), "seen": seen, "swipes": swipes},
+	}
+}
 
-	subArgsNoTail, tailArgs := splitArgsTail(subArgs, "--args")
-	fs := flag.NewFlagSet("app", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
-	bundleID := fs.String("bundle-id", "", "bundle id")
-	localJSON := fs.Bool("json", false, "")
-	if err := fs.Parse(subArgsNoTail); err != nil {
-		return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+const (
+	// scrollSwipeFraction is the share of the scroll area covered by each
+	// scroll-to swipe; slow swipes keep deceleration from overshooting.
+	scrollSwipeFraction = 0.5
+	scrollSwipeDuration = "0.5"
+	scrollSettleDelay   = 400 * time.Millisecond
+)
+
+type scrollToOptions struct {
+	Container string
+	Direction string
+	MaxSwipes int
+	Tap       bool
+}
+
+// scrollTo swipes the container (or screen) until an element matching sel is
+// visible and on screen, stopping early when a swipe leaves the UI unchanged.
+func (a *App) scrollTo(udid string, sel elementSelector, opts scrollToOptions) (map[string]any, error) {
+	direction := strings.ToLower(strings.TrimSpace(opts.Direction))
+	if direction != "up" && direction != "down" && direction != "left" && direction != "right" {
+		return nil, &AppError{Code: "USAGE", Message: "--direction must be up|down|left|right"}
+	}
+	if opts.MaxSwipes < 0 {
+		return nil, &AppError{Code: "USAGE", Message: "--max-swipes must be >= 0"}
+	}
+	if err := sel.validate(); err != nil {
+		return nil, err
+	}
+	if sel.Index >= 0 {
+		// Indexes number the elements of one capture; every swipe renumbers
+		// them, so an index cannot name the element being scrolled to.
+		return nil, &AppError{Code: "USAGE", Message: "scroll-to does not accept --index; use --id, --label, --contains or --select"}
+	}
+	var containerQuery *selectorNode
+	if strings.TrimSpace(opts.Container) != "" {
+		parsed, err := parseSelectorExpr(opts.Container)
+		if err != nil {
+			return nil, err
+		}
+		containerQuery = parsed
 	}
-	emitJSON = emitJSON || *localJSON
 
-	switch sub {
-	case "openurl":
-		vals := fs.Args()
-		if len(vals) != 1 {
-			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent app openurl \"<url>\""}
+	prevHash := ""
+	exhausted := false
+	swipes := 0
+	for {
+		snapshot, err := a.captureElements(udid)
+		if err != nil {
+			return nil, err
 		}
-		if _, err := a.runSimctl("openurl", target.UDID, vals[0]); err != nil {
-			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "openurl failed")
+		area := snapshot.Screen
+		if containerQuery != nil {
+			container, err := pickScrollContainer(snapshot.Elements, containerQuery, opts.Container)
+			if err != nil {
+				return nil, err
+			}
+			area = container.Frame
 		}
-		resp := map[string]any{"ok": true, "action": "openurl", "url": vals[0]}
-		if emitJSON {
-			a.printJSON(resp)
-		} else {
-			fmt.Printf("openurl %s\n", vals[0])
+		if area.W <= 0 || area.H <= 0 {
+			// Same fallback screen as swipeOrigin when the tree has no bounds.
+			area = FrameRect{W: 392, H: 852}
 		}
-		return emitJSON, nil
-	case "launch":
-		if *bundleID == "" {
-			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent app launch --bundle-id <id> [--args ...]"}
+
+		onScreen := make([]Element, 0, len(snapshot.Elements))
+		for _, elem := range snapshot.Elements {
+			if elem.Visible && !elem.Offscreen && rectContainsPoint(area, elem.Center) {
+				onScreen = append(onScreen, elem)
+			}
 		}
-		args := []string{"launch", target.UDID, *bundleID}
-		args = append(args, tailArgs...)
-		if _, err := a.runSimctl(args...); err != nil {
-			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "launch failed")
+		elem, pickErr := pickElementBySelector(onScreen, sel)
+		if pickErr == nil {
+			resp := map[string]any{
+				"ok":        true,
+				"action":    "scroll-to",
+				"direction": direction,
+				"swipes":    swipes,
+				"element":   elem,
+			}
+			if opts.Tap {
+				tapPoint := elem.Center
+				if isTextInputRole(elem.Role) {
+					tapPoint = focusPointForElement(elem)
+				}
+				if _, err := a.runIDB(udid, "ui", "tap", idbCoordArg(tapPoint.X), idbCoordArg(tapPoint.Y)); err != nil {
+					return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "tap failed")
+				}
+				resp["tapped"] = true
+				resp["targetPt"] = map[string]any{"x": tapPoint.X, "y": tapPoint.Y}
+			}
+			return resp, nil
 		}
-		resp := map[string]any{"ok": true, "action": "launch", "bundleId": *bundleID, "args": tailArgs}
-		if emitJSON {
-			a.printJSON(resp)
-		} else {
-			fmt.Printf("launch %s\n", *bundleID)
+		if toAppError(pickErr).Code == "ELEMENT_AMBIGUOUS" {
+			return nil, pickErr
 		}
-		return emitJSON, nil
-	case "terminate":
-		if *bundleID == "" {
-			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent app terminate --bundle-id <id>"}
+		if swipes > 0 && snapshot.Hash == prevHash {
+			exhausted = true
+			break
 		}
-		if _, err := a.runSimctl("terminate", target.UDID, *bundleID); err != nil {
-			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "terminate failed")
+		if swipes >= opts.MaxSwipes {
+			break
 		}
-		resp := map[string]any{"ok": true, "action": "terminate", "bundleId": *bundleID}
-		if emitJSON {
-			a.printJSON(resp)
-		} else {
-			fmt.Printf("terminate %s\n", *bundleID)
+		prevHash = snapshot.Hash
+
+		start, end := scrollSwipeVector(area, direction, scrollSwipeFraction)
+		if _, err := a.runIDB(udid, "ui", "swipe", "--duration", scrollSwipeDuration, idbCoordArg(start.X), idbCoordArg(start.Y), idbCoordArg(end.X), idbCoordArg(end.Y)); err != nil {
+			return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "swipe failed")
 		}
-		return emitJSON, nil
-	default:
-		return emitJSON, &AppError{Code: "USAGE", Message: "unknown app subcommand: " + sub}
+		swipes++
+		time.Sleep(scrollSettleDelay)
+	}
+
+	message := fmt.Sprintf("element not visible after %d swipes", swipes)
+	if exhausted {
+		message = fmt.Sprintf("element not found before end of content (%d swipes)", swipes)
+	}
+	return nil, &AppError{
+		Code:    "ELEMENT_NOT_FOUND",
+		Message: message,
+		Details: map[string]any{"swipes": swipes, "exhausted": exhausted, "direction": direction, "selector": sel.responseFields()},
 	}
 }
 
-func (a *App) cmdRaw(args []string) (bool, error) {
-	if len(args) == 0 {
-		return a.opts.JSON, &AppError{Code: "USAGE", Message: "usage: simagent raw simctl <...>|idb <...>"}
+// pickScrollContainer returns the single element matching the --container
+// expression; several matches fail with ELEMENT_AMBIGUOUS like any selector.
+func pickScrollContainer(elements []Element, query *selectorNode, expr string) (Element, error) {
+	containers := matchSelectorElements(elements, query)
+	switch len(containers) {
+	case 0:
+		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "scroll container not found: " + expr}
+	case 1:
+		return containers[0], nil
+	}
+	candidates := make([]elementCandidate, 0, len(containers))
+	for _, c := range containers {
+		candidates = append(candidates, elementCandidate{Element: c})
+	}
+	return Element{}, &AppError{
+		Code:    "ELEMENT_AMBIGUOUS",
+		Message: fmt.Sprintf("%d scroll containers match %q; use a narrower --container", len(containers), expr),
+		Details: map[string]any{"container": expr, "candidates": candidateDetails(candidates, false)},
+	}
+}
+
+// scrollSwipeVector returns the finger path that scrolls area's content in
+// direction: scrolling down drags the finger up, and so on.
+func scrollSwipeVector(area FrameRect, direction string, fraction float64) (FramePoint, FramePoint) {
+	cx := area.X + area.W/2
+	cy := area.Y + area.H/2
+	dx := area.W * fraction / 2
+	dy := area.H * fraction / 2
+	switch direction {
+	case "up":
+		return FramePoint{X: cx, Y: cy - dy}, FramePoint{X: cx, Y: cy + dy}
+	case "left":
+		return FramePoint{X: cx - dx, Y: cy}, FramePoint{X: cx + dx, Y: cy}
+	case "right":
+		return FramePoint{X: cx + dx, Y: cy}, FramePoint{X: cx - dx, Y: cy}
+	default:
+		return FramePoint{X: cx, Y: cy + dy}, FramePoint{X: cx, Y: cy - dy}
 	}
-	emitJSON := a.opts.JSON || hasJSONFlag(args)
+}
 
-	sub := args[0]
-	pass := stripFirstJSON(args[1:])
-	var res CommandResult
-	var err error
+const defaultSwipeDistance = 220.0
 
-	switch sub {
-	case "simctl":
-		res, err = a.runCommand("xcrun", append([]string{"simctl"}, pass...)...)
-	case "idb":
-		res, err = a.runCommand("idb", pass...)
-	default:
-		return emitJSON, &AppError{Code: "USAGE", Message: "raw command must be simctl|idb"}
+// swipeRequest is a ui swipe as given on the command line or in a flow step.
+// Points and lengths are strings so they can carry px or % units.
+type swipeRequest struct {
+	Direction string
+	Distance  string
+	Unit      string
+	From      string
+	To        string
+	Preset    string
+	Duration  time.Duration
+	// Start is the center of a selected element, which overrides From.
+	Start *FramePoint
+}
+
+func (r swipeRequest) needsScreen() bool {
+	return r.Preset != "" || strings.Contains(r.Distance+r.From+r.To, "%")
+}
+
+type swipePlan struct {
+	Direction string
+	Preset    string
+	Start     FramePoint
+	End       FramePoint
+	Duration  time.Duration
+}
+
+func (p swipePlan) details() map[string]any {
+	out := map[string]any{
+		"action": "swipe",
+		"fromPt": map[string]any{"x": p.Start.X, "y": p.Start.Y},
+		"toPt":   map[string]any{"x": p.End.X, "y": p.End.Y},
 	}
-	if err != nil {
-		return emitJSON, wrapAppErrCode(err, "RAW_FAILED", "raw command failed")
+	if p.Direction != "" {
+		out["direction"] = p.Direction
 	}
-
-	if emitJSON {
-		a.printJSON(map[string]any{"ok": true, "stdout": res.Stdout, "stderr": res.Stderr, "exitCode": res.ExitCode})
-	} else {
-		fmt.Print(res.Stdout)
-		if strings.TrimSpace(res.Stderr) != "" {
-			fmt.Fprint(os.Stderr, res.Stderr)
-		}
+	if p.Preset != "" {
+		out["preset"] = p.Preset
 	}
-	return emitJSON, nil
+	if p.Duration > 0 {
+		out["durationMs"] = p.Duration.Milliseconds()
+	}
+	return out
 }
 
-func (a *App) listTargets() ([]SimTarget, error) {
-	cmd, err := a.runSimctl("list", "devices", "--json")
-	if err != nil {
-		return nil, wrapAppErrCode(err, "SIMCTL_FAILED", "failed to list simulators")
+// swipeTransform returns the last-frame transform, filling in the screen size
+// from a live capture when a preset or percentage needs it and none is known.
+func (a *App) swipeTransform(udid, elementsPath string, req swipeRequest) Transform {
+	_, transform, _ := loadElementsAndTransform(elementsPath)
+	if transform.Screen.W > 0 && transform.Screen.H > 0 || !req.needsScreen() {
+		return transform
+	}
+	if snapshot, err := a.captureElements(udid); err == nil && snapshot.Screen.W > 0 {
+		transform.Screen.W = snapshot.Screen.W
+		transform.Screen.H = snapshot.Screen.H
 	}
+	return transform
+}
 
-	var payload struct {
-		Devices map[string][]struct {
-			Name    string `json:"name"`
-			UDID    string `json:"udid"`
-			State   string `json:"state"`
-			IsAvail bool   `json:"isAvailable"`
-			Avail   bool   `json:"available"`
-		} `json:"devices"`
+func (a *App) performSwipe(udid string, plan swipePlan) error {
+	args := []string{"ui", "swipe"}
+	if plan.Duration > 0 {
+		args = append(args, "--duration", strconv.FormatFloat(plan.Duration.Seconds(), 'f', -1, 64))
 	}
-	if err := json.Unmarshal([]byte(cmd.Stdout), &payload); err != nil {
-		return nil, wrapErr("SIMCTL_FAILED", "invalid simctl devices json", err)
+	args = append(args, idbCoordArg(plan.Start.X), idbCoordArg(plan.Start.Y), idbCoordArg(plan.End.X), idbCoordArg(plan.End.Y))
+	if _, err := a.runIDB(udid, args...); err != nil {
+		return wrapAppErrCode(err, "IDB_UI_FAILED", "swipe failed")
 	}
+	return nil
+}
 
-	list := make([]SimTarget, 0)
-	for runtime, devices := range payload.Devices {
-		for _, d := range devices {
-			available := d.IsAvail || d.Avail
-			list = append(list, SimTarget{
-				Name:      d.Name,
-				UDID:      d.UDID,
-				Runtime:   runtime,
-				State:     d.State,
-				Available: available,
-			})
-		}
+// planSwipe turns a swipe request into start/end points in pt.
+func planSwipe(req swipeRequest, t Transform) (swipePlan, error) {
+	plan := swipePlan{Direction: req.Direction, Preset: req.Preset, Duration: req.Duration}
+	if req.Unit != "" && req.Unit != "pt" && req.Unit != "px" {
+		return plan, &AppError{Code: "USAGE", Message: "--unit must be pt|px"}
+	}
+	if req.Duration < 0 {
+		return plan, &AppError{Code: "USAGE", Message: "--duration must be >= 0"}
+	}
+	if req.needsScreen() && (t.Screen.W <= 0 || t.Screen.H <= 0) {
+		return plan, &AppError{Code: "COORD_TRANSFORM_FAILED", Message: "screen size unknown; run frame first"}
+	}
+	if req.Preset != "" {
+		return presetSwipe(plan, t)
 	}
 
-	sort.Slice(list, func(i, j int) bool {
-		if list[i].State != list[j].State {
-			return list[i].State > list[j].State
-		}
-		if list[i].Runtime != list[j].Runtime {
-			return list[i].Runtime < list[j].Runtime
+	switch {
+	case req.Start != nil:
+		plan.Start = *req.Start
+	case req.From != "":
+		p, err := parseScreenPoint(req.From, req.Unit, t)
+		if err != nil {
+			return plan, err
 		}
-		if list[i].Name != list[j].Name {
-			return list[i].Name < list[j].Name
+		plan.Start = p
+	default:
+		plan.Start.X, plan.Start.Y = swipeOrigin(t)
+	}
+	if req.To != "" {
+		p, err := parseScreenPoint(req.To, req.Unit, t)
+		if err != nil {
+			return plan, err
 		}
-		return list[i].UDID < list[j].UDID
-	})
-	return list, nil
-}
+		plan.End = p
+		return plan, nil
+	}
 
-func (a *App) resolveTarget(spec string) (SimTarget, error) {
-	s := strings.TrimSpace(spec)
-	if s == "" {
-		cfg, err := loadConfig()
-		if err == nil && cfg.DefaultTarget != nil && cfg.DefaultTarget.UDID != "" {
-			s = cfg.DefaultTarget.UDID
-		}
+	axis := t.Screen.H
+	switch req.Direction {
+	case "up", "down":
+	case "left", "right":
+		axis = t.Screen.W
+	default:
+		return plan, &AppError{Code: "USAGE", Message: "direction must be up|down|left|right"}
 	}
-	if s == "" {
-		s = "booted"
+	// A zero or negative distance means the default, as it always has.
+	distance := defaultSwipeDistance
+	if req.Distance != "" {
+		d, err := parseScreenLength(req.Distance, req.Unit, axis, t.Scale)
+		if err != nil {
+			return plan, &AppError{Code: "USAGE", Message: "--distance: " + err.Error()}
+		}
+		if d > 0 {
+			distance = d
+		}
+	}
+	plan.End = plan.Start
+	switch req.Direction {
+	case "up":
+		plan.End.Y -= distance
+	case "down":
+		plan.End.Y += distance
+	case "left":
+		plan.End.X -= distance
+	case "right":
+		plan.End.X += distance
+	}
+	return plan, nil
+}
+
+// presetSwipe builds the edge gestures: back swipes in from the left edge,
+// notifications and control-center pull down from the top-left and
+// top-right edges, and refresh pulls the top of the content down slowly.
+func presetSwipe(plan swipePlan, t Transform) (swipePlan, error) {
+	w, h := t.Screen.W, t.Screen.H
+	defaultDuration := 300 * time.Millisecond
+	switch plan.Preset {
+	case "back":
+		plan.Start = FramePoint{X: 1, Y: h / 2}
+		plan.End = FramePoint{X: w * 0.7, Y: h / 2}
+		plan.Direction = "right"
+	case "notifications":
+		plan.Start = FramePoint{X: w * 0.25, Y: 1}
+		plan.End = FramePoint{X: w * 0.25, Y: h * 0.6}
+		plan.Direction = "down"
+		defaultDuration = 400 * time.Millisecond
+	case "control-center":
+		plan.Start = FramePoint{X: w - 24, Y: 1}
+		plan.End = FramePoint{X: w - 24, Y: h * 0.5}
+		plan.Direction = "down"
+		defaultDuration = 400 * time.Millisecond
+	case "refresh":
+		top := t.SafeArea.Top
+		plan.Start = FramePoint{X: w / 2, Y: top + h*0.15}
+		plan.End = FramePoint{X: w / 2, Y: top + h*0.55}
+		plan.Direction = "down"
+		defaultDuration = 800 * time.Millisecond
+	default:
+		return plan, &AppError{Code: "USAGE", Message: "--preset must be back|notifications|control-center|refresh"}
 	}
+	if plan.Duration == 0 {
+		plan.Duration = defaultDuration
+	}
+	return plan, nil
+}
 
-	targets, err := a.listTargets()
+// parseScreenPoint parses "x,y" where each part is pt, px (unit px) or a
+// percentage of the screen width/height.
+func parseScreenPoint(raw, unit string, t Transform) (FramePoint, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 2 {
+		return FramePoint{}, &AppError{Code: "USAGE", Message: "point must be x,y: " + raw}
+	}
+	x, err := parseScreenLength(parts[0], unit, t.Screen.W, t.Scale)
 	if err != nil {
-		return SimTarget{}, err
+		return FramePoint{}, &AppError{Code: "USAGE", Message: "invalid point " + raw + ": " + err.Error()}
+	}
+	y, err := parseScreenLength(parts[1], unit, t.Screen.H, t.Scale)
+	if err != nil {
+		return FramePoint{}, &AppError{Code: "USAGE", Message: "invalid point " + raw + ": " + err.Error()}
 	}
+	return FramePoint{X: x, Y: y}, nil
+}
 
-	if s == "booted" {
-		for _, t := range targets {
-			if strings.EqualFold(t.State, "booted") {
-				return t, nil
-			}
+// parseScreenLength converts "40%" of axis, or a number in unit, to pt.
+func parseScreenLength(raw, unit string, axis, scale float64) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasSuffix(raw, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(raw, "%")), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid percentage %q", raw)
 		}
-		return SimTarget{}, &AppError{Code: "NO_BOOTED_DEVICE", Message: "no booted simulator found"}
+		return axis * pct / 100, nil
 	}
-
-	for _, t := range targets {
-		if strings.EqualFold(t.UDID, s) {
-			return t, nil
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", raw)
+	}
+	if unit == "px" {
+		if scale <= 0 {
+			return 0, fmt.Errorf("px requires a transform scale; run frame first")
 		}
+		v /= scale
 	}
-	return SimTarget{}, &AppError{Code: "TARGET_NOT_FOUND", Message: "target not found: " + s}
+	return v, nil
 }
 
-func (a *App) runSimctl(args ...string) (CommandResult, error) {
-	return a.runCommand("xcrun", append([]string{"simctl"}, args...)...)
+type elementMatch struct {
+	Element    Element
+	By         string
+	Fallback   bool
+	Candidates []elementCandidate
 }
 
-func (a *App) runIDB(udid string, args ...string) (CommandResult, error) {
-	full := append([]string{}, args...)
-	full = append(full, "--udid", udid)
-	return a.runCommand("idb", full...)
+func (m elementMatch) explain(resp map[string]any) {
+	if m.Candidates != nil {
+		resp["candidates"] = candidateDetails(m.Candidates, true)
+	}
 }
 
-func (a *App) runCommand(name string, args ...string) (CommandResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), a.opts.Timeout)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, name, args...)
-	var stdout bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	res := CommandResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: 0}
+// resolveElement picks the element for sel from --from/last-frame elements and
+// falls back to a live scan, then to intent and system-UI heuristics for text
+// selectors.
+func (a *App) resolveElement(udid, from string, sel elementSelector) (elementMatch, error) {
+	if err := sel.validate(); err != nil {
+		return elementMatch{}, err
+	}
+	elements := []Element{}
+	if strings.TrimSpace(from) != "" || sel.Index >= 0 || sel.ID != "" {
+		loadedElements, _, loadErr := loadElementsAndTransform(from)
+		if loadErr != nil {
+			return elementMatch{}, loadErr
+		}
+		elements = loadedElements
+	} else if loadedElements, _, loadErr := loadElementsAndTransform(from); loadErr == nil {
+		elements = loadedElements
+	}
+	elem, candidates, err := rankElementsBySelector(elements, sel)
 	if err == nil {
-		return res, nil
+		return elementMatch{Element: elem, By: sel.kind(), Candidates: candidates}, nil
 	}
-
-	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return res, &AppError{Code: "TIMEOUT", Message: fmt.Sprintf("command timed out: %s %s", name, strings.Join(args, " ")), Details: map[string]any{"stderr": res.Stderr}}
+	if toAppError(err).Code == "ELEMENT_AMBIGUOUS" {
+		return elementMatch{}, err
 	}
 
-	if ee := (*exec.ExitError)(nil); errors.As(err, &ee) {
-		res.ExitCode = ee.ExitCode()
-		return res, &AppError{Code: "COMMAND_FAILED", Message: fmt.Sprintf("command failed: %s", name), Details: map[string]any{"stderr": res.Stderr, "stdout": res.Stdout, "exitCode": res.ExitCode}}
+	snapshot, snapErr := a.captureElements(udid)
+	if snapErr != nil {
+		return elementMatch{}, err
 	}
-
-	if errors.Is(err, exec.ErrNotFound) {
-		return res, &AppError{Code: "COMMAND_NOT_FOUND", Message: fmt.Sprintf("command not found: %s", name)}
+	elem, candidates, err = rankElementsBySelector(snapshot.Elements, sel)
+	if err == nil {
+		return elementMatch{Element: elem, By: "live-scan", Candidates: candidates}, nil
 	}
-
-	return res, wrapErr("COMMAND_FAILED", fmt.Sprintf("failed to run: %s", name), err)
+	if toAppError(err).Code == "ELEMENT_AMBIGUOUS" {
+		return elementMatch{}, err
+	}
+	if fallback, ok := pickIntentFallbackElement(snapshot.Elements, sel.Label, sel.Contains); ok {
+		return elementMatch{Element: fallback, By: "intent-fallback", Fallback: true}, nil
+	}
+	if fallback, ok := pickSystemFallbackElement(snapshot.Elements, sel.Label, sel.Contains); ok {
+		return elementMatch{Element: fallback, By: "system-fallback", Fallback: true}, nil
+	}
+	return elementMatch{}, err
 }
 
-func normalizeElements(rawUI any, opts frameOptions) ([]Element, int, int) {
-	nodes := make([]candidateNode, 0, 64)
-	order := 0
-	walkCandidates(rawUI, "", &order, &nodes)
-	allCandidates := make([]Element, 0, len(nodes))
-	allCount := 0
-	interactiveCount := 0
+func (a *App) focusElementWithRetry(udid string, elem Element, retries int) (Element, error) {
+	if retries <= 0 {
+		retries = 1
+	}
+	target := elem
+	focusPoint := focusPointForElement(target)
+	var lastReason string
+	var lastSnapshot *elementSnapshot
+	var lastErr error
 
-	for _, node := range nodes {
-		elem, ok := elementFromCandidate(node)
-		if !ok {
-			continue
-		}
-		if elem.Frame.W*elem.Frame.H < opts.MinArea {
-			continue
-		}
-		roleKey := strings.ToLower(strings.TrimSpace(elem.Role))
-		if len(opts.IncludeRoles) > 0 && !opts.IncludeRoles[roleKey] {
+	for attempt := 1; attempt <= retries; attempt++ {
+		if _, err := a.runIDB(udid, "ui", "tap", idbCoordArg(focusPoint.X), idbCoordArg(focusPoint.Y)); err != nil {
+			lastErr = wrapAppErrCode(err, "IDB_UI_FAILED", "focus tap failed")
 			continue
 		}
-		if opts.ExcludeRoles[roleKey] {
+		time.Sleep(120 * time.Millisecond)
+		snapshot, err := a.captureElements(udid)
+		if err != nil {
+			lastErr = err
 			continue
 		}
-		if !elem.Enabled {
+		lastSnapshot = &snapshot
+		matched, ok := findBestVerificationTarget(snapshot.Elements, target)
+		if !ok {
+			lastReason = "target element not found after tap"
 			continue
 		}
-		allCount++
-		isInteractive := isInteractiveRole(elem.Role)
-		if isInteractive {
-			interactiveCount++
-		}
-		if opts.InteractiveOnly && !isInteractive {
-			continue
+		target = matched
+		focusPoint = focusPointForElement(target)
+		if canTrustFocus(snapshot.Elements, matched) {
+			target.Center = focusPoint
+			return target, nil
 		}
-		elem.order = node.Order
-		allCandidates = append(allCandidates, elem)
+		lastReason = "focus moved to different element"
 	}
 
-	screenRect := inferScreenRect(rawUI, allCandidates)
-	for i := range allCandidates {
-		allCandidates[i].Visible, allCandidates[i].Offscreen = classifyVisibility(allCandidates[i].Frame, screenRect)
+	details := map[string]any{
+		"selectorId": strings.TrimSpace(elem.ID),
+		"attempts":   retries,
 	}
-
-	switch opts.Order {
-	case "reading":
-		sort.Slice(allCandidates, func(i, j int) bool {
-			if allCandidates[i].Center.Y != allCandidates[j].Center.Y {
-				return allCandidates[i].Center.Y < allCandidates[j].Center.Y
-			}
-			if allCandidates[i].Center.X != allCandidates[j].Center.X {
-				return allCandidates[i].Center.X < allCandidates[j].Center.X
-			}
-			return allCandidates[i].ID < allCandidates[j].ID
-		})
-	case "stable":
-		sort.Slice(allCandidates, func(i, j int) bool {
-			return allCandidates[i].ID < allCandidates[j].ID
-		})
-	case "z":
-		sort.Slice(allCandidates, func(i, j int) bool {
-			return allCandidates[i].order < allCandidates[j].order
-		})
+	if strings.TrimSpace(lastReason) != "" {
+		details["reason"] = lastReason
 	}
-
-	for i := range allCandidates {
-		allCandidates[i].Index = i + 1
+	if lastErr != nil {
+		details["lastError"] = renderError(lastErr)
 	}
-	allCandidates = addNearbyLabels(allCandidates)
-
-	return allCandidates, allCount, interactiveCount
-}
-
-type candidateNode struct {
-	Path  string
-	Order int
-	Map   map[string]any
+	if lastSnapshot != nil {
+		details["interactive"] = lastSnapshot.InteractiveCount
+	}
+	return Element{}, &AppError{Code: "TYPE_FOCUS_FAILED", Message: "failed to verify focus target after retries", Details: details}
 }
 
-func walkCandidates(v any, path string, order *int, out *[]candidateNode) {
-	switch typed := v.(type) {
-	case map[string]any:
-		*order++
-		*out = append(*out, candidateNode{Path: path, Order: *order, Map: typed})
-		for k, child := range typed {
-			next := path + "/" + k
-			walkCandidates(child, next, order, out)
+func canTrustFocus(elements []Element, target Element) bool {
+	hasFocused := false
+	for _, elem := range elements {
+		if !elem.Focused {
+			continue
 		}
-	case []any:
-		for i, child := range typed {
-			next := fmt.Sprintf("%s/%d", path, i)
-			walkCandidates(child, next, order, out)
+		hasFocused = true
+		if strings.TrimSpace(target.ID) == "" {
+			dx := elem.Center.X - target.Center.X
+			dy := elem.Center.Y - target.Center.Y
+			if math.Hypot(dx, dy) <= 24 {
+				return true
+			}
+		}
+		if elem.ID == target.ID {
+			return true
 		}
 	}
+	return !hasFocused
 }
 
-func elementFromCandidate(node candidateNode) (Element, bool) {
-	rect, ok := findRect(node.Map)
-	if !ok || rect.W <= 0 || rect.H <= 0 {
-		return Element{}, false
-	}
-
-	id := firstString(node.Map, []string{"id", "identifier", "uid", "axPath", "path", "accessibilityIdentifier"})
-	if id == "" {
-		id = "axpath:" + node.Path
-	}
-	role := firstString(node.Map, []string{
-		"role", "type", "elementType", "axRole", "roleDescription", "AXRole", "wdType",
-	})
-	label := firstString(node.Map, []string{
-		"label", "name", "title", "placeholder", "accessibilityLabel", "axLabel", "AXLabel", "wdLabel",
-	})
-	value := firstString(node.Map, []string{
-		"value", "text", "axValue", "AXValue", "displayValue", "wdValue", "selectedText",
-	})
-	if label == "" && value != "" {
-		label = value
+func estimateClearBackspaces(elem Element) int {
+	runes := len([]rune(strings.TrimSpace(elem.Value)))
+	switch {
+	case runes <= 0:
+		return defaultClearKeys
+	case runes < 16:
+		return 24
+	case runes < 40:
+		return runes + 12
+	default:
+		return minInt(runes+16, 220)
 	}
-	enabled := firstBoolWithDefault(node.Map, []string{"enabled", "isEnabled"}, true)
-	focused := firstBoolWithDefault(node.Map, []string{"focused", "isFocused", "hasFocus", "AXFocused"}, false)
+}
 
-	return Element{
-		ID:      id,
-		Role:    role,
-		Label:   label,
-		Value:   value,
-		Enabled: enabled,
-		Focused: focused,
-		Visible: true,
-		Frame:   rect,
-		Center:  FramePoint{X: rect.X + rect.W/2, Y: rect.Y + rect.H/2, Unit: "pt"},
-		Source:  ElementSource{Tool: "idb", Method: "describe-all"},
-	}, true
+// keyCombo is a key press with optional held modifiers, e.g. cmd+a.
+type keyCombo struct {
+	Name      string
+	Key       int
+	Modifiers []int
 }
 
-func inferScreenRect(rawUI any, elements []Element) FrameRect {
-	if root, ok := rawUI.(map[string]any); ok {
-		if rect, ok := findRect(root); ok && rect.W > 0 && rect.H > 0 {
-			return rect
-		}
+// parseKeyCombo parses "return", "cmd+shift+z" or a raw HID code like "40".
+func parseKeyCombo(raw string) (keyCombo, error) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	combo := keyCombo{Name: raw}
+	if raw == "" {
+		return combo, &AppError{Code: "USAGE", Message: "key name is required"}
 	}
-	minX := math.MaxFloat64
-	minY := math.MaxFloat64
-	maxX := 0.0
-	maxY := 0.0
-	for _, e := range elements {
-		if e.Frame.W <= 0 || e.Frame.H <= 0 {
-			continue
+	var mods []string
+	keyName := raw
+	if strings.HasSuffix(raw, "+") {
+		// "+" and "cmd++" name the plus key, typed as shift+equal.
+		keyName = "+"
+		if prefix := strings.TrimSuffix(strings.TrimSuffix(raw, "+"), "+"); prefix != "" {
+			mods = strings.Split(prefix, "+")
 		}
-		if e.Frame.X < minX {
-			minX = e.Frame.X
-		}
-		if e.Frame.Y < minY {
-			minY = e.Frame.Y
+	} else {
+		parts := strings.Split(raw, "+")
+		keyName = strings.TrimSpace(parts[len(parts)-1])
+		mods = parts[:len(parts)-1]
+	}
+	for _, mod := range mods {
+		code, ok := hidModifierCodes[strings.TrimSpace(mod)]
+		if !ok {
+			return combo, &AppError{Code: "USAGE", Message: "unknown modifier: " + mod + " (cmd|shift|ctrl|alt)"}
 		}
-		if e.Frame.X+e.Frame.W > maxX {
-			maxX = e.Frame.X + e.Frame.W
+		combo.Modifiers = append(combo.Modifiers, code)
+	}
+	if keyName == "+" {
+		shift := hidModifierCodes["shift"]
+		hasShift := false
+		for _, code := range combo.Modifiers {
+			hasShift = hasShift || code == shift
 		}
-		if e.Frame.Y+e.Frame.H > maxY {
-			maxY = e.Frame.Y + e.Frame.H
+		if !hasShift {
+			combo.Modifiers = append(combo.Modifiers, shift)
 		}
+		combo.Key = hidKeyCodes["equal"]
+		return combo, nil
 	}
-	if minX == math.MaxFloat64 || minY == math.MaxFloat64 || maxX <= minX || maxY <= minY {
-		return FrameRect{}
+	if code, ok := hidKeyCodes[keyName]; ok {
+		combo.Key = code
+		return combo, nil
 	}
-	return FrameRect{X: minX, Y: minY, W: maxX - minX, H: maxY - minY, Unit: "pt"}
+	if code, err := strconv.Atoi(keyName); err == nil && code > 0 && code < 256 {
+		combo.Key = code
+		return combo, nil
+	}
+	return combo, &AppError{Code: "USAGE", Message: "unknown key: " + keyName}
 }
 
-func classifyVisibility(rect FrameRect, screen FrameRect) (bool, bool) {
-	if rect.W <= 0 || rect.H <= 0 {
-		return false, true
+func (c keyCombo) details() map[string]any {
+	return map[string]any{"action": "key", "key": c.Name, "keyCode": c.Key, "modifiers": c.Modifiers}
+}
+
+// pressKeyCombo presses the key. `idb ui key` cannot hold a modifier, so
+// combos are sent as one key-down/key-up sequence through runHIDEvents.
+func (a *App) pressKeyCombo(udid string, combo keyCombo) error {
+	if len(combo.Modifiers) == 0 {
+		if _, err := a.runIDB(udid, "ui", "key", strconv.Itoa(combo.Key)); err != nil {
+			return wrapAppErrCode(err, "IDB_UI_FAILED", "key press failed: "+combo.Name)
+		}
+		return nil
 	}
-	if screen.W <= 0 || screen.H <= 0 {
-		return true, false
+	if err := a.runHIDEvents(udid, keyComboEvents(combo)); err != nil {
+		return wrapAppErrCode(err, "IDB_UI_FAILED", "key combo failed: "+combo.Name)
 	}
-	screenRight := screen.X + screen.W
-	screenBottom := screen.Y + screen.H
-	rectRight := rect.X + rect.W
-	rectBottom := rect.Y + rect.H
+	return nil
+}
 
-	interLeft := math.Max(rect.X, screen.X)
-	interTop := math.Max(rect.Y, screen.Y)
-	interRight := math.Min(rectRight, screenRight)
-	interBottom := math.Min(rectBottom, screenBottom)
-	if interRight <= interLeft || interBottom <= interTop {
-		return false, true
+// keyComboEvents presses the modifiers, taps the key and releases the
+// modifiers in reverse order.
+func keyComboEvents(combo keyCombo) []hidEvent {
+	events := make([]hidEvent, 0, 2*len(combo.Modifiers)+4)
+	for _, mod := range combo.Modifiers {
+		events = append(events, keyDown(mod))
 	}
-	offscreen := rect.X < screen.X || rect.Y < screen.Y || rectRight > screenRight || rectBottom > screenBottom
-	return true, offscreen
+	events = append(events, hidDelay(keyComboStepDelay), keyDown(combo.Key), keyUp(combo.Key), hidDelay(keyComboStepDelay))
+	for i := len(combo.Modifiers) - 1; i >= 0; i-- {
+		events = append(events, keyUp(combo.Modifiers[i]))
+	}
+	return events
 }
 
-func addNearbyLabels(elements []Element) []Element {
-	for i := range elements {
-		if strings.TrimSpace(elements[i].Label) != "" {
-			continue
+const (
+	clearStrategyAuto      = "auto"
+	clearStrategySelectAll = "select-all"
+	clearStrategyBackspace = "backspace"
+)
+
+func validateClearStrategy(strategy string) error {
+	switch strategy {
+	case clearStrategyAuto, clearStrategySelectAll, clearStrategyBackspace:
+		return nil
+	}
+	return &AppError{Code: "USAGE", Message: "--strategy must be auto|select-all|backspace"}
+}
+
+func flowClearStrategy(step uiFlowStep) string {
+	if strings.TrimSpace(step.Strategy) == "" {
+		return clearStrategyAuto
+	}
+	return strings.TrimSpace(step.Strategy)
+}
+
+// clearMethods lists the clearing methods a strategy tries, in order.
+func clearMethods(strategy string) []string {
+	switch strategy {
+	case clearStrategySelectAll:
+		return []string{"cmd+a", "triple-tap"}
+	case clearStrategyBackspace:
+		return []string{"backspace"}
+	}
+	return []string{"cmd+a", "triple-tap", "backspace"}
+}
+
+// clearInputField empties the focused field elem. Each method of the strategy
+// is tried in turn (select-all via cmd+a or a triple tap followed by delete,
+// then estimated backspaces) and the field is re-read after each one; the
+// first method that leaves it empty or showing its placeholder is reported.
+// backspaces counts every delete key sent, as before strategies existed.
+func (a *App) clearInputField(udid string, elem Element, strategy string, minBackspaces int) (map[string]any, error) {
+	backspaces := 0
+	result := map[string]any{"strategy": strategy}
+	tried := make([]string, 0, 3)
+	observed := elem
+	for _, method := range clearMethods(strategy) {
+		tried = append(tried, method)
+		switch method {
+		case "cmd+a":
+			selectAll := keyCombo{Name: "cmd+a", Key: hidKeyCodes["a"], Modifiers: []int{hidModifierCodes["cmd"]}}
+			if err := a.pressKeyCombo(udid, selectAll); err != nil {
+				return nil, err
+			}
+			if err := a.clearFocusedInput(udid, 1); err != nil {
+				return nil, err
+			}
+			backspaces++
+		case "triple-tap":
+			point := focusPointForElement(observed)
+			if err := a.performTap(udid, point.X, point.Y, tapGesture{Kind: "tap", Count: 3}); err != nil {
+				return nil, err
+			}
+			time.Sleep(150 * time.Millisecond)
+			if err := a.clearFocusedInput(udid, 1); err != nil {
+				return nil, err
+			}
+			backspaces++
+		case "backspace":
+			count := estimateClearBackspaces(observed)
+			if count < minBackspaces {
+				count = minBackspaces
+			}
+			if err := a.clearFocusedInput(udid, count); err != nil {
+				return nil, err
+			}
+			backspaces += count
 		}
-		bestIdx := -1
-		bestScore := math.MaxFloat64
-		for j := range elements {
-			if i == j {
-				continue
+		result["backspaces"] = backspaces
+		time.Sleep(90 * time.Millisecond)
+		snapshot, err := a.captureElements(udid)
+		if err != nil {
+			return nil, err
+		}
+		if current, ok := findBestVerificationTarget(snapshot.Elements, elem); ok {
+			observed = current
+			if inputFieldCleared(current) {
+				result["method"] = method
+				result["tried"] = tried
+				return result, nil
 			}
-			label := strings.TrimSpace(elements[j].Label)
-			if label == "" || !elements[j].Visible {
-				continue
+		}
+	}
+	return nil, &AppError{
+		Code:    "CLEAR_INCOMPLETE",
+		Message: "field is not empty after clearing",
+		Details: map[string]any{"strategy": strategy, "tried": tried, "observed": observed.Value, "elementId": elem.ID},
+	}
+}
+
+// inputFieldCleared reports whether a text input is empty. Empty iOS fields
+// report their placeholder as the value, which usually repeats the label;
+// other placeholders only count when the tree exposes them.
+func inputFieldCleared(elem Element) bool {
+	value := strings.TrimSpace(elem.Value)
+	if value == "" {
+		return true
+	}
+	if isSecureTextInputRole(elem.Role) {
+		if n, ok := secureBulletCount(value); ok && n == 0 {
+			return true
+		}
+	}
+	if placeholder := strings.TrimSpace(elem.Placeholder); placeholder != "" && value == placeholder {
+		return true
+	}
+	return value == strings.TrimSpace(elem.Label) || value == strings.TrimSpace(elem.NearbyLabel)
+}
+
+func (a *App) clearFocusedInput(udid string, count int) error {
+	if count <= 0 {
+		count = defaultClearKeys
+	}
+	args := make([]string, 0, count+2)
+	args = append(args, "ui", "key-sequence")
+	for i := 0; i < count; i++ {
+		args = append(args, backspaceKeyCode)
+	}
+	if _, err := a.runIDB(udid, args...); err == nil {
+		return nil
+	}
+	for i := 0; i < count; i++ {
+		if _, err := a.runIDB(udid, "ui", "key", backspaceKeyCode); err != nil {
+			return wrapAppErrCode(err, "IDB_UI_FAILED", "clear text failed")
+		}
+	}
+	return nil
+}
+
+func prepareTypedText(text string, asciiMode, pasteMode bool) (string, string, error) {
+	out := strings.TrimSpace(text)
+	if asciiMode {
+		out = asciiOnly(out)
+		if strings.TrimSpace(out) == "" {
+			return "", "", &AppError{Code: "TYPE_ASCII_EMPTY", Message: "text became empty after ASCII normalization"}
+		}
+	}
+	mode := "type"
+	if pasteMode && asciiMode {
+		mode = "paste-ascii"
+	} else if pasteMode {
+		mode = "paste"
+	} else if asciiMode {
+		mode = "ascii"
+	}
+	return out, mode, nil
+}
+
+func asciiOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// textInputOptions are the per-command knobs of submitTextInput.
+type textInputOptions struct {
+	Paste      bool
+	Chunking   inputChunking
+	VerifyMode verifyMode
+	// SecureBaseline is the bullet count of a secure field before typing (0
+	// when it was empty or showed its placeholder), or -1 when the field is
+	// not secure or could not be read.
+	SecureBaseline int
+}
+
+// secureBaseline counts the bullets a secure field shows before typing.
+// Secure fields only report bullets, and focused.Value may predate a
+// --replace clear, so the field is re-read.
+func (a *App) secureBaseline(udid string, focused *Element) int {
+	if focused == nil || !isSecureTextInputRole(focused.Role) {
+		return -1
+	}
+	snapshot, err := a.captureElements(udid)
+	if err != nil {
+		return -1
+	}
+	if matched, ok := findBestVerificationTarget(snapshot.Elements, *focused); ok {
+		return secureBaselineFromValue(matched.Value)
+	}
+	return -1
+}
+
+func (a *App) submitTextInput(udid, text string, focused *Element, input textInputOptions) error {
+	if strings.TrimSpace(text) == "" {
+		return nil
+	}
+	secureBaseline := input.SecureBaseline
+	if input.Paste {
+		if err := a.pasteTextInput(udid, text, focused); err != nil {
+			return err
+		}
+	} else if err := a.typeTextInChunks(udid, text, input.Chunking); err != nil {
+		return err
+	}
+
+	target := focused
+	if target == nil {
+		if snapshot, err := a.captureElements(udid); err == nil {
+			if focusedElem, ok := findFocusedTextInput(snapshot.Elements); ok {
+				target = &focusedElem
 			}
-			dx := elements[i].Center.X - elements[j].Center.X
-			dy := elements[i].Center.Y - elements[j].Center.Y
-			distance := math.Hypot(dx, dy)
-			if distance > 220 {
-				continue
+		}
+	}
+	if target == nil {
+		return nil
+	}
+
+	lastObserved := ""
+	lastSecure := false
+	for attempt := 1; attempt <= 4; attempt++ {
+		time.Sleep(90 * time.Millisecond)
+		snapshot, err := a.captureElements(udid)
+		if err != nil {
+			return err
+		}
+		matched, ok := findBestVerificationTarget(snapshot.Elements, *target)
+		if !ok {
+			if focusedElem, hasFocus := findFocusedTextInput(snapshot.Elements); hasFocus {
+				matched = focusedElem
+				ok = true
 			}
-			if distance < bestScore {
-				bestScore = distance
-				bestIdx = j
+		}
+		if !ok {
+			details := map[string]any{"intended": text, "attempt": attempt}
+			if isSecureTextInputRole(target.Role) {
+				details = map[string]any{"secure": true, "intendedLength": len([]rune(text)), "attempt": attempt}
+			}
+			return &AppError{
+				Code:    "TYPE_VERIFY_FAILED",
+				Message: "typed text verification target not found",
+				Details: details,
 			}
 		}
-		if bestIdx >= 0 {
-			elements[i].NearbyLabel = elements[bestIdx].Label
+		target = &matched
+		secure := isSecureTextInputRole(matched.Role)
+		observed := strings.TrimSpace(matched.Value)
+		if observed == "" && !secure {
+			observed = strings.TrimSpace(matched.Label)
+		}
+		lastObserved = observed
+		lastSecure = secure
+		var missing string
+		var comparable bool
+		if secure {
+			missing, comparable = secureMissingSuffix(text, observed, secureBaseline)
+		} else {
+			missing, comparable = input.VerifyMode.missingSuffix(text, observed)
+		}
+		if !comparable {
+			details := map[string]any{"intended": text, "observed": observed, "attempt": attempt, "elementId": matched.ID, "verifyMode": input.VerifyMode.String()}
+			if secure {
+				details = secureTypeDetails(text, observed, secureBaseline)
+				details["attempt"] = attempt
+				details["elementId"] = matched.ID
+			}
+			return &AppError{
+				Code:    "TYPE_INCOMPLETE",
+				Message: "typed text does not match target value prefix",
+				Details: details,
+			}
+		}
+		if missing == "" {
+			return nil
+		}
+		if err := a.typeTextInChunks(udid, missing, input.Chunking); err != nil {
+			return err
+		}
+	}
+
+	if lastSecure {
+		if missing, _ := secureMissingSuffix(text, lastObserved, secureBaseline); missing != "" {
+			return &AppError{
+				Code:    "TYPE_INCOMPLETE",
+				Message: "secure text remains incomplete after retries",
+				Details: secureTypeDetails(text, lastObserved, secureBaseline),
+			}
+		}
+		return nil
+	}
+	if missing, _ := input.VerifyMode.missingSuffix(text, lastObserved); missing != "" {
+		return &AppError{
+			Code:    "TYPE_INCOMPLETE",
+			Message: "typed text remains incomplete after retries",
+			Details: map[string]any{"intended": text, "observed": lastObserved, "missing": missing},
+		}
+	}
+	return nil
+}
+
+// pasteMenuLabels are the edit-menu items that paste, by locale.
+var pasteMenuLabels = []string{"Paste", "ペースト", "貼り付け", "붙여넣기", "粘贴", "貼上"}
+
+const (
+	pasteSettleDelay  = 250 * time.Millisecond
+	pastePollInterval = 150 * time.Millisecond
+	// pasteLandTimeout is how long a paste may take to show up in the tree
+	// before the edit-menu fallback runs; falling back too early pastes twice.
+	pasteLandTimeout = 1500 * time.Millisecond
+)
+
+// pasteTextInput puts text on the simulator pasteboard and pastes it into the
+// focused field with cmd+v. When the shortcut does not land (no hardware
+// keyboard connected), it long-presses the field and taps the edit menu's
+// Paste item instead.
+func (a *App) pasteTextInput(udid, text string, focused *Element) error {
+	target := focused
+	if target == nil {
+		if snapshot, err := a.captureElements(udid); err == nil {
+			if focusedElem, ok := findFocusedTextInput(snapshot.Elements); ok {
+				target = &focusedElem
+			}
+		}
+	}
+	before := ""
+	if target != nil {
+		before = target.Value
+	}
+	if err := a.writePasteboard(udid, text); err != nil {
+		return err
+	}
+	paste := keyCombo{Name: "cmd+v", Key: hidKeyCodes["v"], Modifiers: []int{hidModifierCodes["cmd"]}}
+	if err := a.pressKeyCombo(udid, paste); err != nil {
+		return err
+	}
+	if target == nil {
+		return nil
+	}
+	landed, changed := a.awaitPaste(udid, text, before, *target)
+	if landed || changed {
+		// A value that changed without the full text is left to the caller's
+		// suffix check; pasting again from the menu would duplicate it.
+		return nil
+	}
+
+	beforeMenu, err := a.captureElements(udid)
+	if err != nil {
+		return err
+	}
+	hold := tapGesture{Kind: "longpress", Count: 1, Duration: defaultLongPressDuration}
+	point := focusPointForElement(*target)
+	if err := a.performTap(udid, point.X, point.Y, hold); err != nil {
+		return err
+	}
+	time.Sleep(pasteSettleDelay)
+	snapshot, err := a.captureElements(udid)
+	if err != nil {
+		return err
+	}
+	item, ok := findPasteMenuItem(snapshot.Elements, *target, beforeMenu.Elements)
+	if !ok {
+		return &AppError{
+			Code:    "PASTE_FAILED",
+			Message: "cmd+v did not paste and no Paste menu item appeared",
+			Details: map[string]any{"intended": text, "elementId": target.ID},
+		}
+	}
+	if err := a.performTap(udid, item.Center.X, item.Center.Y, tapGesture{Kind: "tap", Count: 1}); err != nil {
+		return err
+	}
+	if landed, _ := a.awaitPaste(udid, text, before, *target); !landed {
+		return &AppError{
+			Code:    "PASTE_FAILED",
+			Message: "the Paste menu item was tapped but the field did not change",
+			Details: map[string]any{"intended": text, "elementId": target.ID, "menuItem": item.Label},
+		}
+	}
+	return nil
+}
+
+// awaitPaste polls the target field until it includes the pasted text or
+// pasteLandTimeout passes. changed reports whether the value moved at all.
+func (a *App) awaitPaste(udid, text, before string, target Element) (landed, changed bool) {
+	deadline := time.Now().Add(pasteLandTimeout)
+	for {
+		time.Sleep(pastePollInterval)
+		if snapshot, err := a.captureElements(udid); err == nil {
+			if matched, ok := findBestVerificationTarget(snapshot.Elements, target); ok {
+				if pasteValueLanded(text, before, matched) {
+					return true, true
+				}
+				changed = matched.Value != before
+			}
+		}
+		if time.Now().After(deadline) {
+			return false, changed
 		}
 	}
-	return elements
 }
 
-func findRect(m map[string]any) (FrameRect, bool) {
-	if rect, ok := rectFromAny(m["frame"]); ok {
-		return rect, true
+// pasteValueLanded reports whether field changed to include text after a
+// paste. Secure fields only expose bullets, so any change counts.
+func pasteValueLanded(text, before string, field Element) bool {
+	if field.Value == before {
+		return false
+	}
+	if isSecureTextInputRole(field.Role) {
+		return true
+	}
+	want, _ := comparableRunesWithMap([]rune(text))
+	got, _ := comparableRunesWithMap([]rune(field.Value))
+	return strings.Contains(string(got), string(want))
+}
+
+// pasteMenuMaxDistance bounds how far from the field (in pt) the edit menu's
+// Paste item may be.
+const pasteMenuMaxDistance = 150
+
+// findPasteMenuItem finds the edit menu's Paste item after a long press on
+// field. Only menu items, or buttons that were not on screen before the long
+// press, near the field qualify, so an app's own "Paste" button is never hit.
+func findPasteMenuItem(elements []Element, field Element, before []Element) (Element, bool) {
+	existed := map[string]bool{}
+	for _, elem := range before {
+		existed[elem.ID+"\x00"+elem.Label] = true
+	}
+	for _, elem := range elements {
+		if !elem.Enabled || rectDistance(elem.Frame, field.Frame) > pasteMenuMaxDistance {
+			continue
+		}
+		role := strings.ToLower(elem.Role)
+		isMenu := strings.Contains(role, "menu")
+		if !isMenu && (existed[elem.ID+"\x00"+elem.Label] || !strings.Contains(role, "button")) {
+			continue
+		}
+		label := strings.TrimSpace(elem.Label)
+		for _, want := range pasteMenuLabels {
+			if strings.EqualFold(label, want) {
+				return elem, true
+			}
+		}
+	}
+	return Element{}, false
+}
+
+// inputChunking controls how typed text is split across `idb ui text`
+// calls: Size grapheme clusters per call, Delay between calls.
+type inputChunking struct {
+	Size  int
+	Delay time.Duration
+}
+
+var defaultInputChunking = inputChunking{Size: 4, Delay: 60 * time.Millisecond}
+
+// newInputChunking applies --chunk-size/--chunk-delay (or the flow fields)
+// over the defaults; zero size and empty delay keep the default.
+func newInputChunking(size int, delay string) (inputChunking, error) {
+	c := defaultInputChunking
+	if size < 0 {
+		return c, &AppError{Code: "USAGE", Message: "chunk size must be >= 1"}
+	}
+	if size > 0 {
+		c.Size = size
+	}
+	if strings.TrimSpace(delay) != "" {
+		d, err := time.ParseDuration(strings.TrimSpace(delay))
+		if err != nil || d < 0 {
+			return c, &AppError{Code: "USAGE", Message: "chunk delay must be a non-negative duration"}
+		}
+		c.Delay = d
+	}
+	return c, nil
+}
+
+func (a *App) typeTextInChunks(udid, text string, chunking inputChunking) error {
+	chunks := splitIntoInputChunks(text, chunking.Size)
+	for _, chunk := range chunks {
+		if chunk == "" {
+			continue
+		}
+		if _, err := a.runIDB(udid, "ui", "text", chunk); err != nil {
+			return wrapAppErrCode(err, "IDB_UI_FAILED", "text input failed")
+		}
+		if len(chunks) > 1 {
+			time.Sleep(chunking.Delay)
+		}
+	}
+	return nil
+}
+
+// splitIntoInputChunks groups text into chunks of at most chunkSize grapheme
+// clusters, so emoji sequences and combining marks are never split between
+// two idb calls.
+func splitIntoInputChunks(text string, chunkSize int) []string {
+	clusters := splitGraphemes(text)
+	if len(clusters) == 0 {
+		return nil
+	}
+	if chunkSize <= 0 || len(clusters) <= chunkSize {
+		return []string{text}
+	}
+	chunks := make([]string, 0, (len(clusters)+chunkSize-1)/chunkSize)
+	for i := 0; i < len(clusters); i += chunkSize {
+		end := i + chunkSize
+		if end > len(clusters) {
+			end = len(clusters)
+		}
+		chunks = append(chunks, strings.Join(clusters[i:end], ""))
+	}
+	return chunks
+}
+
+// graphemeClass is the subset of the UAX #29 Grapheme_Cluster_Break property
+// needed to keep typed text intact.
+type graphemeClass int
+
+const (
+	gcOther graphemeClass = iota
+	gcCR
+	gcLF
+	gcControl
+	gcExtend
+	gcZWJ
+	gcRegional
+	gcSpacingMark
+	gcL
+	gcV
+	gcT
+	gcLV
+	gcLVT
+	gcPictographic
+)
+
+func graphemeClassOf(r rune) graphemeClass {
+	switch {
+	case r == '\r':
+		return gcCR
+	case r == '\n':
+		return gcLF
+	case r == 0x200D:
+		return gcZWJ
+	case r >= 0x1F1E6 && r <= 0x1F1FF:
+		return gcRegional
+	case r >= 0x1F3FB && r <= 0x1F3FF, // emoji skin-tone modifiers
+		r >= 0xE0020 && r <= 0xE007F, // emoji tag sequences (subdivision flags)
+		r == 0x200C, r == 0xFF9E, r == 0xFF9F,
+		unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r):
+		return gcExtend
+	case unicode.Is(unicode.Mc, r):
+		return gcSpacingMark
+	case unicode.Is(unicode.Cc, r), unicode.Is(unicode.Cf, r), unicode.Is(unicode.Zl, r), unicode.Is(unicode.Zp, r):
+		return gcControl
+	case r >= 0x1100 && r <= 0x115F, r >= 0xA960 && r <= 0xA97C:
+		return gcL
+	case r >= 0x1160 && r <= 0x11A7, r >= 0xD7B0 && r <= 0xD7C6:
+		return gcV
+	case r >= 0x11A8 && r <= 0x11FF, r >= 0xD7CB && r <= 0xD7FB:
+		return gcT
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return gcLV
+		}
+		return gcLVT
+	case isExtendedPictographic(r):
+		return gcPictographic
+	}
+	return gcOther
+}
+
+// isExtendedPictographic approximates the Extended_Pictographic property
+// with the blocks emoji are drawn from.
+func isExtendedPictographic(r rune) bool {
+	switch {
+	case r == 0x00A9, r == 0x00AE, r == 0x203C, r == 0x2049, r == 0x2122, r == 0x2139,
+		r == 0x24C2, r == 0x3030, r == 0x303D, r == 0x3297, r == 0x3299:
+		return true
+	case r >= 0x2194 && r <= 0x21AA, r >= 0x231A && r <= 0x23FF, r >= 0x25AA && r <= 0x25FE,
+		r >= 0x2600 && r <= 0x27BF, r >= 0x2934 && r <= 0x2935, r >= 0x2B05 && r <= 0x2B55,
+		r >= 0x1F000 && r <= 0x1FAFF, r >= 0x1FC00 && r <= 0x1FFFD:
+		return true
+	}
+	return false
+}
+
+// splitGraphemes splits s into extended grapheme clusters following the
+// UAX #29 rules GB3–GB13 (Prepend characters are treated as Other).
+func splitGraphemes(s string) []string {
+	clusters := make([]string, 0, len(s))
+	start := 0
+	prev := graphemeClass(-1)
+	regionalRun := 0
+	pictRun := false
+	zwjAfterPict := false
+	for i, r := range s {
+		cls := graphemeClassOf(r)
+		if prev >= 0 && graphemeBreakBetween(prev, cls, regionalRun, zwjAfterPict) {
+			clusters = append(clusters, s[start:i])
+			start = i
+		}
+		if cls == gcRegional {
+			regionalRun++
+		} else {
+			regionalRun = 0
+		}
+		switch cls {
+		case gcPictographic:
+			pictRun, zwjAfterPict = true, false
+		case gcExtend:
+			zwjAfterPict = false
+		case gcZWJ:
+			zwjAfterPict, pictRun = pictRun, false
+		default:
+			pictRun, zwjAfterPict = false, false
+		}
+		prev = cls
+	}
+	if start < len(s) {
+		clusters = append(clusters, s[start:])
+	}
+	return clusters
+}
+
+func graphemeBreakBetween(prev, next graphemeClass, regionalRun int, zwjAfterPict bool) bool {
+	switch {
+	case prev == gcCR && next == gcLF:
+		return false
+	case prev == gcCR || prev == gcLF || prev == gcControl:
+		return true
+	case next == gcCR || next == gcLF || next == gcControl:
+		return true
+	case prev == gcL && (next == gcL || next == gcV || next == gcLV || next == gcLVT):
+		return false
+	case (prev == gcLV || prev == gcV) && (next == gcV || next == gcT):
+		return false
+	case (prev == gcLVT || prev == gcT) && next == gcT:
+		return false
+	case next == gcExtend || next == gcZWJ || next == gcSpacingMark:
+		return false
+	case prev == gcZWJ && next == gcPictographic && zwjAfterPict:
+		return false
+	case prev == gcRegional && next == gcRegional:
+		return regionalRun%2 == 0
+	}
+	return true
+}
+
+func findFocusedTextInput(elements []Element) (Element, bool) {
+	for _, elem := range elements {
+		if elem.Enabled && elem.Focused && isTextInputRole(elem.Role) {
+			return elem, true
+		}
+	}
+	return Element{}, false
+}
+
+func typedMissingSuffix(intended, observed string) (string, bool) {
+	return typedMissingSuffixFunc(intended, observed, defaultCompareRune)
+}
+
+// typedMissingSuffixFunc compares intended and observed after folding each
+// rune with fold (which drops a rune by returning false) and returns the
+// part of intended that has not been typed yet.
+func typedMissingSuffixFunc(intended, observed string, fold func(rune) (rune, bool)) (string, bool) {
+	intendedRunes := []rune(intended)
+	observedRunes := []rune(observed)
+	intendedComparable, intendedMap := comparableRunesFunc(intendedRunes, fold)
+	observedComparable, _ := comparableRunesFunc(observedRunes, fold)
+	if len(observedComparable) > len(intendedComparable) {
+		return "", false
+	}
+	for i := 0; i < len(observedComparable); i++ {
+		if observedComparable[i] != intendedComparable[i] {
+			return "", false
+		}
+	}
+	if len(observedComparable) == len(intendedComparable) {
+		return "", true
+	}
+	start := intendedMap[len(observedComparable)]
+	if start < 0 || start > len(intendedRunes) {
+		return "", false
+	}
+	return string(intendedRunes[start:]), true
+}
+
+// secureBulletRunes are the mask characters secure text fields report.
+const secureBulletRunes = "•●∙*"
+
+// secureBulletCount returns how many characters a secure field holds. iOS
+// briefly shows the last typed character unmasked, so the final rune may be
+// anything. ok is false when the value is not a mask (e.g. a placeholder).
+func secureBulletCount(value string) (int, bool) {
+	runes := []rune(strings.TrimSpace(value))
+	for i, r := range runes {
+		if i == len(runes)-1 {
+			break
+		}
+		if !strings.ContainsRune(secureBulletRunes, r) {
+			return 0, false
+		}
+	}
+	return len(runes), true
+}
+
+// secureBaselineFromValue is the bullet count of a secure field value before
+// typing. Empty secure fields report their placeholder ("Password"), which
+// counts as 0.
+func secureBaselineFromValue(value string) int {
+	if n, ok := secureBulletCount(value); ok {
+		return n
+	}
+	return 0
+}
+
+// secureMissingSuffix is typedMissingSuffix for secure fields: it compares
+// the bullet count against the intended length and returns the untyped tail.
+// iOS clears a secure field on the first keystroke after refocus, so a count
+// equal to the intended length is complete whatever the baseline was, and
+// baseline+len is complete when the prior bullets were kept. A tail is only
+// retyped when the bullets are known to be typed ones: the field was empty
+// before typing, or it holds more than the intended length and so was not
+// cleared on entry. A baseline < 0 means the prior content is unknown and
+// surplus bullets are tolerated.
+func secureMissingSuffix(intended, observed string, baseline int) (string, bool) {
+	count, ok := secureBulletCount(observed)
+	if !ok {
+		return "", false
+	}
+	intendedRunes := []rune(intended)
+	n := len(intendedRunes)
+	switch {
+	case count == n, baseline > 0 && count == baseline+n:
+		return "", true
+	case baseline == 0 && count < n:
+		return string(intendedRunes[count:]), true
+	case baseline > 0 && count > n && count >= baseline && count < baseline+n:
+		return string(intendedRunes[count-baseline:]), true
+	case baseline < 0 && count > n:
+		return "", true
+	}
+	return "", false
+}
+
+// secureTypeVerified reports whether a secure field holds exactly the typed
+// length, either alone (empty or cleared on entry) or on top of baseline.
+func secureTypeVerified(typed, observed string, baseline int) bool {
+	count, ok := secureBulletCount(observed)
+	if !ok {
+		return false
+	}
+	n := len([]rune(typed))
+	return count == n || (baseline > 0 && count == baseline+n)
+}
+
+// secureTypeDetails reports lengths only so secrets never reach error output.
+func secureTypeDetails(intended, observed string, baseline int) map[string]any {
+	count, _ := secureBulletCount(observed)
+	details := map[string]any{"secure": true, "intendedLength": len([]rune(intended)), "observedLength": count}
+	if baseline >= 0 {
+		details["baselineLength"] = baseline
+	}
+	return details
+}
+
+func comparableRunesWithMap(runes []rune) ([]rune, []int) {
+	return comparableRunesFunc(runes, defaultCompareRune)
+}
+
+func comparableRunesFunc(runes []rune, fold func(rune) (rune, bool)) ([]rune, []int) {
+	comparable := make([]rune, 0, len(runes))
+	indexMap := make([]int, 0, len(runes))
+	for i, r := range runes {
+		folded, keep := fold(r)
+		if !keep {
+			continue
+		}
+		comparable = append(comparable, folded)
+		indexMap = append(indexMap, i)
+	}
+	return comparable, indexMap
+}
+
+func isIgnoredCompareRune(r rune) bool {
+	return unicode.IsSpace(r)
+}
+
+func defaultCompareRune(r rune) (rune, bool) {
+	return r, !isIgnoredCompareRune(r)
+}
+
+// verifyMode selects how typed input is compared with the field value for
+// suffix recovery and --verify. The zero value ignores whitespace only;
+// exact compares verbatim, digits compares digits only, loose also ignores
+// punctuation, symbols, case and full-width forms, and regex requires the
+// final value to match Pattern (recovering with loose comparison).
+type verifyMode struct {
+	Kind    string
+	Pattern *regexp.Regexp
+}
+
+func parseVerifyMode(raw string) (verifyMode, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case raw == "" || raw == "default":
+		return verifyMode{}, nil
+	case raw == "exact" || raw == "digits" || raw == "loose":
+		return verifyMode{Kind: raw}, nil
+	case strings.HasPrefix(raw, "regex:"):
+		re, err := regexp.Compile(strings.TrimPrefix(raw, "regex:"))
+		if err != nil {
+			return verifyMode{}, &AppError{Code: "USAGE", Message: "invalid --verify-mode regex: " + err.Error()}
+		}
+		return verifyMode{Kind: "regex", Pattern: re}, nil
+	}
+	return verifyMode{}, &AppError{Code: "USAGE", Message: "--verify-mode must be exact|digits|loose|regex:<pattern>"}
+}
+
+func (m verifyMode) String() string {
+	switch m.Kind {
+	case "":
+		return "default"
+	case "regex":
+		return "regex:" + m.Pattern.String()
+	}
+	return m.Kind
+}
+
+// targetOnly reports whether --verify must check the target field alone.
+// digits and regex comparisons are loose enough that some other element on
+// screen (a hint, a formatted label) would often satisfy them by accident.
+func (m verifyMode) targetOnly() bool {
+	return m.Kind == "digits" || m.Kind == "regex"
+}
+
+func (m verifyMode) fold(r rune) (rune, bool) {
+	switch m.Kind {
+	case "exact":
+		return r, true
+	case "digits":
+		r = foldFullWidthRune(r)
+		return r, r >= '0' && r <= '9'
+	case "loose", "regex":
+		r = foldFullWidthRune(r)
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			return r, false
+		}
+		return unicode.ToLower(r), true
+	}
+	return defaultCompareRune(r)
+}
+
+func (m verifyMode) missingSuffix(intended, observed string) (string, bool) {
+	if m.Kind == "regex" && m.Pattern.MatchString(strings.TrimSpace(observed)) {
+		return "", true
+	}
+	missing, comparable := typedMissingSuffixFunc(intended, observed, m.fold)
+	if m.Kind == "regex" && comparable && missing == "" {
+		// Everything was typed but the value still fails the pattern.
+		return "", false
+	}
+	return missing, comparable
+}
+
+// holds reports whether value shows the typed text under this mode.
+func (m verifyMode) holds(intended, value string) bool {
+	if m.Kind == "regex" {
+		return m.Pattern.MatchString(strings.TrimSpace(value))
+	}
+	want, _ := comparableRunesFunc([]rune(intended), m.fold)
+	got, _ := comparableRunesFunc([]rune(value), m.fold)
+	return len(want) > 0 && strings.Contains(string(got), string(want))
+}
+
+// foldFullWidthRune maps full-width ASCII variants and the ideographic space
+// to their ASCII forms.
+func foldFullWidthRune(r rune) rune {
+	switch {
+	case r >= 0xFF01 && r <= 0xFF5E:
+		return r - 0xFEE0
+	case r == 0x3000:
+		return ' '
+	}
+	return r
+}
+
+const (
+	defaultExpectTimeout   = 5 * time.Second
+	expectPollInterval     = 300 * time.Millisecond
+	maxReportedDiffEntries = 20
+)
+
+// actionExpectation is what --expect-* asks a ui action to bring about: any UI
+// change, a text appearing, or elements matching a select expression going
+// away. All set conditions must hold.
+type actionExpectation struct {
+	Change  bool
+	Text    string
+	Gone    string
+	Timeout time.Duration
+}
+
+func addExpectFlags(fs *flag.FlagSet) *actionExpectation {
+	e := &actionExpectation{}
+	fs.BoolVar(&e.Change, "expect-change", false, "wait until the UI changes")
+	fs.StringVar(&e.Text, "expect-text", "", "wait until text appears")
+	fs.StringVar(&e.Gone, "expect-gone", "", "wait until no element matches this selector expression")
+	fs.DurationVar(&e.Timeout, "expect-timeout", defaultExpectTimeout, "expectation timeout")
+	return e
+}
+
+func (e actionExpectation) active() bool {
+	return e.Change || strings.TrimSpace(e.Text) != "" || strings.TrimSpace(e.Gone) != ""
+}
+
+func (e actionExpectation) details() map[string]any {
+	out := map[string]any{"timeoutMs": e.Timeout.Milliseconds()}
+	if e.Change {
+		out["change"] = true
+	}
+	if strings.TrimSpace(e.Text) != "" {
+		out["text"] = strings.TrimSpace(e.Text)
+	}
+	if strings.TrimSpace(e.Gone) != "" {
+		out["gone"] = strings.TrimSpace(e.Gone)
+	}
+	return out
+}
+
+// expectBaseline validates e and captures the UI before the action, or
+// returns an empty snapshot when no expectation is set.
+func (a *App) expectBaseline(udid string, e actionExpectation) (elementSnapshot, error) {
+	if !e.active() {
+		return elementSnapshot{}, nil
+	}
+	if e.Timeout <= 0 {
+		return elementSnapshot{}, &AppError{Code: "USAGE", Message: "--expect-timeout must be > 0"}
+	}
+	if strings.TrimSpace(e.Gone) != "" {
+		if _, err := parseSelectorExpr(e.Gone); err != nil {
+			return elementSnapshot{}, err
+		}
+	}
+	return a.captureElements(udid)
+}
+
+// awaitExpectation polls the UI after an action until e holds and returns
+// the elapsed time and the element diff against before.
+func (a *App) awaitExpectation(udid string, e actionExpectation, before elementSnapshot) (map[string]any, error) {
+	var gone *selectorNode
+	if strings.TrimSpace(e.Gone) != "" {
+		parsed, err := parseSelectorExpr(e.Gone)
+		if err != nil {
+			return nil, err
+		}
+		gone = parsed
+	}
+	// --expect-text means the text appeared: it must be in more elements
+	// than before the action, so text that was already there does not count.
+	needle := strings.ToLower(strings.TrimSpace(e.Text))
+	textBefore := countTextMatches(before.Elements, needle)
+	started := time.Now()
+	attempts := 0
+	var last elementSnapshot
+	var lastErr error
+	for {
+		attempts++
+		after, err := a.captureElements(udid)
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = nil
+			last = after
+			changed := after.Hash != before.Hash
+			textOK := needle == "" || countTextMatches(after.Elements, needle) > textBefore
+			goneOK := gone == nil || len(matchSelectorElements(after.Elements, gone)) == 0
+			if (!e.Change || changed) && textOK && goneOK {
+				return map[string]any{
+					"met":         true,
+					"expectation": e.details(),
+					"attempts":    attempts,
+					"elapsedMs":   time.Since(started).Milliseconds(),
+					"changed":     changed,
+					"diff":        diffElements(before.Elements, after.Elements),
+				}, nil
+			}
+		}
+		if time.Since(started) >= e.Timeout {
+			details := map[string]any{
+				"expectation": e.details(),
+				"attempts":    attempts,
+				"elapsedMs":   time.Since(started).Milliseconds(),
+				"changed":     last.Hash != "" && last.Hash != before.Hash,
+				"diff":        diffElements(before.Elements, last.Elements),
+			}
+			if needle != "" {
+				details["textMatchesBefore"] = textBefore
+				details["textMatchesAfter"] = countTextMatches(last.Elements, needle)
+			}
+			if lastErr != nil {
+				details["lastError"] = renderError(lastErr)
+			}
+			return nil, &AppError{Code: "EXPECTATION_FAILED", Message: "action expectation not met before timeout", Details: details}
+		}
+		time.Sleep(expectPollInterval)
+	}
+}
+
+// diffElements compares two element lists by role, id and label, reporting
+// added and removed elements and those whose value or state changed.
+func diffElements(before, after []Element) map[string]any {
+	key := func(e Element) string {
+		return strings.Join([]string{normalizeSelectorRole(e.Role), e.ID, e.Label}, "\x00")
+	}
+	summary := func(e Element) map[string]any {
+		out := map[string]any{"index": e.Index, "role": e.Role, "label": e.Label}
+		if e.Value != "" {
+			out["value"] = e.Value
+		}
+		return out
+	}
+	beforeByKey := map[string][]Element{}
+	for _, e := range before {
+		beforeByKey[key(e)] = append(beforeByKey[key(e)], e)
+	}
+	added := []map[string]any{}
+	changed := []map[string]any{}
+	for _, e := range after {
+		k := key(e)
+		prev := beforeByKey[k]
+		if len(prev) == 0 {
+			added = append(added, summary(e))
+			continue
+		}
+		old := prev[0]
+		beforeByKey[k] = prev[1:]
+		if old.Value != e.Value || old.Enabled != e.Enabled || old.Focused != e.Focused || old.Visible != e.Visible {
+			item := summary(e)
+			item["before"] = map[string]any{"value": old.Value, "enabled": old.Enabled, "focused": old.Focused, "visible": old.Visible}
+			item["after"] = map[string]any{"value": e.Value, "enabled": e.Enabled, "focused": e.Focused, "visible": e.Visible}
+			changed = append(changed, item)
+		}
+	}
+	removed := []map[string]any{}
+	for _, e := range before {
+		if rest := beforeByKey[key(e)]; len(rest) > 0 && rest[0].Index == e.Index {
+			removed = append(removed, summary(e))
+			beforeByKey[key(e)] = rest[1:]
+		}
+	}
+	truncate := func(items []map[string]any) []map[string]any {
+		if len(items) > maxReportedDiffEntries {
+			return items[:maxReportedDiffEntries]
+		}
+		return items
+	}
+	return map[string]any{
+		"addedCount":   len(added),
+		"removedCount": len(removed),
+		"changedCount": len(changed),
+		"added":        truncate(added),
+		"removed":      truncate(removed),
+		"changed":      truncate(changed),
+	}
+}
+
+// waitConditions are the ui wait conditions. By default all set conditions
+// must hold; Any accepts the first one that does.
+type waitConditions struct {
+	HasText        string
+	GoneText       string
+	InteractiveMin int
+	Select         string
+	// Element is a select expression; State lists comma-separated states the
+	// matching element must be in: exists, visible, enabled, focused or
+	// value=<text>, each optionally negated with "!".
+	Element string
+	State   string
+	// Count is "<select expr> <op> N" with op one of >= <= > < = !=.
+	Count  string
+	Stable time.Duration
+	Any    bool
+}
+
+func (c waitConditions) empty() bool {
+	return c.HasText == "" && c.GoneText == "" && c.InteractiveMin < 0 && c.Select == "" &&
+		c.Element == "" && c.Count == "" && c.Stable <= 0
+}
+
+type waitStateCheck struct {
+	Name   string
+	Value  string
+	Negate bool
+}
+
+type compiledWait struct {
+	cond    waitConditions
+	sel     *selectorNode
+	element *selectorNode
+	states  []waitStateCheck
+	count   *selectorNode
+	countOp string
+	countN  int
+}
+
+var waitCountPattern = regexp.MustCompile(`^(.*?\S)\s*(>=|<=|!=|==|=|>|<)\s*(\d+)\s*$`)
+
+func compileWaitConditions(cond waitConditions) (compiledWait, error) {
+	c := compiledWait{cond: cond}
+	var err error
+	if cond.Select != "" {
+		if c.sel, err = parseSelectorExpr(cond.Select); err != nil {
+			return c, err
+		}
+	}
+	if cond.Element != "" {
+		if c.element, err = parseSelectorExpr(cond.Element); err != nil {
+			return c, err
+		}
+		states, err := parseWaitStates(cond.State)
+		if err != nil {
+			return c, err
+		}
+		c.states = states
+	} else if strings.TrimSpace(cond.State) != "" {
+		return c, &AppError{Code: "USAGE", Message: "--state requires --element"}
+	}
+	if cond.Count != "" {
+		m := waitCountPattern.FindStringSubmatch(cond.Count)
+		if m == nil {
+			return c, &AppError{Code: "USAGE", Message: "--count must look like '<select expr> >= N'"}
+		}
+		if c.count, err = parseSelectorExpr(m[1]); err != nil {
+			return c, err
+		}
+		c.countOp = m[2]
+		c.countN, _ = strconv.Atoi(m[3])
+	}
+	if cond.Stable < 0 {
+		return c, &AppError{Code: "USAGE", Message: "--stable must be >= 0"}
+	}
+	return c, nil
+}
+
+func parseWaitStates(raw string) ([]waitStateCheck, error) {
+	states := []waitStateCheck{}
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		check := waitStateCheck{}
+		if strings.HasPrefix(part, "!") {
+			check.Negate = true
+			part = strings.TrimSpace(part[1:])
+		}
+		name, value, hasValue := strings.Cut(part, "=")
+		check.Name = strings.ToLower(strings.TrimSpace(name))
+		switch check.Name {
+		case "exists", "visible", "enabled", "focused":
+			if hasValue {
+				return nil, &AppError{Code: "USAGE", Message: "state " + check.Name + " does not take a value"}
+			}
+		case "value":
+			if !hasValue {
+				return nil, &AppError{Code: "USAGE", Message: "state value requires value=<text>"}
+			}
+			check.Value = strings.TrimSpace(value)
+		default:
+			return nil, &AppError{Code: "USAGE", Message: "unknown state: " + part + " (exists|visible|enabled|focused|value=...)"}
+		}
+		states = append(states, check)
+	}
+	if len(states) == 0 {
+		states = append(states, waitStateCheck{Name: "exists"})
+	}
+	return states, nil
+}
+
+func (s waitStateCheck) holds(elem Element) bool {
+	ok := true
+	switch s.Name {
+	case "visible":
+		ok = elem.Visible && !elem.Offscreen
+	case "enabled":
+		ok = elem.Enabled
+	case "focused":
+		ok = elem.Focused
+	case "value":
+		ok = strings.EqualFold(strings.TrimSpace(elem.Value), s.Value)
+	}
+	return ok != s.Negate
+}
+
+func compareCount(n int, op string, want int) bool {
+	switch op {
+	case ">=":
+		return n >= want
+	case "<=":
+		return n <= want
+	case ">":
+		return n > want
+	case "<":
+		return n < want
+	case "!=":
+		return n != want
+	default:
+		return n == want
+	}
+}
+
+type waitCheck struct {
+	Name   string
+	OK     bool
+	Detail map[string]any
+}
+
+// evaluate checks every set condition against one snapshot; stableFor is how
+// long the UI hash has been unchanged.
+func (c compiledWait) evaluate(snapshot elementSnapshot, stableFor time.Duration) []waitCheck {
+	checks := []waitCheck{}
+	cond := c.cond
+	if cond.HasText != "" {
+		matches := matchingTextSamples(snapshot.Elements, strings.ToLower(cond.HasText))
+		checks = append(checks, waitCheck{"hasText", len(matches) > 0, map[string]any{"hasText": cond.HasText, "matches": matches}})
+	}
+	if cond.GoneText != "" {
+		// Spinners and status labels are often reported disabled, so unlike
+		// hasText this looks at every element.
+		needle := strings.ToLower(cond.GoneText)
+		matches := []string{}
+		for _, elem := range snapshot.Elements {
+			if strings.Contains(strings.ToLower(elementText(elem)), needle) {
+				matches = append(matches, strings.TrimSpace(elem.Label+" "+elem.Value))
+			}
+		}
+		checks = append(checks, waitCheck{"goneText", len(matches) == 0, map[string]any{"goneText": cond.GoneText, "matches": matches}})
+	}
+	if cond.InteractiveMin >= 0 {
+		checks = append(checks, waitCheck{"interactiveMin", snapshot.InteractiveCount >= cond.InteractiveMin, map[string]any{"interactive": snapshot.InteractiveCount, "interactiveMin": cond.InteractiveMin}})
+	}
+	if c.sel != nil {
+		n := len(matchSelectorElements(snapshot.Elements, c.sel))
+		checks = append(checks, waitCheck{"select", n > 0, map[string]any{"select": cond.Select, "selectCount": n}})
+	}
+	if c.element != nil {
+		// "!exists" turns the check around: it holds when no match is in
+		// the remaining states, so "!exists,visible" waits for no visible match.
+		matches := matchSelectorElements(snapshot.Elements, c.element)
+		states := make([]waitStateCheck, 0, len(c.states))
+		absent := false
+		for _, s := range c.states {
+			if s.Name == "exists" && s.Negate {
+				absent = true
+				continue
+			}
+			states = append(states, s)
+		}
+		found := false
+		for _, elem := range matches {
+			all := true
+			for _, s := range states {
+				if !s.holds(elem) {
+					all = false
+					break
+				}
+			}
+			if all {
+				found = true
+				break
+			}
+		}
+		ok := found != absent
+		detail := map[string]any{"element": cond.Element, "state": cond.State, "matches": len(matches)}
+		if len(matches) > 0 {
+			detail["first"] = map[string]any{"index": matches[0].Index, "label": matches[0].Label, "value": matches[0].Value, "enabled": matches[0].Enabled, "visible": matches[0].Visible, "focused": matches[0].Focused}
+		}
+		checks = append(checks, waitCheck{"element", ok, detail})
+	}
+	if c.count != nil {
+		n := len(matchSelectorElements(snapshot.Elements, c.count))
+		checks = append(checks, waitCheck{"count", compareCount(n, c.countOp, c.countN), map[string]any{"count": cond.Count, "actual": n}})
+	}
+	if cond.Stable > 0 {
+		checks = append(checks, waitCheck{"stable", stableFor >= cond.Stable, map[string]any{"stableMs": stableFor.Milliseconds(), "requiredMs": cond.Stable.Milliseconds()}})
+	}
+	return checks
+}
+
+func waitChecksMet(checks []waitCheck, any bool) bool {
+	if len(checks) == 0 {
+		return true
+	}
+	for _, c := range checks {
+		if any && c.OK {
+			return true
+		}
+		if !any && !c.OK {
+			return false
+		}
+	}
+	return !any
+}
+
+func waitCheckDetails(checks []waitCheck) []map[string]any {
+	out := make([]map[string]any, 0, len(checks))
+	for _, c := range checks {
+		item := map[string]any{"condition": c.Name, "ok": c.OK}
+		for k, v := range c.Detail {
+			item[k] = v
+		}
+		out = append(out, item)
+	}
+	return out
+}
+
+func (a *App) waitForCondition(udid string, cond waitConditions, timeout, interval time.Duration) (map[string]any, error) {
+	compiled, err := compileWaitConditions(cond)
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	attempts := 0
+	lastHash := ""
+	stableSince := time.Now()
+	var lastChecks []waitCheck
+	lastInteractive := 0
+	var lastErr error
+
+	for {
+		attempts++
+		snapshot, snapErr := a.captureElements(udid)
+		if snapErr != nil {
+			lastErr = snapErr
+		} else {
+			lastErr = nil
+			if snapshot.Hash != lastHash {
+				lastHash = snapshot.Hash
+				stableSince = time.Now()
+			}
+			lastInteractive = snapshot.InteractiveCount
+			lastChecks = compiled.evaluate(snapshot, time.Since(stableSince))
+			if waitChecksMet(lastChecks, cond.Any) {
+				resp := map[string]any{
+					"ok":          true,
+					"action":      "wait",
+					"attempts":    attempts,
+					"elapsedMs":   time.Since(started).Milliseconds(),
+					"interactive": snapshot.InteractiveCount,
+					"conditions":  waitCheckDetails(lastChecks),
+				}
+				if cond.Any {
+					resp["any"] = true
+				}
+				for _, c := range lastChecks {
+					switch c.Name {
+					case "hasText":
+						resp["hasText"] = cond.HasText
+						resp["matches"] = c.Detail["matches"]
+					case "select":
+						resp["select"] = cond.Select
+						resp["selectCount"] = c.Detail["selectCount"]
+					}
+				}
+				return resp, nil
+			}
+		}
+
+		if time.Since(started) >= timeout {
+			details := map[string]any{
+				"attempts":       attempts,
+				"elapsedMs":      time.Since(started).Milliseconds(),
+				"interactive":    lastInteractive,
+				"interactiveMin": cond.InteractiveMin,
+				"conditions":     waitCheckDetails(lastChecks),
+			}
+			if cond.HasText != "" {
+				details["hasText"] = cond.HasText
+				details["lastMatches"] = []string{}
+			}
+			if cond.Select != "" {
+				details["select"] = cond.Select
+				details["lastSelectCount"] = 0
+			}
+			for _, c := range lastChecks {
+				switch c.Name {
+				case "hasText":
+					details["lastMatches"] = c.Detail["matches"]
+				case "select":
+					details["lastSelectCount"] = c.Detail["selectCount"]
+				}
+			}
+			if lastErr != nil {
+				details["lastError"] = renderError(lastErr)
+			}
+			return nil, &AppError{Code: "WAIT_TIMEOUT", Message: "wait condition not met before timeout", Details: details}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (a *App) cmdApp(args []string) (bool, error) {
+	if len(args) == 0 {
+		return a.opts.JSON, &AppError{Code: "USAGE", Message: "app subcommand required: openurl|launch|terminate|list"}
+	}
+	emitJSON := a.opts.JSON || hasJSONFlag(args[1:])
+	target, err := a.resolveTarget(a.opts.Target)
+	if err != nil {
+		return emitJSON, err
+	}
+
+	sub := args[0]
+	subArgs := args[1:]
+	if sub == "list" {
+		cmd, err := a.runSimctl("listapps", target.UDID)
+		if err != nil {
+			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "list apps failed")
+		}
+		if emitJSON {
+			a.printJSON(map[string]any{"ok": true, "apps": cmd.Stdout})
+		} else {
+			fmt.Print(cmd.Stdout)
+		}
+		return emitJSON, nil
+	}
+
+	subArgsNoTail, tailArgs := splitArgsTail(subArgs, "--args")
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bundleID := fs.String("bundle-id", "", "bundle id")
+	localJSON := fs.Bool("json", false, "")
+	if err := fs.Parse(subArgsNoTail); err != nil {
+		return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+	}
+	emitJSON = emitJSON || *localJSON
+
+	switch sub {
+	case "openurl":
+		vals := fs.Args()
+		if len(vals) != 1 {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent app openurl \"<url>\""}
+		}
+		if _, err := a.runSimctl("openurl", target.UDID, vals[0]); err != nil {
+			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "openurl failed")
+		}
+		resp := map[string]any{"ok": true, "action": "openurl", "url": vals[0]}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("openurl %s\n", vals[0])
+		}
+		return emitJSON, nil
+	case "launch":
+		if *bundleID == "" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent app launch --bundle-id <id> [--args ...]"}
+		}
+		args := []string{"launch", target.UDID, *bundleID}
+		args = append(args, tailArgs...)
+		if _, err := a.runSimctl(args...); err != nil {
+			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "launch failed")
+		}
+		resp := map[string]any{"ok": true, "action": "launch", "bundleId": *bundleID, "args": tailArgs}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("launch %s\n", *bundleID)
+		}
+		return emitJSON, nil
+	case "terminate":
+		if *bundleID == "" {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent app terminate --bundle-id <id>"}
+		}
+		if _, err := a.runSimctl("terminate", target.UDID, *bundleID); err != nil {
+			return emitJSON, wrapAppErrCode(err, "SIMCTL_FAILED", "terminate failed")
+		}
+		resp := map[string]any{"ok": true, "action": "terminate", "bundleId": *bundleID}
+		if emitJSON {
+			a.printJSON(resp)
+		} else {
+			fmt.Printf("terminate %s\n", *bundleID)
+		}
+		return emitJSON, nil
+	default:
+		return emitJSON, &AppError{Code: "USAGE", Message: "unknown app subcommand: " + sub}
+	}
+}
+
+func (a *App) cmdPasteboard(args []string) (bool, error) {
+	if len(args) == 0 {
+		return a.opts.JSON, &AppError{Code: "USAGE", Message: "pasteboard subcommand required: get|set|clear"}
+	}
+	emitJSON := a.opts.JSON || hasJSONFlag(args[1:])
+	target, err := a.resolveTarget(a.opts.Target)
+	if err != nil {
+		return emitJSON, err
+	}
+
+	sub := args[0]
+	fs := flag.NewFlagSet("pasteboard", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	text := fs.String("text", "", "text to copy")
+	localJSON := fs.Bool("json", false, "")
+	if err := fs.Parse(args[1:]); err != nil {
+		return emitJSON, &AppError{Code: "USAGE", Message: err.Error()}
+	}
+	emitJSON = emitJSON || *localJSON
+
+	switch sub {
+	case "get":
+		content, err := a.readPasteboard(target.UDID)
+		if err != nil {
+			return emitJSON, err
+		}
+		if emitJSON {
+			a.printJSON(map[string]any{"ok": true, "action": "pasteboard-get", "text": content})
+		} else {
+			fmt.Println(content)
+		}
+		return emitJSON, nil
+	case "set":
+		value := *text
+		if value == "" && fs.NArg() == 1 {
+			value = fs.Arg(0)
+		}
+		if value == "" || fs.NArg() > 1 || (*text != "" && fs.NArg() > 0) {
+			return emitJSON, &AppError{Code: "USAGE", Message: "usage: simagent pasteboard set --text \"<text>\""}
+		}
+		if err := a.writePasteboard(target.UDID, value); err != nil {
+			return emitJSON, err
+		}
+		if emitJSON {
+			a.printJSON(map[string]any{"ok": true, "action": "pasteboard-set", "text": value})
+		} else {
+			fmt.Println("pasteboard set")
+		}
+		return emitJSON, nil
+	case "clear":
+		if err := a.writePasteboard(target.UDID, ""); err != nil {
+			return emitJSON, err
+		}
+		if emitJSON {
+			a.printJSON(map[string]any{"ok": true, "action": "pasteboard-clear"})
+		} else {
+			fmt.Println("pasteboard cleared")
+		}
+		return emitJSON, nil
+	default:
+		return emitJSON, &AppError{Code: "USAGE", Message: "unknown pasteboard subcommand: " + sub}
+	}
+}
+
+func (a *App) readPasteboard(udid string) (string, error) {
+	res, err := a.runSimctl("pbpaste", udid)
+	if err != nil {
+		return "", wrapAppErrCode(err, "PASTEBOARD_FAILED", "failed to read simulator pasteboard")
+	}
+	return res.Stdout, nil
+}
+
+// writePasteboard replaces the simulator pasteboard; an empty text clears it.
+func (a *App) writePasteboard(udid, text string) error {
+	if _, err := a.runSimctlInput(text, "pbcopy", udid); err != nil {
+		return wrapAppErrCode(err, "PASTEBOARD_FAILED", "failed to write simulator pasteboard")
+	}
+	return nil
+}
+
+// pasteboardMatches checks pasteboard content against want using mode
+// exact (default), contains or regex.
+func pasteboardMatches(content, want, mode string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", "exact":
+		return content == want, nil
+	case "contains":
+		return strings.Contains(content, want), nil
+	case "regex":
+		re, err := regexp.Compile(want)
+		if err != nil {
+			return false, &AppError{Code: "USAGE", Message: "invalid pasteboard regex: " + err.Error()}
+		}
+		return re.MatchString(content), nil
+	default:
+		return false, &AppError{Code: "USAGE", Message: "match must be exact|contains|regex"}
+	}
+}
+
+func (a *App) cmdRaw(args []string) (bool, error) {
+	if len(args) == 0 {
+		return a.opts.JSON, &AppError{Code: "USAGE", Message: "usage: simagent raw simctl <...>|idb <...>"}
+	}
+	emitJSON := a.opts.JSON || hasJSONFlag(args)
+
+	sub := args[0]
+	pass := stripFirstJSON(args[1:])
+	var res CommandResult
+	var err error
+
+	switch sub {
+	case "simctl":
+		res, err = a.runSimctl(pass...)
+	case "idb":
+		// Raw idb calls carry their own --udid, so they bypass runIDB; any of
+		// them may change the UI.
+		if a.batch != nil {
+			a.batch.invalidate()
+		}
+		res, err = a.runCommand("idb", pass...)
+	default:
+		return emitJSON, &AppError{Code: "USAGE", Message: "raw command must be simctl|idb"}
+	}
+	if err != nil {
+		return emitJSON, wrapAppErrCode(err, "RAW_FAILED", "raw command failed")
+	}
+
+	if emitJSON {
+		a.printJSON(map[string]any{"ok": true, "stdout": res.Stdout, "stderr": res.Stderr, "exitCode": res.ExitCode})
+	} else {
+		fmt.Print(res.Stdout)
+		if strings.TrimSpace(res.Stderr) != "" {
+			fmt.Fprint(os.Stderr, res.Stderr)
+		}
+	}
+	return emitJSON, nil
+}
+
+func (a *App) listTargets() ([]SimTarget, error) {
+	cmd, err := a.runSimctl("list", "devices", "--json")
+	if err != nil {
+		return nil, wrapAppErrCode(err, "SIMCTL_FAILED", "failed to list simulators")
+	}
+
+	var payload struct {
+		Devices map[string][]struct {
+			Name       string `json:"name"`
+			UDID       string `json:"udid"`
+			State      string `json:"state"`
+			IsAvail    bool   `json:"isAvailable"`
+			Avail      bool   `json:"available"`
+			DeviceType string `json:"deviceTypeIdentifier"`
+		} `json:"devices"`
+	}
+	if err := json.Unmarshal([]byte(cmd.Stdout), &payload); err != nil {
+		return nil, wrapErr("SIMCTL_FAILED", "invalid simctl devices json", err)
+	}
+
+	list := make([]SimTarget, 0)
+	for runtime, devices := range payload.Devices {
+		for _, d := range devices {
+			available := d.IsAvail || d.Avail
+			list = append(list, SimTarget{
+				Name:       d.Name,
+				UDID:       d.UDID,
+				Runtime:    runtime,
+				State:      d.State,
+				Available:  available,
+				DeviceType: d.DeviceType,
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].State != list[j].State {
+			return list[i].State > list[j].State
+		}
+		if list[i].Runtime != list[j].Runtime {
+			return list[i].Runtime < list[j].Runtime
+		}
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].UDID < list[j].UDID
+	})
+	return list, nil
+}
+
+func (a *App) resolveTarget(spec string) (SimTarget, error) {
+	if a.batch != nil {
+		return a.batch.target, nil
+	}
+	s := strings.TrimSpace(spec)
+	if s == "" {
+		cfg, err := loadConfig()
+		if err == nil && cfg.DefaultTarget != nil && cfg.DefaultTarget.UDID != "" {
+			s = cfg.DefaultTarget.UDID
+		}
+	}
+	if s == "" {
+		s = "booted"
+	}
+
+	targets, err := a.listTargets()
+	if err != nil {
+		return SimTarget{}, err
+	}
+
+	if s == "booted" {
+		for _, t := range targets {
+			if strings.EqualFold(t.State, "booted") {
+				return t, nil
+			}
+		}
+		return SimTarget{}, &AppError{Code: "NO_BOOTED_DEVICE", Message: "no booted simulator found"}
+	}
+
+	for _, t := range targets {
+		if strings.EqualFold(t.UDID, s) {
+			return t, nil
+		}
+	}
+	return SimTarget{}, &AppError{Code: "TARGET_NOT_FOUND", Message: "target not found: " + s}
+}
+
+func (a *App) runSimctl(args ...string) (CommandResult, error) {
+	return a.runSimctlInput("", args...)
+}
+
+// runSimctlInput is runSimctl with stdin, used by simctl pbcopy.
+func (a *App) runSimctlInput(stdin string, args ...string) (CommandResult, error) {
+	if a.batch != nil && (len(args) == 0 || !readOnlySimctl[args[0]]) {
+		a.batch.invalidate()
+	}
+	return a.runCommandInput(stdin, "xcrun", append([]string{"simctl"}, args...)...)
+}
+
+func (a *App) runIDB(udid string, args ...string) (CommandResult, error) {
+	if a.batch != nil && !(len(args) >= 2 && args[0] == "ui" && strings.HasPrefix(args[1], "describe-")) {
+		a.batch.invalidate()
+	}
+	full := append([]string{}, args...)
+	full = append(full, "--udid", udid)
+	return a.runCommand("idb", full...)
+}
+
+func (a *App) runCommand(name string, args ...string) (CommandResult, error) {
+	return a.runCommandInput("", name, args...)
+}
+
+// runCommandInput is runCommand with stdin.
+func (a *App) runCommandInput(stdin, name string, args ...string) (CommandResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.opts.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	res := CommandResult{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: 0}
+	if err == nil {
+		return res, nil
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return res, &AppError{Code: "TIMEOUT", Message: fmt.Sprintf("command timed out: %s %s", name, strings.Join(args, " ")), Details: map[string]any{"stderr": res.Stderr}}
+	}
+
+	if ee := (*exec.ExitError)(nil); errors.As(err, &ee) {
+		res.ExitCode = ee.ExitCode()
+		return res, &AppError{Code: "COMMAND_FAILED", Message: fmt.Sprintf("command failed: %s", name), Details: map[string]any{"stderr": res.Stderr, "stdout": res.Stdout, "exitCode": res.ExitCode}}
+	}
+
+	if errors.Is(err, exec.ErrNotFound) {
+		return res, &AppError{Code: "COMMAND_NOT_FOUND", Message: fmt.Sprintf("command not found: %s", name)}
+	}
+
+	return res, wrapErr("COMMAND_FAILED", fmt.Sprintf("failed to run: %s", name), err)
+}
+
+type normalizedUI struct {
+	Elements         []Element
+	AllCount         int
+	InteractiveCount int
+	Keyboard         KeyboardState
+	Alert            *AlertState
+}
+
+func normalizeElements(rawUI any, opts frameOptions) normalizedUI {
+	nodes := make([]candidateNode, 0, 64)
+	order := 0
+	walkCandidates(rawUI, "", &order, &nodes)
+	allCandidates := make([]Element, 0, len(nodes))
+	allCount := 0
+	interactiveCount := 0
+	screen := inferScreenRect(rawUI, nil)
+	keyboard := detectKeyboard(nodes, screen)
+	alert := detectAlert(nodes, screen)
+
+	for _, node := range nodes {
+		elem, ok := elementFromCandidate(node)
+		if !ok {
+			continue
+		}
+		if elem.Frame.W*elem.Frame.H < opts.MinArea {
+			continue
+		}
+		if keyboard.Frame != nil && !opts.IncludeKeyboard && rectContainsPoint(*keyboard.Frame, elem.Center) {
+			continue
+		}
+		roleKey := strings.ToLower(strings.TrimSpace(elem.Role))
+		if len(opts.IncludeRoles) > 0 && !opts.IncludeRoles[roleKey] {
+			continue
+		}
+		if opts.ExcludeRoles[roleKey] {
+			continue
+		}
+		if !elem.Enabled {
+			continue
+		}
+		allCount++
+		isInteractive := isInteractiveRole(elem.Role)
+		if isInteractive {
+			interactiveCount++
+		}
+		if opts.InteractiveOnly && !isInteractive {
+			continue
+		}
+		elem.order = node.Order
+		allCandidates = append(allCandidates, elem)
+	}
+
+	screenRect := inferScreenRect(rawUI, allCandidates)
+	for i := range allCandidates {
+		allCandidates[i].Visible, allCandidates[i].Offscreen = classifyVisibility(allCandidates[i].Frame, screenRect)
+	}
+
+	switch opts.Order {
+	case "reading":
+		sort.Slice(allCandidates, func(i, j int) bool {
+			if allCandidates[i].Center.Y != allCandidates[j].Center.Y {
+				return allCandidates[i].Center.Y < allCandidates[j].Center.Y
+			}
+			if allCandidates[i].Center.X != allCandidates[j].Center.X {
+				return allCandidates[i].Center.X < allCandidates[j].Center.X
+			}
+			return allCandidates[i].ID < allCandidates[j].ID
+		})
+	case "stable":
+		sort.Slice(allCandidates, func(i, j int) bool {
+			return allCandidates[i].ID < allCandidates[j].ID
+		})
+	case "z":
+		sort.Slice(allCandidates, func(i, j int) bool {
+			return allCandidates[i].order < allCandidates[j].order
+		})
+	}
+
+	for i := range allCandidates {
+		allCandidates[i].Index = i + 1
+	}
+	allCandidates = addNearbyLabels(allCandidates)
+
+	return normalizedUI{
+		Elements:         allCandidates,
+		AllCount:         allCount,
+		InteractiveCount: interactiveCount,
+		Keyboard:         keyboard,
+		Alert:            alert,
+	}
+}
+
+// detectKeyboard finds the software keyboard either from an explicit keyboard
+// container or, when the tree has none, from a cluster of elements with a key
+// role in the lower part of the screen. Plain buttons never count, so an
+// in-app PIN pad or calculator stays in the element list.
+func detectKeyboard(nodes []candidateNode, screen FrameRect) KeyboardState {
+	elements := make([]Element, 0, len(nodes))
+	for _, node := range nodes {
+		elem, ok := elementFromCandidate(node)
+		if !ok {
+			continue
+		}
+		elements = append(elements, elem)
+	}
+	if screen.W <= 0 || screen.H <= 0 {
+		screen = inferScreenRect(nil, elements)
+	}
+	if screen.W <= 0 || screen.H <= 0 {
+		return KeyboardState{}
+	}
+
+	for _, node := range nodes {
+		role := strings.ToLower(firstString(node.Map, []string{"type", "role", "role_description", "subrole", "AXRole"}))
+		if !strings.Contains(role, "keyboard") {
+			continue
+		}
+		rect, ok := findRect(node.Map)
+		if !ok || rect.W < screen.W*0.5 || rect.H < 120 || rect.Y < screen.Y+screen.H*0.35 {
+			continue
+		}
+		return KeyboardState{Visible: true, Frame: &rect}
+	}
+
+	var keys FrameRect
+	keyCount := 0
+	for _, elem := range elements {
+		if !isKeyboardKeyElement(elem, screen) {
+			continue
+		}
+		if keyCount == 0 {
+			keys = elem.Frame
+		} else {
+			keys = unionRect(keys, elem.Frame)
+		}
+		keyCount++
+	}
+	if keyCount < 10 {
+		return KeyboardState{}
+	}
+	frame := FrameRect{X: screen.X, Y: keys.Y, W: screen.W, H: screen.Y + screen.H - keys.Y, Unit: "pt"}
+	return KeyboardState{Visible: true, Frame: &frame}
+}
+
+func isKeyboardKeyElement(elem Element, screen FrameRect) bool {
+	if elem.Center.Y < screen.Y+screen.H*0.55 || elem.Frame.W > screen.W*0.6 || elem.Frame.H > 80 {
+		return false
+	}
+	role := strings.ToLower(strings.TrimSpace(elem.Role))
+	return role == "key" || strings.HasSuffix(role, "key") || strings.Contains(role, "keyboard")
+}
+
+// detectAlert finds an alert, sheet or dialog container and collects its title,
+// message and buttons. Permission prompts that surface without a container are
+// recognized from their well-known button labels when SpringBoard or another
+// system process owns the buttons.
+func detectAlert(nodes []candidateNode, screen FrameRect) *AlertState {
+	elements := make([]Element, 0, len(nodes))
+	for _, node := range nodes {
+		if elem, ok := elementFromCandidate(node); ok {
+			elements = append(elements, elem)
+		}
+	}
+	sort.SliceStable(elements, func(i, j int) bool {
+		if elements[i].Center.Y != elements[j].Center.Y {
+			return elements[i].Center.Y < elements[j].Center.Y
+		}
+		return elements[i].Center.X < elements[j].Center.X
+	})
+
+	for _, node := range nodes {
+		role := strings.ToLower(firstString(node.Map, []string{"type", "role", "role_description", "subrole", "AXRole"}))
+		kind := ""
+		switch {
+		case strings.Contains(role, "alert"), strings.Contains(role, "dialog"):
+			kind = "alert"
+		case strings.Contains(role, "sheet"):
+			kind = "sheet"
+		default:
+			continue
+		}
+		rect, ok := findRect(node.Map)
+		if !ok || rect.W <= 0 || rect.H <= 0 {
+			continue
+		}
+		alert := collectAlertContents(elements, rect, kind)
+		if len(alert.Buttons) == 0 {
+			continue
+		}
+		if alert.Title == "" {
+			alert.Title = firstString(node.Map, []string{"label", "AXLabel", "title"})
+		}
+		return alert
+	}
+
+	// Without a container only system-owned buttons count, so an in-app
+	// permission primer with "Allow"/"Not now" is left to the app.
+	buttons := make([]Element, 0, 4)
+	permission := false
+	appPID, hasAppPID := foregroundAppPID(nodes)
+	for _, node := range nodes {
+		elem, ok := elementFromCandidate(node)
+		if !ok || !elem.Enabled || !strings.Contains(strings.ToLower(elem.Role), "button") {
+			continue
+		}
+		if !systemOwnedNode(node, nodes, appPID, hasAppPID) {
+			continue
+		}
+		label := normalizeAlertLabel(elem.Label)
+		accept := labelInList(label, alertAcceptLabels)
+		dismiss := labelInList(label, alertDismissLabels)
+		if !accept && !dismiss {
+			continue
+		}
+		if strings.Contains(label, "allow") || strings.Contains(label, "許可") || strings.Contains(label, "track") || strings.Contains(label, "トラッキング") {
+			permission = true
+		}
+		buttons = append(buttons, elem)
+	}
+	if len(buttons) < 2 || !permission {
+		return nil
+	}
+	sort.SliceStable(buttons, func(i, j int) bool {
+		if buttons[i].Center.Y != buttons[j].Center.Y {
+			return buttons[i].Center.Y < buttons[j].Center.Y
+		}
+		return buttons[i].Center.X < buttons[j].Center.X
+	})
+	area := buttons[0].Frame
+	for _, b := range buttons[1:] {
+		area = unionRect(area, b.Frame)
+	}
+	if screen.W > 0 && math.Abs((area.X+area.W/2)-(screen.X+screen.W/2)) > screen.W*0.2 {
+		return nil
+	}
+	area.H += math.Min(area.Y, 200)
+	area.Y -= math.Min(area.Y, 200)
+	return collectAlertContents(elements, area, "alert")
+}
+
+// systemBundleIDs are the processes that present permission prompts over an app.
+var systemBundleIDs = []string{"com.apple.springboard", "com.apple.preferences"}
+
+// foregroundAppPID returns the pid of the first application node, which idb
+// lists for the frontmost app.
+func foregroundAppPID(nodes []candidateNode) (int, bool) {
+	for _, node := range nodes {
+		role := strings.ToLower(firstString(node.Map, []string{"type", "role", "AXRole"}))
+		if strings.Contains(role, "application") {
+			if pid, ok := nodePID(node.Map); ok {
+				return pid, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func nodePID(m map[string]any) (int, bool) {
+	for _, key := range []string{"pid", "AXPid", "processIdentifier"} {
+		if v, ok := m[key].(float64); ok {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+// systemOwnedNode reports whether node belongs to SpringBoard or another
+// system process rather than the app: by bundle id, by an enclosing
+// SpringBoard application node, or by a pid other than the app's.
+func systemOwnedNode(node candidateNode, nodes []candidateNode, appPID int, hasAppPID bool) bool {
+	bundle := strings.ToLower(firstString(node.Map, []string{"bundleId", "bundle_id", "bundleIdentifier", "AXBundleIdentifier"}))
+	for _, id := range systemBundleIDs {
+		if bundle == id {
+			return true
+		}
+	}
+	if pid, ok := nodePID(node.Map); ok && hasAppPID && pid != appPID {
+		return true
+	}
+	for _, other := range nodes {
+		if other.Path == "" || !strings.HasPrefix(node.Path, other.Path+"/") {
+			continue
+		}
+		role := strings.ToLower(firstString(other.Map, []string{"type", "role", "AXRole"}))
+		label := strings.ToLower(firstString(other.Map, []string{"label", "AXLabel", "title"}))
+		if strings.Contains(role, "application") && label == "springboard" {
+			return true
+		}
+	}
+	return false
+}
+
+func collectAlertContents(elements []Element, rect FrameRect, kind string) *AlertState {
+	alert := &AlertState{Kind: kind, Frame: rect, Buttons: []AlertButton{}}
+	texts := make([]string, 0, 2)
+	for _, elem := range elements {
+		if !rectContainsPoint(rect, elem.Center) || elem.Frame.W*elem.Frame.H >= rect.W*rect.H {
+			continue
+		}
+		label := strings.TrimSpace(elem.Label)
+		if label == "" {
+			continue
+		}
+		if strings.Contains(strings.ToLower(elem.Role), "button") {
+			alert.Buttons = append(alert.Buttons, AlertButton{Label: label, Frame: elem.Frame, Center: elem.Center})
+			continue
+		}
+		if isInteractiveRole(elem.Role) {
+			continue
+		}
+		if len(texts) == 0 || texts[len(texts)-1] != label {
+			texts = append(texts, label)
+		}
+	}
+	if len(texts) > 0 {
+		alert.Title = texts[0]
+	}
+	if len(texts) > 1 {
+		alert.Message = strings.Join(texts[1:], "\n")
+	}
+	return alert
+}
+
+func normalizeAlertLabel(label string) string {
+	label = strings.ReplaceAll(label, "\u2019", "'")
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+func labelInList(label string, list []string) bool {
+	for _, candidate := range list {
+		if label == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// pickAlertButton chooses the button for accept/dismiss, or the one matching
+// label for tap. Without a well-known label, accept takes the last (preferred)
+// button and dismiss the first.
+func pickAlertButton(alert *AlertState, action, label string) (AlertButton, error) {
+	if alert == nil || len(alert.Buttons) == 0 {
+		return AlertButton{}, &AppError{Code: "ALERT_NOT_FOUND", Message: "no alert is currently shown"}
+	}
+	labels := make([]string, 0, len(alert.Buttons))
+	for _, b := range alert.Buttons {
+		labels = append(labels, b.Label)
+	}
+	switch action {
+	case "tap":
+		want := normalizeAlertLabel(label)
+		for _, b := range alert.Buttons {
+			if normalizeAlertLabel(b.Label) == want {
+				return b, nil
+			}
+		}
+		for _, b := range alert.Buttons {
+			if strings.Contains(normalizeAlertLabel(b.Label), want) {
+				return b, nil
+			}
+		}
+		return AlertButton{}, &AppError{Code: "ALERT_BUTTON_NOT_FOUND", Message: "alert button not found: " + label, Details: map[string]any{"buttons": labels}}
+	case "accept":
+		for _, b := range alert.Buttons {
+			if labelInList(normalizeAlertLabel(b.Label), alertAcceptLabels) {
+				return b, nil
+			}
+		}
+		for i := len(alert.Buttons) - 1; i >= 0; i-- {
+			if !labelInList(normalizeAlertLabel(alert.Buttons[i].Label), alertDismissLabels) {
+				return alert.Buttons[i], nil
+			}
+		}
+		return alert.Buttons[len(alert.Buttons)-1], nil
+	case "dismiss":
+		for _, b := range alert.Buttons {
+			if labelInList(normalizeAlertLabel(b.Label), alertDismissLabels) {
+				return b, nil
+			}
+		}
+		return alert.Buttons[0], nil
+	default:
+		return AlertButton{}, &AppError{Code: "USAGE", Message: "alert action must be accept|dismiss|tap"}
+	}
+}
+
+func (a *App) handleAlert(udid string, alert *AlertState, action, label string) (map[string]any, error) {
+	button, err := pickAlertButton(alert, action, label)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.runIDB(udid, "ui", "tap", idbCoordArg(button.Center.X), idbCoordArg(button.Center.Y)); err != nil {
+		return nil, wrapAppErrCode(err, "IDB_UI_FAILED", "alert button tap failed")
+	}
+	resp := map[string]any{
+		"ok":       true,
+		"action":   "alert-" + action,
+		"title":    alert.Title,
+		"button":   button.Label,
+		"targetPt": map[string]any{"x": button.Center.X, "y": button.Center.Y},
+	}
+	time.Sleep(300 * time.Millisecond)
+	if after, err := a.captureElements(udid); err == nil {
+		resp["closed"] = after.Alert == nil || after.Alert.Title != alert.Title
+	}
+	return resp, nil
+}
+
+func rectContainsPoint(rect FrameRect, p FramePoint) bool {
+	return p.X >= rect.X && p.X <= rect.X+rect.W && p.Y >= rect.Y && p.Y <= rect.Y+rect.H
+}
+
+func rectInsideRect(inner, outer FrameRect, tol float64) bool {
+	return inner.X >= outer.X-tol && inner.Y >= outer.Y-tol &&
+		inner.X+inner.W <= outer.X+outer.W+tol && inner.Y+inner.H <= outer.Y+outer.H+tol
+}
+
+func unionRect(a, b FrameRect) FrameRect {
+	minX := math.Min(a.X, b.X)
+	minY := math.Min(a.Y, b.Y)
+	maxX := math.Max(a.X+a.W, b.X+b.W)
+	maxY := math.Max(a.Y+a.H, b.Y+b.H)
+	return FrameRect{X: minX, Y: minY, W: maxX - minX, H: maxY - minY, Unit: "pt"}
+}
+
+type candidateNode struct {
+	Path  string
+	Order int
+	Map   map[string]any
+}
+
+func walkCandidates(v any, path string, order *int, out *[]candidateNode) {
+	switch typed := v.(type) {
+	case map[string]any:
+		*order++
+		*out = append(*out, candidateNode{Path: path, Order: *order, Map: typed})
+		for k, child := range typed {
+			next := path + "/" + k
+			walkCandidates(child, next, order, out)
+		}
+	case []any:
+		for i, child := range typed {
+			next := fmt.Sprintf("%s/%d", path, i)
+			walkCandidates(child, next, order, out)
+		}
+	}
+}
+
+func elementFromCandidate(node candidateNode) (Element, bool) {
+	rect, ok := findRect(node.Map)
+	if !ok || rect.W <= 0 || rect.H <= 0 {
+		return Element{}, false
+	}
+
+	id := firstString(node.Map, []string{"id", "identifier", "uid", "axPath", "path", "accessibilityIdentifier"})
+	if id == "" {
+		id = "axpath:" + node.Path
+	}
+	role := firstString(node.Map, []string{
+		"role", "type", "elementType", "axRole", "roleDescription", "AXRole", "wdType",
+	})
+	label := firstString(node.Map, []string{
+		"label", "name", "title", "placeholder", "accessibilityLabel", "axLabel", "AXLabel", "wdLabel",
+	})
+	value := firstString(node.Map, []string{
+		"value", "text", "axValue", "AXValue", "displayValue", "wdValue", "selectedText",
+	})
+	if label == "" && value != "" {
+		label = value
+	}
+	placeholder := firstString(node.Map, []string{"placeholder", "placeholderValue", "AXPlaceholderValue"})
+	enabled := firstBoolWithDefault(node.Map, []string{"enabled", "isEnabled"}, true)
+	focused := firstBoolWithDefault(node.Map, []string{"focused", "isFocused", "hasFocus", "AXFocused"}, false)
+
+	return Element{
+		ID:          id,
+		Role:        role,
+		Label:       label,
+		Value:       value,
+		Placeholder: placeholder,
+		Enabled:     enabled,
+		Focused:     focused,
+		Visible:     true,
+		Frame:       rect,
+		Center:      FramePoint{X: rect.X + rect.W/2, Y: rect.Y + rect.H/2, Unit: "pt"},
+		Source:      ElementSource{Tool: "idb", Method: "describe-all"},
+	}, true
+}
+
+func inferScreenRect(rawUI any, elements []Element) FrameRect {
+	if app, ok := findApplicationNode(rawUI); ok {
+		if rect, ok := findRect(app); ok {
+			return rect
+		}
+	}
+	if root, ok := rawUI.(map[string]any); ok {
+		if rect, ok := findRect(root); ok && rect.W > 0 && rect.H > 0 {
+			return rect
+		}
+	}
+	minX := math.MaxFloat64
+	minY := math.MaxFloat64
+	maxX := 0.0
+	maxY := 0.0
+	for _, e := range elements {
+		if e.Frame.W <= 0 || e.Frame.H <= 0 {
+			continue
+		}
+		if e.Frame.X < minX {
+			minX = e.Frame.X
+		}
+		if e.Frame.Y < minY {
+			minY = e.Frame.Y
+		}
+		if e.Frame.X+e.Frame.W > maxX {
+			maxX = e.Frame.X + e.Frame.W
+		}
+		if e.Frame.Y+e.Frame.H > maxY {
+			maxY = e.Frame.Y + e.Frame.H
+		}
+	}
+	if minX == math.MaxFloat64 || minY == math.MaxFloat64 || maxX <= minX || maxY <= minY {
+		return FrameRect{}
+	}
+	return FrameRect{X: minX, Y: minY, W: maxX - minX, H: maxY - minY, Unit: "pt"}
+}
+
+func classifyVisibility(rect FrameRect, screen FrameRect) (bool, bool) {
+	if rect.W <= 0 || rect.H <= 0 {
+		return false, true
+	}
+	if screen.W <= 0 || screen.H <= 0 {
+		return true, false
+	}
+	screenRight := screen.X + screen.W
+	screenBottom := screen.Y + screen.H
+	rectRight := rect.X + rect.W
+	rectBottom := rect.Y + rect.H
+
+	interLeft := math.Max(rect.X, screen.X)
+	interTop := math.Max(rect.Y, screen.Y)
+	interRight := math.Min(rectRight, screenRight)
+	interBottom := math.Min(rectBottom, screenBottom)
+	if interRight <= interLeft || interBottom <= interTop {
+		return false, true
+	}
+	offscreen := rect.X < screen.X || rect.Y < screen.Y || rectRight > screenRight || rectBottom > screenBottom
+	return true, offscreen
+}
+
+func addNearbyLabels(elements []Element) []Element {
+	for i := range elements {
+		if strings.TrimSpace(elements[i].Label) != "" {
+			continue
+		}
+		bestIdx := -1
+		bestScore := math.MaxFloat64
+		for j := range elements {
+			if i == j {
+				continue
+			}
+			label := strings.TrimSpace(elements[j].Label)
+			if label == "" || !elements[j].Visible {
+				continue
+			}
+			dx := elements[i].Center.X - elements[j].Center.X
+			dy := elements[i].Center.Y - elements[j].Center.Y
+			distance := math.Hypot(dx, dy)
+			if distance > 220 {
+				continue
+			}
+			if distance < bestScore {
+				bestScore = distance
+				bestIdx = j
+			}
+		}
+		if bestIdx >= 0 {
+			elements[i].NearbyLabel = elements[bestIdx].Label
+		}
+	}
+	return elements
+}
+
+func findRect(m map[string]any) (FrameRect, bool) {
+	if rect, ok := rectFromAny(m["frame"]); ok {
+		return rect, true
+	}
+	if rect, ok := rectFromAny(m["bounds"]); ok {
+		return rect, true
+	}
+	if rect, ok := rectFromAny(m["rect"]); ok {
+		return rect, true
+	}
+	if rect, ok := rectFromAny(m); ok {
+		return rect, true
+	}
+	return FrameRect{}, false
+}
+
+func rectFromAny(v any) (FrameRect, bool) {
+	mapVal, ok := v.(map[string]any)
+	if !ok {
+		return FrameRect{}, false
+	}
+	x, okX := getFloatAny(mapVal, []string{"x", "left", "originX"})
+	y, okY := getFloatAny(mapVal, []string{"y", "top", "originY"})
+	w, okW := getFloatAny(mapVal, []string{"w", "width"})
+	h, okH := getFloatAny(mapVal, []string{"h", "height"})
+	if okX && okY && okW && okH {
+		return FrameRect{X: x, Y: y, W: w, H: h, Unit: "pt"}, true
+	}
+	return FrameRect{}, false
+}
+
+func deriveTransform(rawUI any, elements []Element, screenshotSize image.Point, deviceType string) Transform {
+	var t Transform
+	t.Screen.Unit = "pt"
+	t.Screenshot.Unit = "px"
+	t.SafeArea.Unit = "pt"
+	t.Scale = 1
+	if screenshotSize.X > 0 {
+		t.Screenshot.W = screenshotSize.X
+	}
+	if screenshotSize.Y > 0 {
+		t.Screenshot.H = screenshotSize.Y
+	}
+
+	screenW, screenH := screenSizeFromUI(rawUI)
+	if screenW == 0 || screenH == 0 {
+		if profile, ok := lookupDeviceProfile(deviceType, 0, 0); ok {
+			screenW, screenH = profile.W, profile.H
+			if t.Screenshot.W > t.Screenshot.H {
+				screenW, screenH = screenH, screenW
+			}
+		}
+	}
+	if screenW == 0 || screenH == 0 {
+		screenW, screenH = elementExtents(elements)
+	}
+	if screenW == 0 && t.Screenshot.W > 0 {
+		screenW = float64(t.Screenshot.W)
+	}
+	if screenH == 0 && t.Screenshot.H > 0 {
+		screenH = float64(t.Screenshot.H)
+	}
+
+	t.Screen.W = screenW
+	t.Screen.H = screenH
+	t.Orientation = orientationForSize(screenW, screenH)
+
+	if t.Screen.W > 0 && t.Screenshot.W > 0 {
+		t.Scale = float64(t.Screenshot.W) / t.Screen.W
+	} else if t.Screen.H > 0 && t.Screenshot.H > 0 {
+		t.Scale = float64(t.Screenshot.H) / t.Screen.H
+	}
+
+	insets := safeAreaInsets(deviceType, t.Screen.W, t.Screen.H)
+	t.SafeArea.Top = insets.Top
+	t.SafeArea.Bottom = insets.Bottom
+	t.SafeArea.Left = insets.Left
+	t.SafeArea.Right = insets.Right
+
+	return t
+}
+
+// screenSizeFromUI reads the screen bounds from the root application frame,
+// falling back to the root node rect for single-object trees.
+func screenSizeFromUI(rawUI any) (float64, float64) {
+	if app, ok := findApplicationNode(rawUI); ok {
+		if rect, ok := findRect(app); ok {
+			return rect.X + rect.W, rect.Y + rect.H
+		}
+	}
+	if root, ok := rawUI.(map[string]any); ok {
+		if rect, ok := findRect(root); ok && rect.W > 0 && rect.H > 0 {
+			return rect.X + rect.W, rect.Y + rect.H
+		}
+	}
+	return 0, 0
+}
+
+func elementExtents(elements []Element) (float64, float64) {
+	maxW := 0.0
+	maxH := 0.0
+	for _, e := range elements {
+		if e.Frame.X+e.Frame.W > maxW {
+			maxW = e.Frame.X + e.Frame.W
+		}
+		if e.Frame.Y+e.Frame.H > maxH {
+			maxH = e.Frame.Y + e.Frame.H
+		}
+	}
+	return maxW, maxH
+}
+
+type deviceProfile struct {
+	W               float64
+	H               float64
+	Top             float64
+	Bottom          float64
+	LandscapeSide   float64
+	LandscapeBottom float64
+	IPad            bool
+}
+
+type edgeInsets struct {
+	Top    float64
+	Bottom float64
+	Left   float64
+	Right  float64
+}
+
+// deviceProfiles lists portrait screen sizes in pt with the status bar/notch
+// and home indicator insets UIKit reports for them.
+var deviceProfiles = []deviceProfile{
+	{W: 320, H: 568, Top: 20},
+	{W: 375, H: 667, Top: 20},
+	{W: 414, H: 736, Top: 20},
+	{W: 375, H: 812, Top: 44, Bottom: 34, LandscapeSide: 44, LandscapeBottom: 21},
+	{W: 414, H: 896, Top: 44, Bottom: 34, LandscapeSide: 44, LandscapeBottom: 21},
+	{W: 390, H: 844, Top: 47, Bottom: 34, LandscapeSide: 47, LandscapeBottom: 21},
+	{W: 428, H: 926, Top: 47, Bottom: 34, LandscapeSide: 47, LandscapeBottom: 21},
+	{W: 393, H: 852, Top: 59, Bottom: 34, LandscapeSide: 59, LandscapeBottom: 21},
+	{W: 430, H: 932, Top: 59, Bottom: 34, LandscapeSide: 59, LandscapeBottom: 21},
+	{W: 402, H: 874, Top: 62, Bottom: 34, LandscapeSide: 62, LandscapeBottom: 21},
+	{W: 440, H: 956, Top: 62, Bottom: 34, LandscapeSide: 62, LandscapeBottom: 21},
+	{W: 768, H: 1024, Top: 20, IPad: true},
+	{W: 810, H: 1080, Top: 20, IPad: true},
+	{W: 834, H: 1112, Top: 20, IPad: true},
+	{W: 744, H: 1133, Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true},
+	{W: 820, H: 1180, Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true},
+	{W: 834, H: 1194, Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true},
+	{W: 834, H: 1210, Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true},
+	{W: 1024, H: 1366, Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true},
+	{W: 1032, H: 1376, Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true},
+}
+
+// deviceTypeScreenSizes maps simctl device type identifiers to portrait sizes
+// for when the UI tree is unavailable.
+var deviceTypeScreenSizes = map[string][2]float64{
+	"iPhone-SE-3rd-generation": {375, 667},
+	"iPhone-SE-2nd-generation": {375, 667},
+	"iPhone-8":                 {375, 667},
+	"iPhone-8-Plus":            {414, 736},
+	"iPhone-11":                {414, 896},
+	"iPhone-11-Pro":            {375, 812},
+	"iPhone-11-Pro-Max":        {414, 896},
+	"iPhone-12":                {390, 844},
+	"iPhone-12-mini":           {375, 812},
+	"iPhone-12-Pro":            {390, 844},
+	"iPhone-12-Pro-Max":        {428, 926},
+	"iPhone-13":                {390, 844},
+	"iPhone-13-mini":           {375, 812},
+	"iPhone-13-Pro":            {390, 844},
+	"iPhone-13-Pro-Max":        {428, 926},
+	"iPhone-14":                {390, 844},
+	"iPhone-14-Plus":           {428, 926},
+	"iPhone-14-Pro":            {393, 852},
+	"iPhone-14-Pro-Max":        {430, 932},
+	"iPhone-15":                {393, 852},
+	"iPhone-15-Plus":           {430, 932},
+	"iPhone-15-Pro":            {393, 852},
+	"iPhone-15-Pro-Max":        {430, 932},
+	"iPhone-16":                {393, 852},
+	"iPhone-16-Plus":           {430, 932},
+	"iPhone-16-Pro":            {402, 874},
+	"iPhone-16-Pro-Max":        {440, 956},
+}
+
+func deviceTypeName(deviceType string) string {
+	name := strings.TrimSpace(deviceType)
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// lookupDeviceProfile finds the profile by screen size, or by device type when
+// the size is unknown. Notch heights that differ between devices sharing a
+// screen size are corrected from the device type.
+func lookupDeviceProfile(deviceType string, w, h float64) (deviceProfile, bool) {
+	name := deviceTypeName(deviceType)
+	if w <= 0 || h <= 0 {
+		size, ok := deviceTypeScreenSizes[name]
+		if !ok {
+			return deviceProfile{}, false
+		}
+		w, h = size[0], size[1]
+	}
+	portraitW, portraitH := math.Min(w, h), math.Max(w, h)
+	for _, p := range deviceProfiles {
+		if math.Abs(p.W-portraitW) > 1 || math.Abs(p.H-portraitH) > 1 {
+			continue
+		}
+		lower := strings.ToLower(name)
+		switch {
+		case strings.Contains(lower, "mini") && !p.IPad && p.Top == 44:
+			p.Top, p.LandscapeSide = 50, 50
+		case (lower == "iphone-xr" || lower == "iphone-11") && p.Top == 44:
+			p.Top, p.LandscapeSide = 48, 48
+		}
+		return p, true
+	}
+	return deviceProfile{}, false
+}
+
+func safeAreaInsets(deviceType string, w, h float64) edgeInsets {
+	if w <= 0 || h <= 0 {
+		return edgeInsets{}
+	}
+	profile, ok := lookupDeviceProfile(deviceType, w, h)
+	if !ok {
+		isIPad := strings.Contains(strings.ToLower(deviceType), "ipad") || math.Min(w, h) >= 700
+		notched := !isIPad && math.Max(w, h)/math.Min(w, h) > 2
+		switch {
+		case isIPad:
+			profile = deviceProfile{Top: 24, Bottom: 20, LandscapeBottom: 20, IPad: true}
+		case notched:
+			profile = deviceProfile{Top: 47, Bottom: 34, LandscapeSide: 47, LandscapeBottom: 21}
+		default:
+			profile = deviceProfile{Top: 20}
+		}
+	}
+	if w <= h {
+		return edgeInsets{Top: profile.Top, Bottom: profile.Bottom}
+	}
+	if profile.IPad {
+		return edgeInsets{Top: profile.Top, Bottom: profile.LandscapeBottom}
+	}
+	return edgeInsets{Bottom: profile.LandscapeBottom, Left: profile.LandscapeSide, Right: profile.LandscapeSide}
+}
+
+// swipeOrigin returns the center of the safe content area, falling back to an
+// iPhone-sized default when no transform is available.
+func swipeOrigin(t Transform) (float64, float64) {
+	if t.Screen.W <= 0 || t.Screen.H <= 0 {
+		return 196, 426
+	}
+	x := t.SafeArea.Left + (t.Screen.W-t.SafeArea.Left-t.SafeArea.Right)/2
+	y := t.SafeArea.Top + (t.Screen.H-t.SafeArea.Top-t.SafeArea.Bottom)/2
+	return x, y
+}
+
+func createAnnotatedImage(srcPath, dstPath string, elements []Element, transform Transform) error {
+	src, format, err := decodeImage(srcPath)
+	if err != nil {
+		return err
+	}
+
+	rgba := image.NewRGBA(src.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	scale := transform.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+
+	for _, e := range elements {
+		r := image.Rect(
+			int(math.Round(e.Frame.X*scale)),
+			int(math.Round(e.Frame.Y*scale)),
+			int(math.Round((e.Frame.X+e.Frame.W)*scale)),
+			int(math.Round((e.Frame.Y+e.Frame.H)*scale)),
+		)
+		if r.Dx() <= 1 || r.Dy() <= 1 {
+			continue
+		}
+
+		stroke := annotationStrokeColor(e.Index)
+		strokeThickness := maxInt(3, int(math.Round(scale*1.5)))
+		strokeRect(rgba, r, stroke, strokeThickness)
+
+		label := strconv.Itoa(e.Index)
+		digitScale := maxInt(4, int(math.Round(scale*2)))
+		digitWidth := 8 * digitScale
+		digitHeight := 8 * digitScale
+		labelPaddingX := maxInt(4, digitScale)
+		labelPaddingY := maxInt(3, digitScale/2)
+		labelW := labelPaddingX*2 + len(label)*digitWidth
+		labelH := labelPaddingY*2 + digitHeight
+		labelTop := maxInt(0, r.Min.Y-labelH-2)
+		labelRect := image.Rect(r.Min.X, labelTop, r.Min.X+labelW, labelTop+labelH)
+		labelRect = clampRectToBounds(labelRect, rgba.Bounds())
+		labelBG := color.RGBA{R: stroke.R, G: stroke.G, B: stroke.B, A: 220}
+		fillRect(rgba, labelRect, labelBG)
+		strokeRect(rgba, labelRect, color.RGBA{R: 255, G: 255, B: 255, A: 230}, maxInt(1, digitScale/4))
+		drawDigits(rgba, labelRect.Min.X+labelPaddingX, labelRect.Min.Y+labelPaddingY, label, annotationTextColor(stroke), digitScale)
+	}
+
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if format == "jpeg" {
+		return png.Encode(f, rgba)
+	}
+	return png.Encode(f, rgba)
+}
+
+func decodeImage(path string) (image.Image, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	img, format, err := image.Decode(f)
+	return img, format, err
+}
+
+func strokeRect(img *image.RGBA, r image.Rectangle, c color.Color, thickness int) {
+	for i := 0; i < thickness; i++ {
+		top := image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1)
+		bottom := image.Rect(r.Min.X, r.Max.Y-1-i, r.Max.X, r.Max.Y-i)
+		left := image.Rect(r.Min.X+i, r.Min.Y, r.Min.X+i+1, r.Max.Y)
+		right := image.Rect(r.Max.X-1-i, r.Min.Y, r.Max.X-i, r.Max.Y)
+		fillRect(img, top, c)
+		fillRect(img, bottom, c)
+		fillRect(img, left, c)
+		fillRect(img, right, c)
+	}
+}
+
+func fillRect(img draw.Image, r image.Rectangle, c color.Color) {
+	draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
+}
+
+func clampRectToBounds(r image.Rectangle, bounds image.Rectangle) image.Rectangle {
+	if r.Dx() >= bounds.Dx() {
+		r.Min.X = bounds.Min.X
+		r.Max.X = bounds.Max.X
+	} else {
+		if r.Min.X < bounds.Min.X {
+			r = r.Add(image.Pt(bounds.Min.X-r.Min.X, 0))
+		}
+		if r.Max.X > bounds.Max.X {
+			r = r.Add(image.Pt(bounds.Max.X-r.Max.X, 0))
+		}
+	}
+
+	if r.Dy() >= bounds.Dy() {
+		r.Min.Y = bounds.Min.Y
+		r.Max.Y = bounds.Max.Y
+	} else {
+		if r.Min.Y < bounds.Min.Y {
+			r = r.Add(image.Pt(0, bounds.Min.Y-r.Min.Y))
+		}
+		if r.Max.Y > bounds.Max.Y {
+			r = r.Add(image.Pt(0, bounds.Max.Y-r.Max.Y))
+		}
+	}
+
+	return r
+}
+
+func drawDigits(img *image.RGBA, x int, y int, text string, c color.Color, scale int) {
+	if scale <= 0 {
+		scale = 1
+	}
+	offset := 0
+	for _, ch := range text {
+		if ch >= '0' && ch <= '9' {
+			drawDigit(img, x+offset, y, int(ch-'0'), c, scale)
+			offset += 8 * scale
+		}
+	}
+}
+
+func drawDigit(img *image.RGBA, x int, y int, digit int, c color.Color, scale int) {
+	segments := [10][7]bool{
+		{true, true, true, true, true, true, false},
+		{false, true, true, false, false, false, false},
+		{true, true, false, true, true, false, true},
+		{true, true, true, true, false, false, true},
+		{false, true, true, false, false, true, true},
+		{true, false, true, true, false, true, true},
+		{true, false, true, true, true, true, true},
+		{true, true, true, false, false, false, false},
+		{true, true, true, true, true, true, true},
+		{true, true, true, true, false, true, true},
+	}
+	if digit < 0 || digit > 9 {
+		return
+	}
+	if scale <= 0 {
+		scale = 1
+	}
+	scaleRect := func(x0 int, y0 int, x1 int, y1 int) image.Rectangle {
+		return image.Rect(x+x0*scale, y+y0*scale, x+x1*scale, y+y1*scale)
+	}
+	on := segments[digit]
+	if on[0] {
+		fillRect(img, scaleRect(1, 0, 6, 1), c)
+	}
+	if on[1] {
+		fillRect(img, scaleRect(6, 1, 7, 4), c)
+	}
+	if on[2] {
+		fillRect(img, scaleRect(6, 4, 7, 7), c)
+	}
+	if on[3] {
+		fillRect(img, scaleRect(1, 7, 6, 8), c)
+	}
+	if on[4] {
+		fillRect(img, scaleRect(0, 4, 1, 7), c)
+	}
+	if on[5] {
+		fillRect(img, scaleRect(0, 1, 1, 4), c)
+	}
+	if on[6] {
+		fillRect(img, scaleRect(1, 3, 6, 4), c)
+	}
+}
+
+func annotationStrokeColor(index int) color.RGBA {
+	palette := []color.RGBA{
+		{R: 220, G: 53, B: 69, A: 255},
+		{R: 13, G: 110, B: 253, A: 255},
+		{R: 25, G: 135, B: 84, A: 255},
+		{R: 255, G: 140, B: 0, A: 255},
+		{R: 111, G: 66, B: 193, A: 255},
+		{R: 32, G: 201, B: 151, A: 255},
+		{R: 214, G: 51, B: 132, A: 255},
+		{R: 13, G: 202, B: 240, A: 255},
+		{R: 102, G: 16, B: 242, A: 255},
+		{R: 108, G: 117, B: 125, A: 255},
+	}
+	if len(palette) == 0 {
+		return color.RGBA{R: 255, G: 64, B: 64, A: 255}
+	}
+	if index < 0 {
+		index = -index
+	}
+	return palette[index%len(palette)]
+}
+
+func annotationTextColor(bg color.RGBA) color.RGBA {
+	brightness := int(bg.R)*299 + int(bg.G)*587 + int(bg.B)*114
+	if brightness >= 140000 {
+		return color.RGBA{R: 0, G: 0, B: 0, A: 255}
+	}
+	return color.RGBA{R: 255, G: 255, B: 255, A: 255}
+}
+
+func imageSize(path string) (image.Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer f.Close()
+	cfg, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Point{}, err
+	}
+	_ = format
+	return image.Pt(cfg.Width, cfg.Height), nil
+}
+
+func (a *App) fail(err error, emitJSON bool, stderr io.Writer) int {
+	appErr := toAppError(err)
+	if emitJSON {
+		a.printJSON(ErrorEnvelope{OK: false, Error: appErr})
+		return 1
+	}
+	fmt.Fprintf(stderr, "error [%s]: %s\n", appErr.Code, appErr.Message)
+	if len(appErr.Details) > 0 {
+		if b, marshalErr := json.MarshalIndent(appErr.Details, "", "  "); marshalErr == nil {
+			fmt.Fprintf(stderr, "%s\n", string(b))
+		}
+	}
+	return 1
+}
+
+func (a *App) printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	if a.batch != nil {
+		// One compact object per line, tagged with its input line.
+		if m, ok := v.(map[string]any); ok && a.batch.line > 0 {
+			m["line"] = a.batch.line
+		}
+	} else {
+		enc.SetIndent("", "  ")
+	}
+	_ = enc.Encode(v)
+}
+
+func (a *App) logf(format string, args ...any) {
+	if a.opts.Quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+}
+
+func configDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", wrapErr("IO_ERROR", "failed to resolve home directory", err)
+	}
+	dir := filepath.Join(home, ".config", "simagent")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", wrapErr("IO_ERROR", "failed to create config directory", err)
+	}
+	return dir, nil
+}
+
+func configPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "config.json"), nil
+}
+
+func lastFramePath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "last_frame.json"), nil
+}
+
+func loadConfig() (Config, error) {
+	path, err := configPath()
+	if err != nil {
+		return Config{}, err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Config{}, nil
+	}
+	if err != nil {
+		return Config{}, wrapErr("IO_ERROR", "failed to read config", err)
+	}
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, wrapErr("IO_ERROR", "failed to parse config", err)
+	}
+	return cfg, nil
+}
+
+func saveConfig(cfg Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return wrapErr("IO_ERROR", "failed to encode config", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return wrapErr("IO_ERROR", "failed to write config", err)
+	}
+	return nil
+}
+
+func saveLastFrame(frame LastFrame) error {
+	path, err := lastFramePath()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(frame, "", "  ")
+	if err != nil {
+		return wrapErr("IO_ERROR", "failed to encode last_frame", err)
+	}
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		return wrapErr("IO_ERROR", "failed to write last_frame", err)
+	}
+	return nil
+}
+
+func loadLastFrame() (LastFrame, error) {
+	path, err := lastFramePath()
+	if err != nil {
+		return LastFrame{}, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return LastFrame{}, &AppError{Code: "NO_LAST_FRAME", Message: "no last frame found; run `simagent frame` first"}
+		}
+		return LastFrame{}, wrapErr("IO_ERROR", "failed to read last_frame", err)
+	}
+	var frame LastFrame
+	if err := json.Unmarshal(b, &frame); err != nil {
+		return LastFrame{}, wrapErr("IO_ERROR", "failed to parse last_frame", err)
+	}
+	return frame, nil
+}
+
+func loadElementsAndTransform(from string) ([]Element, Transform, error) {
+	elementsPath := from
+	transformPath := ""
+	if strings.TrimSpace(elementsPath) == "" {
+		last, err := loadLastFrame()
+		if err != nil {
+			return nil, Transform{}, err
+		}
+		elementsPath = last.Elements
+		transformPath = last.Transform
+	} else {
+		transformPath = filepath.Join(filepath.Dir(elementsPath), "transform.json")
+	}
+
+	elemBytes, err := os.ReadFile(elementsPath)
+	if err != nil {
+		return nil, Transform{}, wrapErr("IO_ERROR", "failed to read elements json", err)
+	}
+	var elements []Element
+	if err := json.Unmarshal(elemBytes, &elements); err != nil {
+		return nil, Transform{}, wrapErr("IO_ERROR", "failed to parse elements json", err)
+	}
+
+	var transform Transform
+	if transformBytes, err := os.ReadFile(transformPath); err == nil {
+		_ = json.Unmarshal(transformBytes, &transform)
+	}
+	return elements, transform, nil
+}
+
+func pickElement(elements []Element, index int, id string) (Element, error) {
+	if index >= 0 {
+		for _, e := range elements {
+			if e.Index == index {
+				return e, nil
+			}
+		}
+		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: fmt.Sprintf("element index not found: %d", index)}
+	}
+	if id != "" {
+		for _, e := range elements {
+			if e.ID == id {
+				return e, nil
+			}
+		}
+		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "element id not found: " + id}
+	}
+	return Element{}, &AppError{Code: "USAGE", Message: "index or id is required"}
+}
+
+type uiTypeOptions struct {
+	Text              string
+	Into              bool
+	Index             int
+	ID                string
+	Label             string
+	Contains          string
+	LabelRegex        string
+	ValueRegex        string
+	Select            string
+	Role              string
+	Below             string
+	Above             string
+	RightOf           string
+	LeftOf            string
+	Inside            string
+	Normalize         bool
+	Nth               int
+	First             bool
+	Last              bool
+	Explain           bool
+	From              string
+	Replace           bool
+	ASCII             bool
+	Paste             bool
+	FocusRetries      int
+	Verify            bool
+	JSON              bool
+	LegacyTypeParsing bool
+	Submit            bool
+	Chunking          inputChunking
+	VerifyMode        verifyMode
+	ClearStrategy     string
+	Expect            actionExpectation
+}
+
+type elementSnapshot struct {
+	Elements         []Element
+	AllCount         int
+	InteractiveCount int
+	Keyboard         KeyboardState
+	Alert            *AlertState
+	Screen           FrameRect
+	Hash             string
+}
+
+const selectorFlagsUsage = "--index|--id|--label|--contains|--label-regex|--value-regex|--select"
+
+// elementSelector bundles the element selector flags shared by ui commands and
+// flow steps. Index is -1 when unset.
+type elementSelector struct {
+	Index    int
+	ID       string
+	Label    string
+	Contains string
+	// LabelRegex and ValueRegex are RE2 patterns matched against the label
+	// and value.
+	LabelRegex string
+	ValueRegex string
+	Select     string
+	// Role, Below, Above, RightOf, LeftOf and Inside narrow any selector (or
+	// select on their own) by role and position relative to an anchor text;
+	// Inside takes a --select expression for the container.
+	Role    string
+	Below   string
+	Above   string
+	RightOf string
+	LeftOf  string
+	Inside  string
+	// Normalize folds width, kana and whitespace before text comparisons.
+	Normalize bool
+	// Nth (1-based), First and Last pick among text/select matches in
+	// reading order instead of failing with ELEMENT_AMBIGUOUS.
+	Nth   int
+	First bool
+	Last  bool
+	// Explain reports the ranked candidates and their score breakdown.
+	Explain bool
+}
+
+func addSelectorFlags(fs *flag.FlagSet, verb string) *elementSelector {
+	sel := &elementSelector{}
+	fs.IntVar(&sel.Index, "index", -1, "element index")
+	fs.StringVar(&sel.ID, "id", "", "element id")
+	fs.StringVar(&sel.Label, "label", "", verb+" by exact label")
+	fs.StringVar(&sel.Contains, "contains", "", verb+" by partial label/value")
+	fs.StringVar(&sel.LabelRegex, "label-regex", "", verb+" by label regular expression")
+	fs.StringVar(&sel.ValueRegex, "value-regex", "", verb+" by value regular expression")
+	fs.StringVar(&sel.Select, "select", "", verb+" by selector expression")
+	fs.StringVar(&sel.Role, "role", "", "only match elements with this role")
+	fs.StringVar(&sel.Below, "below", "", "only match elements below the element with this text")
+	fs.StringVar(&sel.Above, "above", "", "only match elements above the element with this text")
+	fs.StringVar(&sel.RightOf, "right-of", "", "only match elements right of the element with this text")
+	fs.StringVar(&sel.LeftOf, "left-of", "", "only match elements left of the element with this text")
+	fs.StringVar(&sel.Inside, "inside", "", "only match elements inside a container matching this selector expression")
+	fs.BoolVar(&sel.Normalize, "normalize", false, "fold full-width/half-width, kana and whitespace when matching text")
+	fs.IntVar(&sel.Nth, "nth", 0, "pick the nth match in reading order (1-based)")
+	fs.BoolVar(&sel.First, "first", false, "pick the first match in reading order")
+	fs.BoolVar(&sel.Last, "last", false, "pick the last match in reading order")
+	fs.BoolVar(&sel.Explain, "explain", false, "report candidate scores")
+	return sel
+}
+
+func (o uiTypeOptions) selector() elementSelector {
+	sel := elementSelector{
+		Index:      o.Index,
+		ID:         o.ID,
+		Label:      o.Label,
+		Contains:   o.Contains,
+		LabelRegex: o.LabelRegex,
+		ValueRegex: o.ValueRegex,
+		Select:     o.Select,
+		Role:       o.Role,
+		Below:      o.Below,
+		Above:      o.Above,
+		RightOf:    o.RightOf,
+		LeftOf:     o.LeftOf,
+		Inside:     o.Inside,
+		Normalize:  o.Normalize,
+		Nth:        o.Nth,
+		First:      o.First,
+		Last:       o.Last,
+		Explain:    o.Explain,
+	}
+	sel.normalize()
+	return sel
+}
+
+func (s *elementSelector) normalize() {
+	s.ID = strings.TrimSpace(s.ID)
+	s.Label = strings.TrimSpace(s.Label)
+	s.Contains = strings.TrimSpace(s.Contains)
+	s.LabelRegex = strings.TrimSpace(s.LabelRegex)
+	s.ValueRegex = strings.TrimSpace(s.ValueRegex)
+	s.Select = strings.TrimSpace(s.Select)
+	s.Role = strings.TrimSpace(s.Role)
+	s.Below = strings.TrimSpace(s.Below)
+	s.Above = strings.TrimSpace(s.Above)
+	s.RightOf = strings.TrimSpace(s.RightOf)
+	s.LeftOf = strings.TrimSpace(s.LeftOf)
+	s.Inside = strings.TrimSpace(s.Inside)
+}
+
+func (s elementSelector) hasFilters() bool {
+	return s.Role != "" || s.Below != "" || s.Above != "" || s.RightOf != "" || s.LeftOf != "" || s.Inside != ""
+}
+
+// filterNode turns the role and relative flags into a select expression
+// node, or nil when none are set.
+func (s elementSelector) filterNode() (*selectorNode, error) {
+	var node *selectorNode
+	add := func(next *selectorNode) {
+		if node == nil {
+			node = next
+			return
+		}
+		node = &selectorNode{Op: "and", Left: node, Right: next}
+	}
+	if s.Role != "" {
+		add(&selectorNode{Op: "role", Value: normalizeSelectorRole(s.Role)})
+	}
+	for _, rel := range []struct{ name, anchor string }{
+		{"below", s.Below}, {"above", s.Above}, {"right-of", s.RightOf}, {"left-of", s.LeftOf},
+	} {
+		if rel.anchor != "" {
+			add(&selectorNode{Op: "rel", Cmp: rel.name, Value: rel.anchor})
+		}
+	}
+	if s.Inside != "" {
+		container, err := parseSelectorExpr(s.Inside)
+		if err != nil {
+			return nil, err
+		}
+		add(&selectorNode{Op: "rel", Cmp: "inside", Right: container})
+	}
+	return node, nil
+}
+
+func (s elementSelector) count() int {
+	count := countElementSelectors(s.Index, s.ID, s.Label, s.Contains)
+	for _, v := range []string{s.LabelRegex, s.ValueRegex, s.Select} {
+		if v != "" {
+			count++
+		}
+	}
+	if count == 0 && s.hasFilters() {
+		count = 1
+	}
+	return count
+}
+
+func (s elementSelector) kind() string {
+	switch {
+	case s.Index >= 0:
+		return "index"
+	case s.ID != "":
+		return "id"
+	case s.Label != "":
+		return "label"
+	case s.Contains != "":
+		return "contains"
+	case s.LabelRegex != "":
+		return "label-regex"
+	case s.ValueRegex != "":
+		return "value-regex"
+	case s.Select != "":
+		return "select"
+	case s.hasFilters():
+		return "relative"
+	default:
+		return ""
+	}
+}
+
+func (s elementSelector) validate() error {
+	picks := 0
+	if s.Nth != 0 {
+		picks++
+	}
+	if s.First {
+		picks++
+	}
+	if s.Last {
+		picks++
+	}
+	if picks > 1 {
+		return &AppError{Code: "USAGE", Message: "choose only one of --nth|--first|--last"}
+	}
+	if s.Nth < 0 {
+		return &AppError{Code: "USAGE", Message: "--nth must be >= 1"}
+	}
+	if _, err := s.textMatcher(); err != nil {
+		return err
+	}
+	if s.hasFilters() && (s.Index >= 0 || s.ID != "") {
+		return &AppError{Code: "USAGE", Message: "--role/--below/--above/--right-of/--left-of/--inside cannot be combined with --index or --id"}
+	}
+	if _, err := s.filterNode(); err != nil {
+		return err
+	}
+	if s.Select == "" {
+		return nil
+	}
+	_, err := parseSelectorExpr(s.Select)
+	return err
+}
+
+// details is responseFields with index, id, label and contains always
+// present, the shape flow step results have always reported.
+func (s elementSelector) details() map[string]any {
+	out := s.responseFields()
+	out["index"] = s.Index
+	out["id"] = s.ID
+	out["label"] = s.Label
+	out["contains"] = s.Contains
+	return out
+}
+
+// responseFields returns only the selector fields that were set, for
+// flattening into command responses.
+func (s elementSelector) responseFields() map[string]any {
+	out := map[string]any{}
+	if s.Index >= 0 {
+		out["index"] = s.Index
 	}
-	if rect, ok := rectFromAny(m["bounds"]); ok {
-		return rect, true
+	if s.ID != "" {
+		out["id"] = s.ID
 	}
-	if rect, ok := rectFromAny(m["rect"]); ok {
-		return rect, true
+	if s.Label != "" {
+		out["label"] = s.Label
 	}
-	if rect, ok := rectFromAny(m); ok {
-		return rect, true
+	if s.Contains != "" {
+		out["contains"] = s.Contains
 	}
-	return FrameRect{}, false
-}
-
-func rectFromAny(v any) (FrameRect, bool) {
-	mapVal, ok := v.(map[string]any)
-	if !ok {
-		return FrameRect{}, false
+	if s.LabelRegex != "" {
+		out["labelRegex"] = s.LabelRegex
 	}
-	x, okX := getFloatAny(mapVal, []string{"x", "left", "originX"})
-	y, okY := getFloatAny(mapVal, []string{"y", "top", "originY"})
-	w, okW := getFloatAny(mapVal, []string{"w", "width"})
-	h, okH := getFloatAny(mapVal, []string{"h", "height"})
-	if okX && okY && okW && okH {
-		return FrameRect{X: x, Y: y, W: w, H: h, Unit: "pt"}, true
+	if s.ValueRegex != "" {
+		out["valueRegex"] = s.ValueRegex
 	}
-	return FrameRect{}, false
+	if s.Select != "" {
+		out["select"] = s.Select
+	}
+	for key, value := range map[string]string{
+		"role": s.Role, "below": s.Below, "above": s.Above, "rightOf": s.RightOf, "leftOf": s.LeftOf, "inside": s.Inside,
+	} {
+		if value != "" {
+			out[key] = value
+		}
+	}
+	if s.Normalize {
+		out["normalize"] = true
+	}
+	if s.Nth > 0 {
+		out["nth"] = s.Nth
+	}
+	if s.First {
+		out["first"] = true
+	}
+	if s.Last {
+		out["last"] = true
+	}
+	return out
 }
 
-func deriveTransform(rawUI any, elements []Element, screenshotSize image.Point) Transform {
-	var t Transform
-	t.Screen.Unit = "pt"
-	t.Screenshot.Unit = "px"
-	t.SafeArea.Unit = "pt"
-	t.Scale = 1
-	if screenshotSize.X > 0 {
-		t.Screenshot.W = screenshotSize.X
+func countElementSelectors(index int, id, label, contains string) int {
+	count := 0
+	if index >= 0 {
+		count++
 	}
-	if screenshotSize.Y > 0 {
-		t.Screenshot.H = screenshotSize.Y
+	if strings.TrimSpace(id) != "" {
+		count++
+	}
+	if strings.TrimSpace(label) != "" {
+		count++
+	}
+	if strings.TrimSpace(contains) != "" {
+		count++
 	}
+	return count
+}
 
-	maxW := 0.0
-	maxH := 0.0
-	for _, e := range elements {
-		if e.Frame.X+e.Frame.W > maxW {
-			maxW = e.Frame.X + e.Frame.W
+func pickElementBySelector(elements []Element, sel elementSelector) (Element, error) {
+	elem, _, err := rankElementsBySelector(elements, sel)
+	return elem, err
+}
+
+// rankElementsBySelector resolves sel against elements and also returns the
+// ranked candidates for text and --select selectors.
+func rankElementsBySelector(elements []Element, sel elementSelector) (Element, []elementCandidate, error) {
+	sel.normalize()
+	switch sel.count() {
+	case 0:
+		return Element{}, nil, &AppError{Code: "USAGE", Message: "selector is required: " + selectorFlagsUsage}
+	case 1:
+		if sel.Index >= 0 || sel.ID != "" {
+			elem, err := pickElement(elements, sel.Index, sel.ID)
+			return elem, nil, err
 		}
-		if e.Frame.Y+e.Frame.H > maxH {
-			maxH = e.Frame.Y + e.Frame.H
+		filter, err := sel.filterNode()
+		if err != nil {
+			return Element{}, nil, err
 		}
-	}
-	if maxW == 0 || maxH == 0 {
-		if rootMap, ok := rawUI.(map[string]any); ok {
-			if rect, ok := findRect(rootMap); ok {
-				if maxW == 0 {
-					maxW = rect.W
+		var candidates []elementCandidate
+		if sel.Select != "" || (filter != nil && sel.kind() == "relative") {
+			query := filter
+			if sel.Select != "" {
+				query, err = parseSelectorExpr(sel.Select)
+				if err != nil {
+					return Element{}, nil, err
 				}
-				if maxH == 0 {
-					maxH = rect.H
+				if filter != nil {
+					query = &selectorNode{Op: "and", Left: query, Right: filter}
 				}
 			}
+			candidates = rankSelectExprCandidates(elements, query, sel.Normalize)
+			if len(candidates) == 0 {
+				return Element{}, nil, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "no element matches selector", Details: sel.details()}
+			}
+		} else {
+			matcher, err := sel.textMatcher()
+			if err != nil {
+				return Element{}, nil, err
+			}
+			candidates = rankTextCandidates(elements, matcher)
+			if filter != nil {
+				candidates = filterCandidates(elements, candidates, filter, sel.Normalize)
+			}
+			if len(candidates) == 0 {
+				return Element{}, nil, matcher.notFoundError()
+			}
 		}
+		elem, err := chooseCandidate(candidates, sel)
+		return elem, candidates, err
+	default:
+		return Element{}, nil, &AppError{Code: "USAGE", Message: "choose only one selector: " + selectorFlagsUsage}
 	}
-
-	if maxW == 0 && t.Screenshot.W > 0 {
-		maxW = float64(t.Screenshot.W)
-	}
-	if maxH == 0 && t.Screenshot.H > 0 {
-		maxH = float64(t.Screenshot.H)
-	}
-
-	t.Screen.W = maxW
-	t.Screen.H = maxH
-
-	if t.Screen.W > 0 && t.Screenshot.W > 0 {
-		t.Scale = float64(t.Screenshot.W) / t.Screen.W
-	} else if t.Screen.H > 0 && t.Screenshot.H > 0 {
-		t.Scale = float64(t.Screenshot.H) / t.Screen.H
-	}
-
-	return t
 }
 
-func createAnnotatedImage(srcPath, dstPath string, elements []Element, transform Transform) error {
-	src, format, err := decodeImage(srcPath)
-	if err != nil {
-		return err
-	}
-
-	rgba := image.NewRGBA(src.Bounds())
-	draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+// textMatcher holds the folded text and compiled regex parts of a selector.
+type textMatcher struct {
+	label      string
+	contains   string
+	labelRegex *regexp.Regexp
+	valueRegex *regexp.Regexp
+	normalize  bool
+}
 
-	scale := transform.Scale
-	if scale <= 0 {
-		scale = 1
+func (s elementSelector) textMatcher() (textMatcher, error) {
+	m := textMatcher{
+		label:     foldSelectorText(s.Label, s.Normalize),
+		contains:  foldSelectorText(s.Contains, s.Normalize),
+		normalize: s.Normalize,
 	}
-
-	for _, e := range elements {
-		r := image.Rect(
-			int(math.Round(e.Frame.X*scale)),
-			int(math.Round(e.Frame.Y*scale)),
-			int(math.Round((e.Frame.X+e.Frame.W)*scale)),
-			int(math.Round((e.Frame.Y+e.Frame.H)*scale)),
-		)
-		if r.Dx() <= 1 || r.Dy() <= 1 {
-			continue
+	var err error
+	if s.LabelRegex != "" {
+		if m.labelRegex, err = regexp.Compile(s.LabelRegex); err != nil {
+			return m, &AppError{Code: "USAGE", Message: "invalid --label-regex: " + err.Error()}
 		}
-
-		stroke := annotationStrokeColor(e.Index)
-		strokeThickness := maxInt(3, int(math.Round(scale*1.5)))
-		strokeRect(rgba, r, stroke, strokeThickness)
-
-		label := strconv.Itoa(e.Index)
-		digitScale := maxInt(4, int(math.Round(scale*2)))
-		digitWidth := 8 * digitScale
-		digitHeight := 8 * digitScale
-		labelPaddingX := maxInt(4, digitScale)
-		labelPaddingY := maxInt(3, digitScale/2)
-		labelW := labelPaddingX*2 + len(label)*digitWidth
-		labelH := labelPaddingY*2 + digitHeight
-		labelTop := maxInt(0, r.Min.Y-labelH-2)
-		labelRect := image.Rect(r.Min.X, labelTop, r.Min.X+labelW, labelTop+labelH)
-		labelRect = clampRectToBounds(labelRect, rgba.Bounds())
-		labelBG := color.RGBA{R: stroke.R, G: stroke.G, B: stroke.B, A: 220}
-		fillRect(rgba, labelRect, labelBG)
-		strokeRect(rgba, labelRect, color.RGBA{R: 255, G: 255, B: 255, A: 230}, maxInt(1, digitScale/4))
-		drawDigits(rgba, labelRect.Min.X+labelPaddingX, labelRect.Min.Y+labelPaddingY, label, annotationTextColor(stroke), digitScale)
 	}
-
-	f, err := os.Create(dstPath)
-	if err != nil {
-		return err
+	if s.ValueRegex != "" {
+		if m.valueRegex, err = regexp.Compile(s.ValueRegex); err != nil {
+			return m, &AppError{Code: "USAGE", Message: "invalid --value-regex: " + err.Error()}
+		}
 	}
-	defer f.Close()
+	return m, nil
+}
 
-	if format == "jpeg" {
-		return png.Encode(f, rgba)
+func (m textMatcher) notFoundError() error {
+	switch {
+	case m.label != "":
+		return &AppError{Code: "ELEMENT_NOT_FOUND", Message: "element label not found: " + m.label}
+	case m.labelRegex != nil:
+		return &AppError{Code: "ELEMENT_NOT_FOUND", Message: "no element label matches: " + m.labelRegex.String()}
+	case m.valueRegex != nil:
+		return &AppError{Code: "ELEMENT_NOT_FOUND", Message: "no element value matches: " + m.valueRegex.String()}
+	default:
+		return &AppError{Code: "ELEMENT_NOT_FOUND", Message: "element text not found: " + m.contains}
 	}
-	return png.Encode(f, rgba)
 }
 
-func decodeImage(path string) (image.Image, string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, "", err
+// regexSubject is the text a selector regex runs against; with --normalize
+// the element text is folded but the pattern is used as written.
+func (m textMatcher) regexSubject(s string) string {
+	if m.normalize {
+		return normalizeMatchText(s)
 	}
-	defer f.Close()
-	img, format, err := image.Decode(f)
-	return img, format, err
+	return strings.TrimSpace(s)
 }
 
-func strokeRect(img *image.RGBA, r image.Rectangle, c color.Color, thickness int) {
-	for i := 0; i < thickness; i++ {
-		top := image.Rect(r.Min.X, r.Min.Y+i, r.Max.X, r.Min.Y+i+1)
-		bottom := image.Rect(r.Min.X, r.Max.Y-1-i, r.Max.X, r.Max.Y-i)
-		left := image.Rect(r.Min.X+i, r.Min.Y, r.Min.X+i+1, r.Max.Y)
-		right := image.Rect(r.Max.X-1-i, r.Min.Y, r.Max.X-i, r.Max.Y)
-		fillRect(img, top, c)
-		fillRect(img, bottom, c)
-		fillRect(img, left, c)
-		fillRect(img, right, c)
+func foldSelectorText(s string, normalize bool) string {
+	if normalize {
+		return normalizeMatchText(s)
 	}
+	return strings.ToLower(strings.TrimSpace(s))
 }
 
-func fillRect(img draw.Image, r image.Rectangle, c color.Color) {
-	draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
-}
+// halfWidthKatakana maps U+FF61..U+FF9D to their full-width forms.
+var halfWidthKatakana = []rune("。「」、・ヲァィゥェォャュョッーアイウエオカキクケコサシスセソタチツテトナニヌネノハヒフヘホマミムメモヤユヨラリルレロワン")
 
-func clampRectToBounds(r image.Rectangle, bounds image.Rectangle) image.Rectangle {
-	if r.Dx() >= bounds.Dx() {
-		r.Min.X = bounds.Min.X
-		r.Max.X = bounds.Max.X
-	} else {
-		if r.Min.X < bounds.Min.X {
-			r = r.Add(image.Pt(bounds.Min.X-r.Min.X, 0))
+// normalizeMatchText folds text for --normalize matching: full-width ASCII and
+// half-width katakana to their canonical width (as NFKC does), voiced sound
+// marks composed onto their base, katakana to hiragana, case, and runs of
+// whitespace to a single space.
+func normalizeMatchText(s string) string {
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= 0xFF01 && r <= 0xFF5E:
+			r -= 0xFEE0
+		case r == 0x3000:
+			r = ' '
+		case r >= 0xFF61 && r <= 0xFF9D:
+			r = halfWidthKatakana[r-0xFF61]
+		case r == 0xFF9E || r == 0x3099 || r == 0x309B:
+			if n := len(out); n > 0 {
+				if composed, ok := composeKanaMark(out[n-1], false); ok {
+					out[n-1] = composed
+					continue
+				}
+			}
+			r = 0x3099
+		case r == 0xFF9F || r == 0x309A || r == 0x309C:
+			if n := len(out); n > 0 {
+				if composed, ok := composeKanaMark(out[n-1], true); ok {
+					out[n-1] = composed
+					continue
+				}
+			}
+			r = 0x309A
 		}
-		if r.Max.X > bounds.Max.X {
-			r = r.Add(image.Pt(bounds.Max.X-r.Max.X, 0))
+		out = append(out, r)
+	}
+	for i, r := range out {
+		if r >= 0x30A1 && r <= 0x30F6 {
+			out[i] = r - 0x60
 		}
 	}
+	return strings.Join(strings.Fields(strings.ToLower(string(out))), " ")
+}
 
-	if r.Dy() >= bounds.Dy() {
-		r.Min.Y = bounds.Min.Y
-		r.Max.Y = bounds.Max.Y
-	} else {
-		if r.Min.Y < bounds.Min.Y {
-			r = r.Add(image.Pt(0, bounds.Min.Y-r.Min.Y))
-		}
-		if r.Max.Y > bounds.Max.Y {
-			r = r.Add(image.Pt(0, bounds.Max.Y-r.Max.Y))
-		}
+// composeKanaMark applies a dakuten (or handakuten when semi) to a kana base.
+func composeKanaMark(base rune, semi bool) (rune, bool) {
+	offset := rune(0)
+	if base >= 0x3041 && base <= 0x3096 {
+		offset = 0x60
+		base += offset
+	}
+	var composed rune
+	switch {
+	case semi && base >= 0x30CF && base <= 0x30DB && (base-0x30CF)%3 == 0:
+		composed = base + 2
+	case semi:
+		return 0, false
+	case base == 0x30A6:
+		composed = 0x30F4
+	case base >= 0x30AB && base <= 0x30C2 && (base-0x30AB)%2 == 0:
+		composed = base + 1
+	case base == 0x30C4 || base == 0x30C6 || base == 0x30C8:
+		composed = base + 1
+	case base >= 0x30CF && base <= 0x30DB && (base-0x30CF)%3 == 0:
+		composed = base + 1
+	default:
+		return 0, false
 	}
+	return composed - offset, true
+}
 
-	return r
+// ambiguityScoreMargin is the score gap below which the top two candidates of
+// a text selector are considered indistinguishable.
+const ambiguityScoreMargin = 8
+
+type elementCandidate struct {
+	Element   Element
+	Score     int
+	Distance  float64
+	Breakdown map[string]int
 }
 
-func drawDigits(img *image.RGBA, x int, y int, text string, c color.Color, scale int) {
-	if scale <= 0 {
-		scale = 1
-	}
-	offset := 0
-	for _, ch := range text {
-		if ch >= '0' && ch <= '9' {
-			drawDigit(img, x+offset, y, int(ch-'0'), c, scale)
-			offset += 8 * scale
+func rankTextCandidates(elements []Element, m textMatcher) []elementCandidate {
+	fold := func(s string) string { return foldSelectorText(s, m.normalize) }
+	candidates := make([]elementCandidate, 0)
+	for _, elem := range elements {
+		if !elem.Enabled {
+			continue
+		}
+		parts := map[string]int{}
+		if m.label != "" {
+			if fold(elem.Label) == m.label {
+				parts["label"] = 90
+			}
+			if fold(elem.Value) == m.label {
+				parts["value"] = 75
+			}
+			if fold(elem.NearbyLabel) == m.label {
+				parts["nearbyLabel"] = 55
+			}
+			if len(parts) == 0 {
+				continue
+			}
+		}
+		if m.contains != "" {
+			if !strings.Contains(fold(elementText(elem)), m.contains) {
+				continue
+			}
+			parts["contains"] = 45
+		}
+		if m.labelRegex != nil {
+			if !m.labelRegex.MatchString(m.regexSubject(elem.Label)) {
+				continue
+			}
+			parts["labelRegex"] = 80
+		}
+		if m.valueRegex != nil {
+			if !m.valueRegex.MatchString(m.regexSubject(elem.Value)) {
+				continue
+			}
+			parts["valueRegex"] = 65
 		}
+		for k, v := range baseElementScoreParts(elem) {
+			parts[k] = v
+		}
+		candidates = append(candidates, elementCandidate{Element: elem, Score: sumScoreParts(parts), Breakdown: parts})
 	}
+	sortCandidates(candidates)
+	return candidates
 }
 
-func drawDigit(img *image.RGBA, x int, y int, digit int, c color.Color, scale int) {
-	segments := [10][7]bool{
-		{true, true, true, true, true, true, false},
-		{false, true, true, false, false, false, false},
-		{true, true, false, true, true, false, true},
-		{true, true, true, true, false, false, true},
-		{false, true, true, false, false, true, true},
-		{true, false, true, true, false, true, true},
-		{true, false, true, true, true, true, true},
-		{true, true, true, false, false, false, false},
-		{true, true, true, true, true, true, true},
-		{true, true, true, true, false, true, true},
-	}
-	if digit < 0 || digit > 9 {
-		return
-	}
-	if scale <= 0 {
-		scale = 1
-	}
-	scaleRect := func(x0 int, y0 int, x1 int, y1 int) image.Rectangle {
-		return image.Rect(x+x0*scale, y+y0*scale, x+x1*scale, y+y1*scale)
-	}
-	on := segments[digit]
-	if on[0] {
-		fillRect(img, scaleRect(1, 0, 6, 1), c)
-	}
-	if on[1] {
-		fillRect(img, scaleRect(6, 1, 7, 4), c)
+// filterCandidates keeps candidates matching the role/relative filter and
+// re-ranks them by anchor distance.
+func filterCandidates(elements []Element, candidates []elementCandidate, filter *selectorNode, normalize bool) []elementCandidate {
+	ctx := newSelectorContext(elements)
+	ctx.normalize = normalize
+	out := make([]elementCandidate, 0, len(candidates))
+	for _, c := range candidates {
+		ok, dist := filter.match(c.Element, ctx)
+		if !ok {
+			continue
+		}
+		c.Distance = dist
+		out = append(out, c)
 	}
-	if on[2] {
-		fillRect(img, scaleRect(6, 4, 7, 7), c)
+	sortCandidates(out)
+	return out
+}
+
+func sortCandidates(candidates []elementCandidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Distance != candidates[j].Distance {
+			return candidates[i].Distance < candidates[j].Distance
+		}
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Element.Index < candidates[j].Element.Index
+	})
+}
+
+// chooseCandidate applies --nth/--first/--last in reading order, or returns
+// the top-ranked candidate unless the runner-up is too close to call.
+func chooseCandidate(candidates []elementCandidate, sel elementSelector) (Element, error) {
+	if len(candidates) == 0 {
+		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "no matching element"}
 	}
-	if on[3] {
-		fillRect(img, scaleRect(1, 7, 6, 8), c)
+	if sel.Nth > 0 || sel.First || sel.Last {
+		ordered := append([]elementCandidate(nil), candidates...)
+		sort.Slice(ordered, func(i, j int) bool {
+			return ordered[i].Element.Index < ordered[j].Element.Index
+		})
+		pos := sel.Nth - 1
+		if sel.First {
+			pos = 0
+		}
+		if sel.Last {
+			pos = len(ordered) - 1
+		}
+		if pos < 0 || pos >= len(ordered) {
+			return Element{}, &AppError{
+				Code:    "ELEMENT_NOT_FOUND",
+				Message: fmt.Sprintf("--nth %d out of range: %d matches", sel.Nth, len(ordered)),
+				Details: map[string]any{"matches": len(ordered)},
+			}
+		}
+		return ordered[pos].Element, nil
 	}
-	if on[4] {
-		fillRect(img, scaleRect(0, 4, 1, 7), c)
+	if len(candidates) > 1 {
+		top, next := candidates[0], candidates[1]
+		if math.Abs(top.Distance-next.Distance) < 1 && top.Score-next.Score < ambiguityScoreMargin {
+			return Element{}, &AppError{
+				Code:    "ELEMENT_AMBIGUOUS",
+				Message: fmt.Sprintf("%d elements match equally well; use --nth|--first|--last or a narrower selector", countCloseCandidates(candidates)),
+				Details: map[string]any{"candidates": candidateDetails(candidates, sel.Explain)},
+			}
+		}
 	}
-	if on[5] {
-		fillRect(img, scaleRect(0, 1, 1, 4), c)
+	return candidates[0].Element, nil
+}
+
+func countCloseCandidates(candidates []elementCandidate) int {
+	count := 0
+	for _, c := range candidates {
+		if math.Abs(candidates[0].Distance-c.Distance) < 1 && candidates[0].Score-c.Score < ambiguityScoreMargin {
+			count++
+		}
 	}
-	if on[6] {
-		fillRect(img, scaleRect(1, 3, 6, 4), c)
+	return count
+}
+
+// maxReportedCandidates caps candidate lists in responses and errors.
+const maxReportedCandidates = 10
+
+func candidateDetails(candidates []elementCandidate, explain bool) []map[string]any {
+	out := make([]map[string]any, 0, len(candidates))
+	for i, c := range candidates {
+		if i >= maxReportedCandidates {
+			break
+		}
+		item := map[string]any{
+			"rank":  i + 1,
+			"index": c.Element.Index,
+			"label": c.Element.Label,
+			"score": c.Score,
+			"frame": c.Element.Frame,
+		}
+		if c.Element.Role != "" {
+			item["role"] = c.Element.Role
+		}
+		if c.Distance > 0 {
+			item["distance"] = math.Round(c.Distance*10) / 10
+		}
+		if explain {
+			item["breakdown"] = c.Breakdown
+		}
+		out = append(out, item)
 	}
+	return out
 }
 
-func annotationStrokeColor(index int) color.RGBA {
-	palette := []color.RGBA{
-		{R: 220, G: 53, B: 69, A: 255},
-		{R: 13, G: 110, B: 253, A: 255},
-		{R: 25, G: 135, B: 84, A: 255},
-		{R: 255, G: 140, B: 0, A: 255},
-		{R: 111, G: 66, B: 193, A: 255},
-		{R: 32, G: 201, B: 151, A: 255},
-		{R: 214, G: 51, B: 132, A: 255},
-		{R: 13, G: 202, B: 240, A: 255},
-		{R: 102, G: 16, B: 242, A: 255},
-		{R: 108, G: 117, B: 125, A: 255},
+func sumScoreParts(parts map[string]int) int {
+	total := 0
+	for _, v := range parts {
+		total += v
 	}
-	if len(palette) == 0 {
-		return color.RGBA{R: 255, G: 64, B: 64, A: 255}
+	return total
+}
+
+// selectorNearMaxDistance bounds `near "text"` matches, in points between
+// element frames.
+const selectorNearMaxDistance = 220.0
+
+var selectorStringAttrs = map[string]bool{
+	"id": true, "role": true, "label": true, "value": true, "nearbylabel": true, "text": true,
+}
+
+var selectorNumberAttrs = map[string]bool{
+	"index": true, "x": true, "y": true, "w": true, "h": true,
+}
+
+var selectorBoolAttrs = map[string]bool{
+	"enabled": true, "focused": true, "visible": true, "offscreen": true, "interactive": true, "input": true,
+}
+
+// selectorKnownRoles are the roles a bare word may name, normalized with
+// normalizeSelectorRole. Anything else is reported as a typo; role=<name>
+// still matches arbitrary roles.
+var selectorKnownRoles = map[string]bool{
+	"application": true, "window": true, "other": true, "group": true,
+	"button": true, "link": true, "image": true, "icon": true,
+	"statictext": true, "heading": true, "header": true,
+	"textfield": true, "securetextfield": true, "searchfield": true, "textview": true, "textarea": true,
+	"cell": true, "table": true, "list": true, "collectionview": true, "scrollview": true,
+	"switch": true, "toggle": true, "slider": true, "stepper": true, "checkbox": true, "radiobutton": true,
+	"picker": true, "pickerwheel": true, "datepicker": true, "segmentedcontrol": true, "combobox": true,
+	"tab": true, "tabbar": true, "toolbar": true, "navigationbar": true, "menu": true, "menuitem": true,
+	"alert": true, "sheet": true, "dialog": true, "popover": true, "keyboard": true, "key": true,
+	"activityindicator": true, "progressindicator": true, "pageindicator": true, "map": true, "webview": true,
+}
+
+// selectorKeywordList names the bare words that are not roles, for errors.
+func selectorKeywordList() []string {
+	words := sortedSetKeys(selectorBoolAttrs)
+	words = append(words, sortedSetKeys(selectorStringAttrs)...)
+	for word := range selectorRelations {
+		words = append(words, word)
 	}
-	if index < 0 {
-		index = -index
+	sort.Strings(words)
+	return append([]string{"and", "or", "not"}, words...)
+}
+
+// selectorRelations are the spatial keywords usable after (or instead of) a
+// subject, e.g. `textfield below "Email"` or `inside (role=cell)`.
+var selectorRelations = map[string]string{
+	"near": "near", "below": "below", "above": "above",
+	"right-of": "right-of", "rightof": "right-of", "left-of": "left-of", "leftof": "left-of",
+	"inside": "inside",
+}
+
+// selectorRelationTolerance absorbs rounding in frames reported by idb.
+const selectorRelationTolerance = 2.0
+
+// selectorNode is a parsed --select expression. Op is one of
+// or|and|not|rel|cmp|bool|role|text|has. For rel, Cmp is the relation, Left
+// the optional subject, and Value (or Right for inside) the anchor.
+type selectorNode struct {
+	Op    string
+	Left  *selectorNode
+	Right *selectorNode
+	Attr  string
+	Cmp   string
+	Value string
+}
+
+type selectorToken struct {
+	Kind  string // ident|string|op|eof
+	Text  string
+	Pos   int
+	Quote bool
+}
+
+type selectorParser struct {
+	expr   string
+	tokens []selectorToken
+	pos    int
+}
+
+func selectorSyntaxError(expr string, pos int, msg string) error {
+	return &AppError{
+		Code:    "SELECTOR_SYNTAX",
+		Message: fmt.Sprintf("selector syntax error at position %d: %s", pos+1, msg),
+		Details: map[string]any{
+			"select":   expr,
+			"position": pos + 1,
+			"caret":    expr + "\n" + strings.Repeat(" ", pos) + "^",
+		},
 	}
-	return palette[index%len(palette)]
 }
 
-func annotationTextColor(bg color.RGBA) color.RGBA {
-	brightness := int(bg.R)*299 + int(bg.G)*587 + int(bg.B)*114
-	if brightness >= 140000 {
-		return color.RGBA{R: 0, G: 0, B: 0, A: 255}
+func tokenizeSelector(expr string) ([]selectorToken, error) {
+	runes := []rune(expr)
+	tokens := []selectorToken{}
+	i := 0
+	for i < len(runes) {
+		ch := runes[i]
+		switch {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '"' || ch == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					sb.WriteRune(runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == ch {
+					closed = true
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			if !closed {
+				return nil, selectorSyntaxError(expr, start, "unterminated string")
+			}
+			tokens = append(tokens, selectorToken{Kind: "string", Text: sb.String(), Pos: start, Quote: true})
+		case strings.ContainsRune("()", ch):
+			tokens = append(tokens, selectorToken{Kind: "op", Text: string(ch), Pos: i})
+			i++
+		case strings.ContainsRune("&|!=~^$<>", ch):
+			start := i
+			two := ""
+			if i+1 < len(runes) {
+				two = string(runes[i : i+2])
+			}
+			switch two {
+			case "&&", "||", "!=", "~=", "^=", "$=", "<=", ">=":
+				tokens = append(tokens, selectorToken{Kind: "op", Text: two, Pos: start})
+				i += 2
+				continue
+			}
+			if ch == '&' || ch == '|' || ch == '~' || ch == '^' || ch == '$' {
+				return nil, selectorSyntaxError(expr, start, fmt.Sprintf("unexpected %q", string(ch)))
+			}
+			tokens = append(tokens, selectorToken{Kind: "op", Text: string(ch), Pos: start})
+			i++
+		case unicode.IsLetter(ch) || unicode.IsDigit(ch) || ch == '_' || ch == '-' || ch == '.':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, selectorToken{Kind: "ident", Text: string(runes[start:i]), Pos: start})
+		default:
+			return nil, selectorSyntaxError(expr, i, fmt.Sprintf("unexpected %q", string(ch)))
+		}
 	}
-	return color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	tokens = append(tokens, selectorToken{Kind: "eof", Pos: len(runes)})
+	return tokens, nil
 }
 
-func imageSize(path string) (image.Point, error) {
-	f, err := os.Open(path)
+// parseSelectorExpr parses a --select expression such as
+// `role=button && label~="Next" && visible && !offscreen` or
+// `textfield near "Email"`.
+func parseSelectorExpr(expr string) (*selectorNode, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, selectorSyntaxError(expr, 0, "empty selector")
+	}
+	tokens, err := tokenizeSelector(expr)
 	if err != nil {
-		return image.Point{}, err
+		return nil, err
 	}
-	defer f.Close()
-	cfg, format, err := image.DecodeConfig(f)
+	p := &selectorParser{expr: expr, tokens: tokens}
+	node, err := p.parseOr()
 	if err != nil {
-		return image.Point{}, err
+		return nil, err
 	}
-	_ = format
-	return image.Pt(cfg.Width, cfg.Height), nil
+	if tok := p.peek(); tok.Kind != "eof" {
+		return nil, p.errorAt(tok, fmt.Sprintf("unexpected %q", tok.Text))
+	}
+	return node, nil
 }
 
-func (a *App) fail(err error, emitJSON bool, stderr io.Writer) int {
-	appErr := toAppError(err)
-	if emitJSON {
-		a.printJSON(ErrorEnvelope{OK: false, Error: appErr})
-		return 1
-	}
-	fmt.Fprintf(stderr, "error [%s]: %s\n", appErr.Code, appErr.Message)
-	if len(appErr.Details) > 0 {
-		if b, marshalErr := json.MarshalIndent(appErr.Details, "", "  "); marshalErr == nil {
-			fmt.Fprintf(stderr, "%s\n", string(b))
-		}
-	}
-	return 1
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.pos]
 }
 
-func (a *App) printJSON(v any) {
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	_ = enc.Encode(v)
+func (p *selectorParser) next() selectorToken {
+	tok := p.tokens[p.pos]
+	if tok.Kind != "eof" {
+		p.pos++
+	}
+	return tok
 }
 
-func (a *App) logf(format string, args ...any) {
-	if a.opts.Quiet {
-		return
+func (p *selectorParser) errorAt(tok selectorToken, msg string) error {
+	if tok.Kind == "eof" {
+		msg = "unexpected end of selector"
 	}
-	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	return selectorSyntaxError(p.expr, tok.Pos, msg)
 }
 
-func configDir() (string, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return "", wrapErr("IO_ERROR", "failed to resolve home directory", err)
+func (p *selectorParser) isKeyword(tok selectorToken, words ...string) bool {
+	if tok.Kind == "op" {
+		for _, w := range words {
+			if tok.Text == w {
+				return true
+			}
+		}
+		return false
 	}
-	dir := filepath.Join(home, ".config", "simagent")
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return "", wrapErr("IO_ERROR", "failed to create config directory", err)
+	if tok.Kind != "ident" {
+		return false
 	}
-	return dir, nil
+	for _, w := range words {
+		if strings.EqualFold(tok.Text, w) {
+			return true
+		}
+	}
+	return false
 }
 
-func configPath() (string, error) {
-	dir, err := configDir()
+func (p *selectorParser) parseOr() (*selectorNode, error) {
+	left, err := p.parseAnd()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return filepath.Join(dir, "config.json"), nil
+	for p.isKeyword(p.peek(), "||", "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &selectorNode{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
 }
 
-func lastFramePath() (string, error) {
-	dir, err := configDir()
+func (p *selectorParser) parseAnd() (*selectorNode, error) {
+	left, err := p.parseUnary()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return filepath.Join(dir, "last_frame.json"), nil
+	for p.isKeyword(p.peek(), "&&", "and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &selectorNode{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
 }
 
-func loadConfig() (Config, error) {
-	path, err := configPath()
-	if err != nil {
-		return Config{}, err
-	}
-	b, err := os.ReadFile(path)
-	if errors.Is(err, os.ErrNotExist) {
-		return Config{}, nil
+func (p *selectorParser) parseUnary() (*selectorNode, error) {
+	if p.isKeyword(p.peek(), "!", "not") {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &selectorNode{Op: "not", Left: inner}, nil
 	}
+	return p.parsePostfix()
+}
+
+func (p *selectorParser) parsePostfix() (*selectorNode, error) {
+	node, err := p.parsePrimary()
 	if err != nil {
-		return Config{}, wrapErr("IO_ERROR", "failed to read config", err)
+		return nil, err
 	}
-	var cfg Config
-	if err := json.Unmarshal(b, &cfg); err != nil {
-		return Config{}, wrapErr("IO_ERROR", "failed to parse config", err)
+	for {
+		tok := p.peek()
+		relation, ok := selectorRelations[strings.ToLower(tok.Text)]
+		if tok.Kind != "ident" || !ok {
+			return node, nil
+		}
+		p.next()
+		rel, err := p.parseRelation(relation, node)
+		if err != nil {
+			return nil, err
+		}
+		node = rel
 	}
-	return cfg, nil
 }
 
-func saveConfig(cfg Config) error {
-	path, err := configPath()
-	if err != nil {
-		return err
+func (p *selectorParser) parseRelation(relation string, subject *selectorNode) (*selectorNode, error) {
+	tok := p.peek()
+	if relation == "inside" && tok.Kind == "op" && tok.Text == "(" {
+		p.next()
+		container, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.Kind != "op" || closing.Text != ")" {
+			return nil, p.errorAt(closing, "expected \")\"")
+		}
+		return &selectorNode{Op: "rel", Cmp: relation, Left: subject, Right: container}, nil
 	}
-	b, err := json.MarshalIndent(cfg, "", "  ")
-	if err != nil {
-		return wrapErr("IO_ERROR", "failed to encode config", err)
+	p.next()
+	if tok.Kind != "string" {
+		return nil, p.errorAt(tok, relation+" expects a quoted anchor text")
 	}
-	if err := os.WriteFile(path, b, 0o644); err != nil {
-		return wrapErr("IO_ERROR", "failed to write config", err)
+	node := &selectorNode{Op: "rel", Cmp: relation, Left: subject, Value: tok.Text}
+	if relation == "inside" {
+		node.Right = &selectorNode{Op: "text", Value: tok.Text}
 	}
-	return nil
+	return node, nil
 }
 
-func saveLastFrame(frame LastFrame) error {
-	path, err := lastFramePath()
-	if err != nil {
-		return err
+func (p *selectorParser) parsePrimary() (*selectorNode, error) {
+	tok := p.next()
+	switch tok.Kind {
+	case "string":
+		return &selectorNode{Op: "text", Value: tok.Text}, nil
+	case "op":
+		if tok.Text != "(" {
+			return nil, p.errorAt(tok, fmt.Sprintf("unexpected %q", tok.Text))
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.Kind != "op" || closing.Text != ")" {
+			return nil, p.errorAt(closing, "expected \")\"")
+		}
+		return inner, nil
+	case "ident":
+		if p.isKeyword(tok, "and", "or", "not") {
+			return nil, p.errorAt(tok, fmt.Sprintf("unexpected keyword %q", tok.Text))
+		}
+		if relation, ok := selectorRelations[strings.ToLower(tok.Text)]; ok {
+			if next := p.peek(); next.Kind == "string" || (next.Kind == "op" && next.Text == "(") {
+				return p.parseRelation(relation, nil)
+			}
+		}
+		return p.parseAttr(tok)
+	default:
+		return nil, p.errorAt(tok, "expected attribute, role or quoted text")
 	}
-	b, err := json.MarshalIndent(frame, "", "  ")
-	if err != nil {
-		return wrapErr("IO_ERROR", "failed to encode last_frame", err)
+}
+
+func (p *selectorParser) parseAttr(tok selectorToken) (*selectorNode, error) {
+	attr := strings.ToLower(tok.Text)
+	op := p.peek()
+	isCmp := false
+	if op.Kind == "op" {
+		switch op.Text {
+		case "=", "!=", "~=", "^=", "$=", "<", "<=", ">", ">=":
+			isCmp = true
+		}
 	}
-	if err := os.WriteFile(path, b, 0o644); err != nil {
-		return wrapErr("IO_ERROR", "failed to write last_frame", err)
+	if !isCmp {
+		switch {
+		case selectorBoolAttrs[attr]:
+			return &selectorNode{Op: "bool", Attr: attr}, nil
+		case selectorStringAttrs[attr]:
+			return &selectorNode{Op: "has", Attr: attr}, nil
+		case selectorNumberAttrs[attr]:
+			return nil, p.errorAt(op, fmt.Sprintf("%s requires a comparison", tok.Text))
+		default:
+			role := normalizeSelectorRole(tok.Text)
+			if !selectorKnownRoles[role] {
+				return nil, p.errorAt(tok, fmt.Sprintf("unknown role or keyword %q (roles: %s; keywords: %s); use role=%s for roles not listed",
+					tok.Text, strings.Join(sortedSetKeys(selectorKnownRoles), ", "), strings.Join(selectorKeywordList(), ", "), tok.Text))
+			}
+			return &selectorNode{Op: "role", Value: role}, nil
+		}
 	}
-	return nil
+	p.next()
+	valueTok := p.next()
+	if valueTok.Kind != "string" && valueTok.Kind != "ident" {
+		return nil, p.errorAt(valueTok, fmt.Sprintf("expected value after %q", op.Text))
+	}
+	switch {
+	case selectorStringAttrs[attr]:
+		switch op.Text {
+		case "=", "!=", "~=", "^=", "$=":
+		default:
+			return nil, p.errorAt(op, fmt.Sprintf("operator %q is not valid for %s", op.Text, tok.Text))
+		}
+	case selectorNumberAttrs[attr]:
+		switch op.Text {
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return nil, p.errorAt(op, fmt.Sprintf("operator %q is not valid for %s", op.Text, tok.Text))
+		}
+		if _, err := strconv.ParseFloat(valueTok.Text, 64); err != nil {
+			return nil, p.errorAt(valueTok, fmt.Sprintf("%s expects a number", tok.Text))
+		}
+	case selectorBoolAttrs[attr]:
+		if op.Text != "=" && op.Text != "!=" {
+			return nil, p.errorAt(op, fmt.Sprintf("operator %q is not valid for %s", op.Text, tok.Text))
+		}
+		if _, err := strconv.ParseBool(strings.ToLower(valueTok.Text)); err != nil {
+			return nil, p.errorAt(valueTok, fmt.Sprintf("%s expects true or false", tok.Text))
+		}
+	default:
+		return nil, p.errorAt(tok, fmt.Sprintf("unknown attribute %q", tok.Text))
+	}
+	return &selectorNode{Op: "cmp", Attr: attr, Cmp: op.Text, Value: valueTok.Text}, nil
+}
+
+// normalizeSelectorRole folds "AXTextField", "text_field" and "TextField" to
+// "textfield" so role comparisons ignore accessibility prefixes and casing.
+func normalizeSelectorRole(role string) string {
+	r := strings.ToLower(strings.TrimSpace(role))
+	r = strings.TrimPrefix(r, "ax")
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(r)
+}
+
+type selectorContext struct {
+	elements  []Element
+	anchors   map[string][]Element
+	normalize bool
 }
 
-func loadLastFrame() (LastFrame, error) {
-	path, err := lastFramePath()
-	if err != nil {
-		return LastFrame{}, err
+func newSelectorContext(elements []Element) *selectorContext {
+	return &selectorContext{elements: elements, anchors: map[string][]Element{}}
+}
+
+func (c *selectorContext) fold(s string) string {
+	return foldSelectorText(s, c.normalize)
+}
+
+// anchorsFor returns elements whose text matches anchor, preferring exact
+// label/value matches over substring matches.
+func (c *selectorContext) anchorsFor(anchor string) []Element {
+	key := c.fold(anchor)
+	if cached, ok := c.anchors[key]; ok {
+		return cached
 	}
-	b, err := os.ReadFile(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return LastFrame{}, &AppError{Code: "NO_LAST_FRAME", Message: "no last frame found; run `simagent frame` first"}
+	exact := []Element{}
+	partial := []Element{}
+	for _, elem := range c.elements {
+		label := c.fold(elem.Label)
+		value := c.fold(elem.Value)
+		if label == key || value == key {
+			exact = append(exact, elem)
+			continue
+		}
+		if key != "" && (strings.Contains(label, key) || strings.Contains(value, key)) {
+			partial = append(partial, elem)
 		}
-		return LastFrame{}, wrapErr("IO_ERROR", "failed to read last_frame", err)
 	}
-	var frame LastFrame
-	if err := json.Unmarshal(b, &frame); err != nil {
-		return LastFrame{}, wrapErr("IO_ERROR", "failed to parse last_frame", err)
+	out := exact
+	if len(out) == 0 {
+		out = partial
 	}
-	return frame, nil
+	c.anchors[key] = out
+	return out
 }
 
-func loadElementsAndTransform(from string) ([]Element, Transform, error) {
-	elementsPath := from
-	transformPath := ""
-	if strings.TrimSpace(elementsPath) == "" {
-		last, err := loadLastFrame()
-		if err != nil {
-			return nil, Transform{}, err
+// containersFor returns the elements matching an `inside` container query.
+func (c *selectorContext) containersFor(query *selectorNode) []Element {
+	out := []Element{}
+	for _, elem := range c.elements {
+		if ok, _ := query.match(elem, c); ok {
+			out = append(out, elem)
 		}
-		elementsPath = last.Elements
-		transformPath = last.Transform
-	} else {
-		transformPath = filepath.Join(filepath.Dir(elementsPath), "transform.json")
 	}
+	return out
+}
 
-	elemBytes, err := os.ReadFile(elementsPath)
-	if err != nil {
-		return nil, Transform{}, wrapErr("IO_ERROR", "failed to read elements json", err)
-	}
-	var elements []Element
-	if err := json.Unmarshal(elemBytes, &elements); err != nil {
-		return nil, Transform{}, wrapErr("IO_ERROR", "failed to parse elements json", err)
+// relationDistance reports whether elem lies in the given direction of anchor
+// and how far away it is. Directional relations require the frames to overlap
+// on the other axis so `below "Email"` means underneath, not anywhere lower.
+func relationDistance(relation string, elem, anchor FrameRect) (float64, bool) {
+	tol := selectorRelationTolerance
+	switch relation {
+	case "near":
+		return rectDistance(elem, anchor), true
+	case "below":
+		if elem.Y < anchor.Y+anchor.H-tol || spanOverlap(elem.X, elem.W, anchor.X, anchor.W) <= 0 {
+			return 0, false
+		}
+		return math.Max(0, elem.Y-(anchor.Y+anchor.H)), true
+	case "above":
+		if elem.Y+elem.H > anchor.Y+tol || spanOverlap(elem.X, elem.W, anchor.X, anchor.W) <= 0 {
+			return 0, false
+		}
+		return math.Max(0, anchor.Y-(elem.Y+elem.H)), true
+	case "right-of":
+		if elem.X < anchor.X+anchor.W-tol || spanOverlap(elem.Y, elem.H, anchor.Y, anchor.H) <= 0 {
+			return 0, false
+		}
+		return math.Max(0, elem.X-(anchor.X+anchor.W)), true
+	case "left-of":
+		if elem.X+elem.W > anchor.X+tol || spanOverlap(elem.Y, elem.H, anchor.Y, anchor.H) <= 0 {
+			return 0, false
+		}
+		return math.Max(0, anchor.X-(elem.X+elem.W)), true
+	case "inside":
+		if elem.X < anchor.X-tol || elem.Y < anchor.Y-tol || elem.X+elem.W > anchor.X+anchor.W+tol || elem.Y+elem.H > anchor.Y+anchor.H+tol {
+			return 0, false
+		}
+		return 0, true
 	}
+	return 0, false
+}
 
-	var transform Transform
-	if transformBytes, err := os.ReadFile(transformPath); err == nil {
-		_ = json.Unmarshal(transformBytes, &transform)
-	}
-	return elements, transform, nil
+func spanOverlap(aStart, aLen, bStart, bLen float64) float64 {
+	return math.Min(aStart+aLen, bStart+bLen) - math.Max(aStart, bStart)
 }
 
-func pickElement(elements []Element, index int, id string) (Element, error) {
-	if index >= 0 {
-		for _, e := range elements {
-			if e.Index == index {
-				return e, nil
+// match reports whether elem satisfies the node. The returned distance is the
+// anchor distance of any spatial relation involved (0 when none).
+func (n *selectorNode) match(elem Element, ctx *selectorContext) (bool, float64) {
+	switch n.Op {
+	case "or":
+		if ok, dist := n.Left.match(elem, ctx); ok {
+			return true, dist
+		}
+		return n.Right.match(elem, ctx)
+	case "and":
+		ok, leftDist := n.Left.match(elem, ctx)
+		if !ok {
+			return false, 0
+		}
+		ok, rightDist := n.Right.match(elem, ctx)
+		if !ok {
+			return false, 0
+		}
+		return true, math.Max(leftDist, rightDist)
+	case "not":
+		ok, _ := n.Left.match(elem, ctx)
+		return !ok, 0
+	case "rel":
+		innerDist := 0.0
+		if n.Left != nil {
+			ok, dist := n.Left.match(elem, ctx)
+			if !ok {
+				return false, 0
 			}
+			innerDist = dist
 		}
-		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: fmt.Sprintf("element index not found: %d", index)}
-	}
-	if id != "" {
-		for _, e := range elements {
-			if e.ID == id {
-				return e, nil
+		var anchors []Element
+		if n.Cmp == "inside" {
+			anchors = ctx.containersFor(n.Right)
+		} else {
+			anchors = ctx.anchorsFor(n.Value)
+		}
+		best := math.Inf(1)
+		for _, anchor := range anchors {
+			if anchor.Index == elem.Index {
+				continue
+			}
+			if dist, ok := relationDistance(n.Cmp, elem.Frame, anchor.Frame); ok {
+				best = math.Min(best, dist)
 			}
 		}
-		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "element id not found: " + id}
+		if math.IsInf(best, 1) || (n.Cmp == "near" && best > selectorNearMaxDistance) {
+			return false, 0
+		}
+		return true, math.Max(best, innerDist)
+	case "role":
+		return normalizeSelectorRole(elem.Role) == n.Value, 0
+	case "text":
+		return strings.Contains(ctx.fold(elementText(elem)), ctx.fold(n.Value)), 0
+	case "has":
+		return selectorStringAttr(elem, n.Attr) != "", 0
+	case "bool":
+		return selectorBoolAttr(elem, n.Attr), 0
+	case "cmp":
+		return n.compare(elem, ctx), 0
 	}
-	return Element{}, &AppError{Code: "USAGE", Message: "index or id is required"}
+	return false, 0
 }
 
-type uiTypeOptions struct {
-	Text              string
-	Into              bool
-	Index             int
-	ID                string
-	Label             string
-	Contains          string
-	From              string
-	Replace           bool
-	ASCII             bool
-	Paste             bool
-	FocusRetries      int
-	Verify            bool
-	JSON              bool
-	LegacyTypeParsing bool
+func (n *selectorNode) compare(elem Element, ctx *selectorContext) bool {
+	switch {
+	case selectorBoolAttrs[n.Attr]:
+		want, _ := strconv.ParseBool(strings.ToLower(n.Value))
+		got := selectorBoolAttr(elem, n.Attr)
+		if n.Cmp == "!=" {
+			return got != want
+		}
+		return got == want
+	case selectorNumberAttrs[n.Attr]:
+		want, _ := strconv.ParseFloat(n.Value, 64)
+		got := selectorNumberAttr(elem, n.Attr)
+		switch n.Cmp {
+		case "=":
+			return got == want
+		case "!=":
+			return got != want
+		case "<":
+			return got < want
+		case "<=":
+			return got <= want
+		case ">":
+			return got > want
+		case ">=":
+			return got >= want
+		}
+		return false
+	}
+	got := ctx.fold(selectorStringAttr(elem, n.Attr))
+	want := ctx.fold(n.Value)
+	if n.Attr == "role" {
+		got = normalizeSelectorRole(got)
+		want = normalizeSelectorRole(want)
+	}
+	switch n.Cmp {
+	case "=":
+		return got == want
+	case "!=":
+		return got != want
+	case "~=":
+		return strings.Contains(got, want)
+	case "^=":
+		return strings.HasPrefix(got, want)
+	case "$=":
+		return strings.HasSuffix(got, want)
+	}
+	return false
 }
 
-type elementSnapshot struct {
-	Elements         []Element
-	AllCount         int
-	InteractiveCount int
+func selectorStringAttr(elem Element, attr string) string {
+	switch attr {
+	case "id":
+		return strings.TrimSpace(elem.ID)
+	case "role":
+		return strings.TrimSpace(elem.Role)
+	case "label":
+		return strings.TrimSpace(elem.Label)
+	case "value":
+		return strings.TrimSpace(elem.Value)
+	case "nearbylabel":
+		return strings.TrimSpace(elem.NearbyLabel)
+	case "text":
+		return strings.TrimSpace(elementText(elem))
+	}
+	return ""
 }
 
-func countElementSelectors(index int, id, label, contains string) int {
-	count := 0
-	if index >= 0 {
-		count++
-	}
-	if strings.TrimSpace(id) != "" {
-		count++
-	}
-	if strings.TrimSpace(label) != "" {
-		count++
-	}
-	if strings.TrimSpace(contains) != "" {
-		count++
+func selectorNumberAttr(elem Element, attr string) float64 {
+	switch attr {
+	case "index":
+		return float64(elem.Index)
+	case "x":
+		return elem.Frame.X
+	case "y":
+		return elem.Frame.Y
+	case "w":
+		return elem.Frame.W
+	case "h":
+		return elem.Frame.H
+	}
+	return 0
+}
+
+func selectorBoolAttr(elem Element, attr string) bool {
+	switch attr {
+	case "enabled":
+		return elem.Enabled
+	case "focused":
+		return elem.Focused
+	case "visible":
+		return elem.Visible
+	case "offscreen":
+		return elem.Offscreen
+	case "interactive":
+		return isInteractiveRole(elem.Role)
+	case "input":
+		return isTextInputRole(elem.Role)
 	}
-	return count
+	return false
 }
 
-func pickElementBySelectors(elements []Element, index int, id, label, contains string) (Element, error) {
-	label = strings.TrimSpace(label)
-	contains = strings.TrimSpace(contains)
-	id = strings.TrimSpace(id)
-	switch countElementSelectors(index, id, label, contains) {
-	case 0:
-		return Element{}, &AppError{Code: "USAGE", Message: "selector is required: --index|--id|--label|--contains"}
-	case 1:
-		if index >= 0 || id != "" {
-			return pickElement(elements, index, id)
+// rectDistance is the gap between two frames, 0 when they overlap.
+func rectDistance(a, b FrameRect) float64 {
+	dx := math.Max(0, math.Max(a.X-(b.X+b.W), b.X-(a.X+a.W)))
+	dy := math.Max(0, math.Max(a.Y-(b.Y+b.H), b.Y-(a.Y+a.H)))
+	return math.Hypot(dx, dy)
+}
+
+func matchSelectorElements(elements []Element, query *selectorNode) []Element {
+	ctx := newSelectorContext(elements)
+	out := []Element{}
+	for _, elem := range elements {
+		if ok, _ := query.match(elem, ctx); ok {
+			out = append(out, elem)
 		}
-		return pickElementByText(elements, label, contains)
-	default:
-		return Element{}, &AppError{Code: "USAGE", Message: "choose only one selector: --index|--id|--label|--contains"}
 	}
+	return out
 }
 
-func pickElementByText(elements []Element, exactLabel, partial string) (Element, error) {
-	exactLabel = strings.ToLower(strings.TrimSpace(exactLabel))
-	partial = strings.ToLower(strings.TrimSpace(partial))
-	type candidate struct {
-		Element Element
-		Score   int
-	}
-	candidates := make([]candidate, 0)
+// rankSelectExprCandidates ranks matches for a parsed --select expression:
+// closest to its `near` anchor first, then by the usual score.
+func rankSelectExprCandidates(elements []Element, query *selectorNode, normalize bool) []elementCandidate {
+	ctx := newSelectorContext(elements)
+	ctx.normalize = normalize
+	candidates := []elementCandidate{}
 	for _, elem := range elements {
-		if !elem.Enabled {
+		ok, dist := query.match(elem, ctx)
+		if !ok {
 			continue
 		}
-		score := 0
-		if exactLabel != "" {
-			exactHit := false
-			if strings.EqualFold(strings.TrimSpace(elem.Label), exactLabel) {
-				exactHit = true
-				score += 90
-			}
-			if strings.EqualFold(strings.TrimSpace(elem.Value), exactLabel) {
-				exactHit = true
-				score += 75
-			}
-			if strings.EqualFold(strings.TrimSpace(elem.NearbyLabel), exactLabel) {
-				exactHit = true
-				score += 55
-			}
-			if !exactHit {
-				continue
-			}
-		}
-		if partial != "" {
-			text := strings.ToLower(elementText(elem))
-			if !strings.Contains(text, partial) {
-				continue
-			}
-			score += 45
-		}
-		if elem.Visible {
-			score += 24
-		}
-		if !elem.Offscreen {
-			score += 10
-		}
-		if isInteractiveRole(elem.Role) {
-			score += 15
-		}
-		if strings.TrimSpace(elem.Label) != "" {
-			score += 8
+		parts := baseElementScoreParts(elem)
+		if elem.Enabled {
+			parts["enabled"] = 20
 		}
-		candidates = append(candidates, candidate{Element: elem, Score: score})
+		candidates = append(candidates, elementCandidate{Element: elem, Score: sumScoreParts(parts), Distance: dist, Breakdown: parts})
 	}
-	if len(candidates) == 0 {
-		if exactLabel != "" {
-			return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "element label not found: " + exactLabel}
-		}
-		return Element{}, &AppError{Code: "ELEMENT_NOT_FOUND", Message: "element text not found: " + partial}
+	sortCandidates(candidates)
+	return candidates
+}
+
+// baseElementScoreParts is the selector-independent part of candidate
+// ranking: prefer visible, on-screen, interactive, labelled elements.
+func baseElementScoreParts(elem Element) map[string]int {
+	parts := map[string]int{}
+	if elem.Visible {
+		parts["visible"] = 24
 	}
-	sort.Slice(candidates, func(i, j int) bool {
-		if candidates[i].Score != candidates[j].Score {
-			return candidates[i].Score > candidates[j].Score
-		}
-		return candidates[i].Element.Index < candidates[j].Element.Index
-	})
-	return candidates[0].Element, nil
+	if !elem.Offscreen {
+		parts["onscreen"] = 10
+	}
+	if isInteractiveRole(elem.Role) {
+		parts["interactive"] = 15
+	}
+	if strings.TrimSpace(elem.Label) != "" {
+		parts["hasLabel"] = 8
+	}
+	return parts
 }
 
 func pickSystemFallbackElement(elements []Element, label, contains string) (Element, bool) {
@@ -3022,9 +8595,38 @@ func containsAnyToken(s string, tokens []string) bool {
 	return false
 }
 
+// parseInterspersedFlags parses fs like fs.Parse but keeps going past
+// positional arguments, so `ui key tab --repeat 2` sees --repeat. The
+// positionals are left in fs.Args() in their original order.
+func parseInterspersedFlags(fs *flag.FlagSet, args []string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return fs.Parse(append([]string{"--"}, positional...))
+}
+
 func parseUITypeArgs(args []string) (uiTypeOptions, error) {
-	opts := uiTypeOptions{Index: -1, FocusRetries: 2}
+	opts := uiTypeOptions{Index: -1, FocusRetries: 2, Chunking: defaultInputChunking, ClearStrategy: clearStrategyAuto, Expect: actionExpectation{Timeout: defaultExpectTimeout}}
 	positionals := make([]string, 0)
+	filterFlags := map[string]*string{
+		"--role":        &opts.Role,
+		"--below":       &opts.Below,
+		"--above":       &opts.Above,
+		"--right-of":    &opts.RightOf,
+		"--left-of":     &opts.LeftOf,
+		"--inside":      &opts.Inside,
+		"--expect-text": &opts.Expect.Text,
+		"--expect-gone": &opts.Expect.Gone,
+	}
 
 	nextValue := func(i *int, name string) (string, error) {
 		if *i+1 >= len(args) {
@@ -3047,6 +8649,8 @@ func parseUITypeArgs(args []string) (uiTypeOptions, error) {
 			opts.Paste = true
 		case arg == "--verify":
 			opts.Verify = true
+		case arg == "--submit":
+			opts.Submit = true
 		case arg == "--json":
 			opts.JSON = true
 		case arg == "--legacy-type-parsing":
@@ -3109,6 +8713,131 @@ func parseUITypeArgs(args []string) (uiTypeOptions, error) {
 			opts.Contains = raw
 		case strings.HasPrefix(arg, "--contains="):
 			opts.Contains = strings.TrimPrefix(arg, "--contains=")
+		case arg == "--first":
+			opts.First = true
+		case arg == "--last":
+			opts.Last = true
+		case arg == "--explain":
+			opts.Explain = true
+		case arg == "--normalize":
+			opts.Normalize = true
+		case arg == "--expect-change":
+			opts.Expect.Change = true
+		case arg == "--strategy" || strings.HasPrefix(arg, "--strategy="):
+			raw := strings.TrimPrefix(arg, "--strategy=")
+			if arg == "--strategy" {
+				value, err := nextValue(&i, "--strategy")
+				if err != nil {
+					return opts, err
+				}
+				raw = value
+			}
+			if err := validateClearStrategy(raw); err != nil {
+				return opts, err
+			}
+			opts.ClearStrategy = raw
+		case arg == "--verify-mode" || strings.HasPrefix(arg, "--verify-mode="):
+			raw := strings.TrimPrefix(arg, "--verify-mode=")
+			if arg == "--verify-mode" {
+				value, err := nextValue(&i, "--verify-mode")
+				if err != nil {
+					return opts, err
+				}
+				raw = value
+			}
+			mode, err := parseVerifyMode(raw)
+			if err != nil {
+				return opts, err
+			}
+			opts.VerifyMode = mode
+		case arg == "--chunk-size" || strings.HasPrefix(arg, "--chunk-size="):
+			raw := strings.TrimPrefix(arg, "--chunk-size=")
+			if arg == "--chunk-size" {
+				value, err := nextValue(&i, "--chunk-size")
+				if err != nil {
+					return opts, err
+				}
+				raw = value
+			}
+			parsed, convErr := strconv.Atoi(strings.TrimSpace(raw))
+			if convErr != nil || parsed < 1 {
+				return opts, &AppError{Code: "USAGE", Message: "--chunk-size must be an integer >= 1"}
+			}
+			opts.Chunking.Size = parsed
+		case arg == "--chunk-delay" || strings.HasPrefix(arg, "--chunk-delay="):
+			raw := strings.TrimPrefix(arg, "--chunk-delay=")
+			if arg == "--chunk-delay" {
+				value, err := nextValue(&i, "--chunk-delay")
+				if err != nil {
+					return opts, err
+				}
+				raw = value
+			}
+			parsed, convErr := time.ParseDuration(strings.TrimSpace(raw))
+			if convErr != nil || parsed < 0 {
+				return opts, &AppError{Code: "USAGE", Message: "--chunk-delay must be a non-negative duration"}
+			}
+			opts.Chunking.Delay = parsed
+		case arg == "--expect-timeout" || strings.HasPrefix(arg, "--expect-timeout="):
+			raw := strings.TrimPrefix(arg, "--expect-timeout=")
+			if arg == "--expect-timeout" {
+				value, err := nextValue(&i, "--expect-timeout")
+				if err != nil {
+					return opts, err
+				}
+				raw = value
+			}
+			parsed, convErr := time.ParseDuration(strings.TrimSpace(raw))
+			if convErr != nil {
+				return opts, &AppError{Code: "USAGE", Message: "--expect-timeout must be a duration"}
+			}
+			opts.Expect.Timeout = parsed
+		case filterFlags[arg] != nil:
+			raw, err := nextValue(&i, arg)
+			if err != nil {
+				return opts, err
+			}
+			*filterFlags[arg] = raw
+		case strings.Contains(arg, "=") && filterFlags[arg[:strings.Index(arg, "=")]] != nil:
+			*filterFlags[arg[:strings.Index(arg, "=")]] = arg[strings.Index(arg, "=")+1:]
+		case arg == "--label-regex":
+			raw, err := nextValue(&i, "--label-regex")
+			if err != nil {
+				return opts, err
+			}
+			opts.LabelRegex = raw
+		case strings.HasPrefix(arg, "--label-regex="):
+			opts.LabelRegex = strings.TrimPrefix(arg, "--label-regex=")
+		case arg == "--value-regex":
+			raw, err := nextValue(&i, "--value-regex")
+			if err != nil {
+				return opts, err
+			}
+			opts.ValueRegex = raw
+		case strings.HasPrefix(arg, "--value-regex="):
+			opts.ValueRegex = strings.TrimPrefix(arg, "--value-regex=")
+		case arg == "--nth" || strings.HasPrefix(arg, "--nth="):
+			raw := strings.TrimPrefix(arg, "--nth=")
+			if arg == "--nth" {
+				value, err := nextValue(&i, "--nth")
+				if err != nil {
+					return opts, err
+				}
+				raw = value
+			}
+			parsed, convErr := strconv.Atoi(strings.TrimSpace(raw))
+			if convErr != nil || parsed < 1 {
+				return opts, &AppError{Code: "USAGE", Message: "--nth must be an integer >= 1"}
+			}
+			opts.Nth = parsed
+		case arg == "--select":
+			raw, err := nextValue(&i, "--select")
+			if err != nil {
+				return opts, err
+			}
+			opts.Select = raw
+		case strings.HasPrefix(arg, "--select="):
+			opts.Select = strings.TrimPrefix(arg, "--select=")
 		case arg == "--from":
 			raw, err := nextValue(&i, "--from")
 			if err != nil {
@@ -3135,6 +8864,9 @@ func parseUITypeArgs(args []string) (uiTypeOptions, error) {
 	opts.ID = strings.TrimSpace(opts.ID)
 	opts.Label = strings.TrimSpace(opts.Label)
 	opts.Contains = strings.TrimSpace(opts.Contains)
+	opts.Select = strings.TrimSpace(opts.Select)
+	opts.LabelRegex = strings.TrimSpace(opts.LabelRegex)
+	opts.ValueRegex = strings.TrimSpace(opts.ValueRegex)
 	opts.Text = strings.TrimSpace(opts.Text)
 	if opts.FocusRetries <= 0 {
 		return opts, &AppError{Code: "USAGE", Message: "--focus-retries must be >= 1"}
@@ -3194,6 +8926,24 @@ func isTextInputRole(role string) bool {
 }
 
 func (a *App) captureElements(udid string) (elementSnapshot, error) {
+	return a.captureElementsWithKeyboard(udid, a.includeKeyboard)
+}
+
+func (a *App) captureElementsWithKeyboard(udid string, includeKeyboard bool) (elementSnapshot, error) {
+	if a.batch == nil {
+		return a.captureElementsLive(udid, includeKeyboard)
+	}
+	if snapshot, ok := a.batch.cached(udid, includeKeyboard); ok {
+		return snapshot, nil
+	}
+	snapshot, err := a.captureElementsLive(udid, includeKeyboard)
+	if err == nil {
+		a.batch.store(udid, includeKeyboard, snapshot)
+	}
+	return snapshot, err
+}
+
+func (a *App) captureElementsLive(udid string, includeKeyboard bool) (elementSnapshot, error) {
 	cmd, err := a.runIDB(udid, "ui", "describe-all", "--json")
 	if err != nil {
 		return elementSnapshot{}, wrapAppErrCode(err, "IDB_UI_FAILED", "failed to capture ui tree")
@@ -3207,22 +8957,32 @@ func (a *App) captureElements(udid string) (elementSnapshot, error) {
 		InteractiveOnly: false,
 		IncludeRoles:    map[string]bool{},
 		ExcludeRoles:    map[string]bool{},
+		IncludeKeyboard: includeKeyboard,
 	}
-	elements, allCount, _ := normalizeElements(parsed, opts)
+	normalized := normalizeElements(parsed, opts)
 	interactiveVisible := 0
-	for _, elem := range elements {
+	for _, elem := range normalized.Elements {
 		if elem.Enabled && elem.Visible && isInteractiveRole(elem.Role) {
 			interactiveVisible++
 		}
 	}
+	screenW, screenH := screenSizeFromUI(parsed)
+	if screenW == 0 || screenH == 0 {
+		screenW, screenH = elementExtents(normalized.Elements)
+	}
 	return elementSnapshot{
-		Elements:         elements,
-		AllCount:         allCount,
+		Elements:         normalized.Elements,
+		AllCount:         normalized.AllCount,
 		InteractiveCount: interactiveVisible,
+		Keyboard:         normalized.Keyboard,
+		Alert:            normalized.Alert,
+		Screen:           FrameRect{W: screenW, H: screenH},
+		Hash:             hashElementSet(normalized.Elements),
 	}, nil
 }
 
-func (a *App) verifyTypeResult(udid, typedText string, focused *Element) (map[string]any, error) {
+func (a *App) verifyTypeResult(udid, typedText string, focused *Element, input textInputOptions) (map[string]any, error) {
+	mode := input.VerifyMode
 	snapshot, err := a.captureElements(udid)
 	if err != nil {
 		return nil, err
@@ -3236,15 +8996,36 @@ func (a *App) verifyTypeResult(udid, typedText string, focused *Element) (map[st
 	}
 
 	typedNorm := normalizeTextForMatch(typedText)
+	hasTyped := func(elem Element) bool {
+		if mode.Kind == "" {
+			return elementHasTypedText(elem, typedNorm)
+		}
+		return mode.holds(typedText, elem.Value) || mode.holds(typedText, elem.Label)
+	}
 	if target != nil {
-		if elementHasTypedText(*target, typedNorm) {
-			return map[string]any{
-				"elementId": target.ID,
-				"label":     target.Label,
-				"value":     target.Value,
-			}, nil
+		if isSecureTextInputRole(target.Role) {
+			// A secure value is a mask or a placeholder; comparing it as
+			// text would let a "Password" placeholder verify "Password".
+			baseline := input.SecureBaseline
+			if baseline < 0 && focused != nil {
+				baseline = secureBaselineFromValue(focused.Value)
+			}
+			if secureTypeVerified(typedText, target.Value, baseline) {
+				n, _ := secureBulletCount(target.Value)
+				return map[string]any{
+					"elementId":    target.ID,
+					"label":        target.Label,
+					"value":        target.Value,
+					"secureLength": n,
+				}, nil
+			}
+			return nil, &AppError{
+				Code:    "TYPE_VERIFY_FAILED",
+				Message: "secure field length does not match the typed length",
+				Details: secureTypeDetails(typedText, target.Value, baseline),
+			}
 		}
-		if isSecureTextInputRole(target.Role) && strings.TrimSpace(target.Value) != "" && strings.TrimSpace(target.Value) != strings.TrimSpace(focused.Value) {
+		if hasTyped(*target) {
 			return map[string]any{
 				"elementId": target.ID,
 				"label":     target.Label,
@@ -3253,8 +9034,21 @@ func (a *App) verifyTypeResult(udid, typedText string, focused *Element) (map[st
 		}
 	}
 
+	if mode.targetOnly() {
+		details := map[string]any{"typed": typedText, "verifyMode": mode.String(), "interactive": snapshot.InteractiveCount}
+		if target != nil {
+			details["elementId"] = target.ID
+			details["value"] = target.Value
+		}
+		return nil, &AppError{
+			Code:    "TYPE_VERIFY_FAILED",
+			Message: fmt.Sprintf("target field value does not satisfy --verify-mode %s", mode.String()),
+			Details: details,
+		}
+	}
+
 	for _, elem := range snapshot.Elements {
-		if elementHasTypedText(elem, typedNorm) {
+		if hasTyped(elem) {
 			return map[string]any{
 				"elementId": elem.ID,
 				"label":     elem.Label,
@@ -3266,7 +9060,7 @@ func (a *App) verifyTypeResult(udid, typedText string, focused *Element) (map[st
 	return nil, &AppError{
 		Code:    "TYPE_VERIFY_FAILED",
 		Message: "typed text could not be verified from latest ui tree",
-		Details: map[string]any{"typed": typedText, "interactive": snapshot.InteractiveCount},
+		Details: map[string]any{"typed": typedText, "verifyMode": mode.String(), "interactive": snapshot.InteractiveCount},
 	}
 }
 
@@ -3297,6 +9091,21 @@ func findBestVerificationTarget(elements []Element, focused Element) (Element, b
 	return best, found
 }
 
+// countTextMatches counts the enabled elements whose text contains needle,
+// using the same matching as matchingTextSamples.
+func countTextMatches(elements []Element, needle string) int {
+	if needle == "" {
+		return 0
+	}
+	n := 0
+	for _, elem := range elements {
+		if elem.Enabled && strings.Contains(strings.ToLower(elementText(elem)), needle) {
+			n++
+		}
+	}
+	return n
+}
+
 func matchingTextSamples(elements []Element, needle string) []string {
 	if needle == "" {
 		return nil
@@ -3348,14 +9157,29 @@ func isSecureTextInputRole(role string) bool {
 }
 
 func hasJSONFlag(args []string) bool {
+	return hasFlag(args, "--json")
+}
+
+func hasFlag(args []string, name string) bool {
 	for _, arg := range args {
-		if arg == "--json" {
+		if arg == name {
 			return true
 		}
 	}
 	return false
 }
 
+// stripFlag removes every occurrence of the boolean flag name from args.
+func stripFlag(args []string, name string) []string {
+	out := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg != name {
+			out = append(out, arg)
+		}
+	}
+	return out
+}
+
 func stripFirstJSON(args []string) []string {
 	out := make([]string, 0, len(args))
 	stripped := false
@@ -3389,6 +9213,17 @@ func csvSet(s string) map[string]bool {
 	return out
 }
 
+func sortedSetKeys(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k, v := range set {
+		if v {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
 func normalizeNegatedBools(args []string) []string {
 	repl := map[string]string{
 		"--no-screenshot":       "--screenshot=false",
@@ -1,6 +1,15 @@
 package main
 
-import "testing"
+import (
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestParseUITypeArgsInterspersedFlags(t *testing.T) {
 	opts, err := parseUITypeArgs([]string{"170", "--into", "--index", "3", "--verify"})
@@ -150,7 +159,7 @@ func TestPickElementByTextPrefersVisibleInteractive(t *testing.T) {
 		},
 	}
 
-	picked, err := pickElementByText(elements, "next", "")
+	picked, _, err := rankElementsBySelector(elements, elementSelector{Index: -1, Label: "next"})
 	if err != nil {
 		t.Fatalf("pick failed: %v", err)
 	}
@@ -177,3 +186,1081 @@ func TestClassifyVisibility(t *testing.T) {
 		t.Fatalf("expected invisible offscreen element, got visible=%v offscreen=%v", visible, offscreen)
 	}
 }
+
+func TestForegroundBundleIDFromLaunchctl(t *testing.T) {
+	out := "PID\tStatus\tLabel\n" +
+		"412\t0\tUIKitApplication:com.apple.Preferences[4a1c][rb-legacy]\n" +
+		"-\t0\tUIKitApplication:com.example.stale[11aa][rb-legacy]\n" +
+		"530\t0\tUIKitApplication:com.example.app[9f2e][rb-legacy]\n" +
+		"77\t0\tcom.apple.backboardd\n"
+	if got := foregroundBundleIDFromLaunchctl(out); got != "com.example.app" {
+		t.Fatalf("unexpected bundle id: %q", got)
+	}
+	if got := foregroundBundleIDFromLaunchctl("PID\tStatus\tLabel\n"); got != "" {
+		t.Fatalf("expected empty bundle id, got %q", got)
+	}
+}
+
+func TestDeriveTransformSafeAreaPortrait(t *testing.T) {
+	rawUI := []any{
+		map[string]any{"type": "Application", "frame": map[string]any{"x": 0.0, "y": 0.0, "width": 393.0, "height": 852.0}},
+		map[string]any{"type": "Button", "frame": map[string]any{"x": 20.0, "y": 100.0, "width": 100.0, "height": 44.0}},
+	}
+	transform := deriveTransform(rawUI, []Element{{Frame: FrameRect{X: 20, Y: 100, W: 100, H: 44}}}, image.Pt(1179, 2556), "com.apple.CoreSimulator.SimDeviceType.iPhone-15-Pro")
+	if transform.Screen.W != 393 || transform.Screen.H != 852 {
+		t.Fatalf("unexpected screen: %+v", transform.Screen)
+	}
+	if transform.Orientation != "portrait" {
+		t.Fatalf("unexpected orientation: %q", transform.Orientation)
+	}
+	if transform.SafeArea.Top != 59 || transform.SafeArea.Bottom != 34 || transform.SafeArea.Left != 0 {
+		t.Fatalf("unexpected safe area: %+v", transform.SafeArea)
+	}
+	if transform.Scale != 3 {
+		t.Fatalf("unexpected scale: %v", transform.Scale)
+	}
+}
+
+func TestDeriveTransformSafeAreaLandscape(t *testing.T) {
+	rawUI := []any{
+		map[string]any{"type": "Application", "frame": map[string]any{"x": 0.0, "y": 0.0, "width": 844.0, "height": 390.0}},
+	}
+	transform := deriveTransform(rawUI, nil, image.Point{}, "com.apple.CoreSimulator.SimDeviceType.iPhone-14")
+	if transform.Orientation != "landscape" {
+		t.Fatalf("unexpected orientation: %q", transform.Orientation)
+	}
+	if transform.SafeArea.Top != 0 || transform.SafeArea.Left != 47 || transform.SafeArea.Right != 47 || transform.SafeArea.Bottom != 21 {
+		t.Fatalf("unexpected safe area: %+v", transform.SafeArea)
+	}
+	x, y := swipeOrigin(transform)
+	if x != 422 || y != 184.5 {
+		t.Fatalf("unexpected swipe origin: %v,%v", x, y)
+	}
+}
+
+// uiNode builds a describe-all style node for normalizeElements fixtures;
+// pass pid to mark the owning process.
+func uiNode(role, label string, x, y, w, h float64, pid ...float64) map[string]any {
+	node := map[string]any{"type": role, "AXLabel": label, "frame": map[string]any{"x": x, "y": y, "width": w, "height": h}}
+	if len(pid) > 0 {
+		node["pid"] = pid[0]
+	}
+	return node
+}
+
+func keyboardTestUI() []any {
+	raw := []any{
+		uiNode("Application", "Demo", 0, 0, 390, 844),
+		uiNode("TextField", "Email", 20, 200, 350, 44),
+	}
+	for i, key := range []string{"q", "w", "e", "r", "t", "y", "u", "i", "o", "p"} {
+		raw = append(raw, uiNode("Key", key, 3+float64(i)*39, 560, 33, 42))
+	}
+	raw = append(raw, uiNode("Key", "shift", 3, 668, 42, 42), uiNode("Key", "delete", 345, 668, 42, 42))
+	return raw
+}
+
+func TestDetectKeyboardIgnoresPinPad(t *testing.T) {
+	raw := []any{uiNode("Application", "Demo", 0, 0, 390, 844)}
+	for i, digit := range []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "0"} {
+		raw = append(raw, uiNode("Button", digit, 40+float64(i%3)*110, 520+float64(i/3)*70, 90, 60))
+	}
+	raw = append(raw, uiNode("Button", "delete", 260, 730, 90, 60))
+	normalized := normalizeElements(raw, frameOptions{Order: "reading"})
+	if normalized.Keyboard.Visible {
+		t.Fatalf("PIN pad buttons must not be taken for the keyboard: %+v", normalized.Keyboard)
+	}
+	buttons := 0
+	for _, elem := range normalized.Elements {
+		if elem.Role == "Button" {
+			buttons++
+		}
+	}
+	if buttons != 11 {
+		t.Fatalf("PIN pad buttons must stay in elements, got %d", buttons)
+	}
+}
+
+func TestNormalizeElementsExcludesKeyboard(t *testing.T) {
+	opts := frameOptions{Order: "reading"}
+	normalized := normalizeElements(keyboardTestUI(), opts)
+	if !normalized.Keyboard.Visible || normalized.Keyboard.Frame == nil {
+		t.Fatal("expected visible keyboard")
+	}
+	if normalized.Keyboard.Frame.Y != 560 {
+		t.Fatalf("unexpected keyboard frame: %+v", *normalized.Keyboard.Frame)
+	}
+	for _, elem := range normalized.Elements {
+		if elem.Center.Y >= 560 {
+			t.Fatalf("keyboard key leaked into elements: %+v", elem)
+		}
+	}
+
+	opts.IncludeKeyboard = true
+	withKeys := normalizeElements(keyboardTestUI(), opts)
+	if len(withKeys.Elements) <= len(normalized.Elements) {
+		t.Fatalf("expected keys with --include-keyboard, got %d elements", len(withKeys.Elements))
+	}
+}
+
+func TestDetectAlertWithoutContainerNeedsSystemOwner(t *testing.T) {
+	primer := []any{
+		uiNode("Application", "Demo", 0, 0, 390, 844, 100),
+		uiNode("StaticText", "Turn on notifications?", 60, 360, 270, 40, 100),
+		uiNode("Button", "Not Now", 60, 466, 135, 44, 100),
+		uiNode("Button", "Allow", 195, 466, 135, 44, 100),
+	}
+	if alert := normalizeElements(primer, frameOptions{Order: "reading"}).Alert; alert != nil {
+		t.Fatalf("in-app primer must not be a system alert: %+v", alert)
+	}
+	prompt := []any{
+		uiNode("Application", "Demo", 0, 0, 390, 844, 100),
+		uiNode("StaticText", "“Demo” Would Like to Send You Notifications", 76, 346, 238, 40, 55),
+		uiNode("Button", "Don’t Allow", 60, 466, 135, 44, 55),
+		uiNode("Button", "Allow", 195, 466, 135, 44, 55),
+	}
+	alert := normalizeElements(prompt, frameOptions{Order: "reading"}).Alert
+	if alert == nil || len(alert.Buttons) != 2 {
+		t.Fatalf("expected SpringBoard prompt to be detected, got %+v", alert)
+	}
+}
+
+func TestDetectAlertFromContainer(t *testing.T) {
+	raw := []any{
+		uiNode("Application", "Demo", 0, 0, 390, 844),
+		uiNode("Alert", "", 60, 330, 270, 180),
+		uiNode("StaticText", "“Demo” Would Like to Send You Notifications", 76, 346, 238, 40),
+		uiNode("StaticText", "Notifications may include alerts.", 76, 390, 238, 36),
+		uiNode("Button", "Don’t Allow", 60, 466, 135, 44),
+		uiNode("Button", "Allow", 195, 466, 135, 44),
+	}
+	normalized := normalizeElements(raw, frameOptions{Order: "reading"})
+	alert := normalized.Alert
+	if alert == nil {
+		t.Fatal("expected alert")
+	}
+	if alert.Kind != "alert" || alert.Title != "“Demo” Would Like to Send You Notifications" || alert.Message != "Notifications may include alerts." {
+		t.Fatalf("unexpected alert: %+v", alert)
+	}
+	if len(alert.Buttons) != 2 {
+		t.Fatalf("unexpected buttons: %+v", alert.Buttons)
+	}
+
+	accept, err := pickAlertButton(alert, "accept", "")
+	if err != nil || accept.Label != "Allow" {
+		t.Fatalf("unexpected accept button: %+v err=%v", accept, err)
+	}
+	dismiss, err := pickAlertButton(alert, "dismiss", "")
+	if err != nil || dismiss.Label != "Don’t Allow" {
+		t.Fatalf("unexpected dismiss button: %+v err=%v", dismiss, err)
+	}
+	if _, err := pickAlertButton(alert, "tap", "Later"); err == nil {
+		t.Fatal("expected missing button error")
+	}
+}
+
+func TestPickElementBySelectExpr(t *testing.T) {
+	elements := []Element{
+		{Index: 0, Role: "StaticText", Label: "Email", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 100, W: 80, H: 20}},
+		{Index: 1, Role: "TextField", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 124, W: 350, H: 40}},
+		{Index: 2, Role: "StaticText", Label: "Password", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 180, W: 80, H: 20}},
+		{Index: 3, Role: "TextField", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 204, W: 350, H: 40}},
+		{Index: 4, Role: "AXButton", Label: "Next", Enabled: true, Visible: true, Offscreen: true, Frame: FrameRect{X: 20, Y: 900, W: 350, H: 44}},
+		{Index: 5, Role: "Button", Label: "Next step", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 700, W: 350, H: 44}},
+	}
+	cases := []struct {
+		expr string
+		want int
+	}{
+		{`role=button && label~="Next" && visible && !offscreen`, 5},
+		{`textfield near "Password"`, 3},
+		{`textfield near "Email"`, 1},
+		{`(label="Next" or label="Done") and offscreen`, 4},
+		{`"step"`, 5},
+		{`role=textfield && y >= 200`, 3},
+	}
+	for _, tc := range cases {
+		got, _, err := rankElementsBySelector(elements, elementSelector{Index: -1, Select: tc.expr})
+		if err != nil {
+			t.Fatalf("pick %q: %v", tc.expr, err)
+		}
+		if got.Index != tc.want {
+			t.Fatalf("%q: expected index %d, got %d", tc.expr, tc.want, got.Index)
+		}
+	}
+}
+
+func TestParseSelectorExprSyntaxErrors(t *testing.T) {
+	cases := map[string]int{
+		`role=button &&`:  15,
+		`label~="Next`:    8,
+		`role=button & x`: 13,
+		`(visible`:        9,
+		`x ~= 10`:         3,
+		`colour="red"`:    1,
+		`enabled = maybe`: 11,
+		`textfield near`:  15,
+	}
+	for expr, wantPos := range cases {
+		_, err := parseSelectorExpr(expr)
+		appErr, ok := err.(*AppError)
+		if !ok || appErr.Code != "SELECTOR_SYNTAX" {
+			t.Fatalf("%q: expected SELECTOR_SYNTAX, got %v", expr, err)
+		}
+		if pos := appErr.Details["position"]; pos != wantPos {
+			t.Fatalf("%q: expected position %d, got %v (%s)", expr, wantPos, pos, appErr.Message)
+		}
+	}
+}
+
+func TestParseSelectorExprUnknownWord(t *testing.T) {
+	for expr, wantPos := range map[string]int{`visble`: 1, `role=button && buton`: 16} {
+		_, err := parseSelectorExpr(expr)
+		appErr, ok := err.(*AppError)
+		if !ok || appErr.Code != "SELECTOR_SYNTAX" || appErr.Details["position"] != wantPos {
+			t.Fatalf("%q: expected SELECTOR_SYNTAX at %d, got %v", expr, wantPos, err)
+		}
+		for _, want := range []string{"pickerwheel", "visible", "near"} {
+			if !strings.Contains(appErr.Message, want) {
+				t.Fatalf("%q: message should list %q: %s", expr, want, appErr.Message)
+			}
+		}
+	}
+	for _, expr := range []string{`map`, `AXPickerWheel`, `role=customthing`} {
+		if _, err := parseSelectorExpr(expr); err != nil {
+			t.Fatalf("%q: unexpected error %v", expr, err)
+		}
+	}
+}
+
+func TestPickElementBySelectorAmbiguity(t *testing.T) {
+	elements := []Element{
+		{Index: 0, Role: "Button", Label: "Edit", Enabled: true, Visible: true, Frame: FrameRect{X: 300, Y: 100, W: 60, H: 44}},
+		{Index: 1, Role: "Button", Label: "Edit", Enabled: true, Visible: true, Frame: FrameRect{X: 300, Y: 160, W: 60, H: 44}},
+		{Index: 2, Role: "Button", Label: "Edit", Enabled: true, Visible: true, Frame: FrameRect{X: 300, Y: 220, W: 60, H: 44}},
+	}
+	_, err := pickElementBySelector(elements, elementSelector{Index: -1, Label: "Edit"})
+	appErr, ok := err.(*AppError)
+	if !ok || appErr.Code != "ELEMENT_AMBIGUOUS" {
+		t.Fatalf("expected ELEMENT_AMBIGUOUS, got %v", err)
+	}
+	if candidates := appErr.Details["candidates"].([]map[string]any); len(candidates) != 3 {
+		t.Fatalf("expected 3 candidates, got %d", len(candidates))
+	}
+
+	for _, tc := range []struct {
+		sel  elementSelector
+		want int
+	}{
+		{elementSelector{Index: -1, Label: "Edit", Nth: 2}, 1},
+		{elementSelector{Index: -1, Label: "Edit", First: true}, 0},
+		{elementSelector{Index: -1, Select: `label="Edit"`, Last: true}, 2},
+	} {
+		got, err := pickElementBySelector(elements, tc.sel)
+		if err != nil || got.Index != tc.want {
+			t.Fatalf("%+v: expected index %d, got %d err=%v", tc.sel, tc.want, got.Index, err)
+		}
+	}
+	if _, err := pickElementBySelector(elements, elementSelector{Index: -1, Label: "Edit", Nth: 4}); err == nil {
+		t.Fatal("expected out-of-range error")
+	}
+}
+
+func TestNormalizeMatchText(t *testing.T) {
+	cases := map[string]string{
+		"ＯＫ":              "ok",
+		"１２３　４５":          "123 45",
+		"ｶﾞｲﾄﾞ":           "がいど",
+		"ガイド":             "がいど",
+		"カ\u3099イト\u3099": "がいど",
+		"ﾊﾟｽﾜｰﾄﾞ":         "ぱすわーど",
+		"  Next \n Step ": "next step",
+	}
+	for in, want := range cases {
+		if got := normalizeMatchText(in); got != want {
+			t.Fatalf("normalizeMatchText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPickElementBySelectorNormalizeAndRegex(t *testing.T) {
+	elements := []Element{
+		{Index: 0, Role: "Button", Label: "OK", Enabled: true, Visible: true},
+		{Index: 1, Role: "StaticText", Label: "残り３件", Enabled: true, Visible: true},
+		{Index: 2, Role: "TextField", Label: "Phone", Value: "090-1234", Enabled: true, Visible: true},
+	}
+	if _, err := pickElementBySelector(elements, elementSelector{Index: -1, Label: "ＯＫ"}); err == nil {
+		t.Fatal("expected full-width label to miss without --normalize")
+	}
+	for _, tc := range []struct {
+		sel  elementSelector
+		want int
+	}{
+		{elementSelector{Index: -1, Label: "ＯＫ", Normalize: true}, 0},
+		{elementSelector{Index: -1, Contains: "3件", Normalize: true}, 1},
+		{elementSelector{Index: -1, LabelRegex: `^残り\d+件$`, Normalize: true}, 1},
+		{elementSelector{Index: -1, ValueRegex: `^090-\d{4}$`}, 2},
+	} {
+		got, err := pickElementBySelector(elements, tc.sel)
+		if err != nil || got.Index != tc.want {
+			t.Fatalf("%+v: expected index %d, got %d err=%v", tc.sel, tc.want, got.Index, err)
+		}
+	}
+	if err := (elementSelector{Index: -1, LabelRegex: "("}).validate(); err == nil {
+		t.Fatal("expected invalid regex error")
+	}
+}
+
+func TestPickElementByRelativeSelectors(t *testing.T) {
+	elements := []Element{
+		{Index: 0, Role: "StaticText", Label: "Email", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 100, W: 80, H: 20}},
+		{Index: 1, Role: "TextField", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 124, W: 350, H: 40}},
+		{Index: 2, Role: "StaticText", Label: "Password", Enabled: true, Visible: true, Frame: FrameRect{X: 20, Y: 180, W: 80, H: 20}},
+		{Index: 3, Role: "SecureTextField", Enabled: true, Visible: true, Frame: FrameRect{X: 110, Y: 176, W: 260, H: 28}},
+		{Index: 4, Role: "Cell", Label: "Row A", Enabled: true, Visible: true, Frame: FrameRect{X: 0, Y: 300, W: 390, H: 60}},
+		{Index: 5, Role: "Button", Label: "Delete", Enabled: true, Visible: true, Frame: FrameRect{X: 300, Y: 310, W: 80, H: 40}},
+		{Index: 6, Role: "Cell", Label: "Row B", Enabled: true, Visible: true, Frame: FrameRect{X: 0, Y: 360, W: 390, H: 60}},
+		{Index: 7, Role: "Button", Label: "Delete", Enabled: true, Visible: true, Frame: FrameRect{X: 300, Y: 370, W: 80, H: 40}},
+	}
+	for _, tc := range []struct {
+		sel  elementSelector
+		want int
+	}{
+		{elementSelector{Index: -1, Below: "Email", Role: "textfield"}, 1},
+		{elementSelector{Index: -1, RightOf: "Password"}, 3},
+		{elementSelector{Index: -1, Label: "Delete", Inside: `label="Row B"`}, 7},
+		{elementSelector{Index: -1, Select: `button inside (cell && label="Row A")`}, 5},
+		{elementSelector{Index: -1, Select: `securetextfield right-of "Password"`}, 3},
+		{elementSelector{Index: -1, Select: `above "Password" && textfield`}, 1},
+	} {
+		got, err := pickElementBySelector(elements, tc.sel)
+		if err != nil || got.Index != tc.want {
+			t.Fatalf("%+v: expected index %d, got %d err=%v", tc.sel, tc.want, got.Index, err)
+		}
+	}
+	if _, err := pickElementBySelector(elements, elementSelector{Index: -1, LeftOf: "Email"}); err == nil {
+		t.Fatal("expected no element left of Email")
+	}
+}
+
+func TestNewTapGesture(t *testing.T) {
+	g, err := newTapGesture("longpress", 0, 1500*time.Millisecond)
+	if err != nil || g.Count != 1 || g.details()["durationMs"] != int64(1500) {
+		t.Fatalf("unexpected longpress gesture: %+v err=%v", g, err)
+	}
+	g, err = newTapGesture("longpress", 0, 0)
+	if err != nil || g.Duration != defaultLongPressDuration {
+		t.Fatalf("unexpected default longpress: %+v err=%v", g, err)
+	}
+	g, err = newTapGesture("doubletap", 0, 0)
+	if err != nil || g.details()["count"] != 2 {
+		t.Fatalf("unexpected doubletap gesture: %+v err=%v", g, err)
+	}
+	if _, err := newTapGesture("tap", -1, 0); err == nil {
+		t.Fatal("expected --count validation error")
+	}
+	if _, err := newTapGesture("longpress", 0, -time.Second); err == nil {
+		t.Fatal("expected --duration validation error")
+	}
+	if _, err := newTapGesture("longpress", 3, 0); err == nil || toAppError(err).Code != "USAGE" {
+		t.Fatal("expected USAGE for longpress --count")
+	}
+	if _, err := newTapGesture("tap", 1, time.Second); err == nil || toAppError(err).Code != "USAGE" {
+		t.Fatal("expected USAGE for tap --duration")
+	}
+	events := multiTapEvents(FramePoint{X: 10, Y: 20}, 2)
+	if len(events) != 7 || events[0].Type != "down" || events[2].Type != "up" || events[3].Seconds != multiTapInterval.Seconds() {
+		t.Fatalf("unexpected double tap events: %+v", events)
+	}
+}
+
+func TestPlanDragHold(t *testing.T) {
+	start := FramePoint{X: 100, Y: 200}
+	end := FramePoint{X: 100, Y: 500}
+	plan := planDrag(start, end, 600*time.Millisecond)
+	if plan.Steps != 30 || plan.Delta != 10 || plan.Duration != 600*time.Millisecond {
+		t.Fatalf("unexpected plan: %+v", plan)
+	}
+	events := plan.heldEvents(700 * time.Millisecond)
+	if len(events) != 2+2*plan.Steps+1 {
+		t.Fatalf("unexpected event count: %d", len(events))
+	}
+	if events[0] != touchDown(start) || events[1].Type != "delay" || events[1].Seconds != 0.7 {
+		t.Fatalf("drag must touch down and hold before moving: %+v", events[:2])
+	}
+	if events[2].Y != 210 || events[3].Seconds != 0.02 {
+		t.Fatalf("moves must stay fine-grained after the hold: %+v %+v", events[2], events[3])
+	}
+	if last := events[len(events)-1]; last != touchUp(end) || events[len(events)-3] != touchDown(end) {
+		t.Fatalf("drag must end at the target: %+v", events[len(events)-3:])
+	}
+	if _, err := parsePointArg("12.5, 40"); err != nil {
+		t.Fatalf("parse point: %v", err)
+	}
+	if _, err := parsePointArg("12.5"); err == nil {
+		t.Fatal("expected point parse error")
+	}
+}
+
+func TestPickScrollContainer(t *testing.T) {
+	elements := []Element{
+		{Index: 0, Role: "Table", Label: "Orders", Frame: FrameRect{Y: 100, W: 390, H: 300}},
+		{Index: 1, Role: "Table", Label: "History", Frame: FrameRect{Y: 420, W: 390, H: 300}},
+	}
+	for expr, want := range map[string]string{`role=table`: "ELEMENT_AMBIGUOUS", `role=collectionview`: "ELEMENT_NOT_FOUND", `role=table && label="History"`: ""} {
+		query, err := parseSelectorExpr(expr)
+		if err != nil {
+			t.Fatalf("%q: %v", expr, err)
+		}
+		got, err := pickScrollContainer(elements, query, expr)
+		if want == "" {
+			if err != nil || got.Index != 1 {
+				t.Fatalf("%q: expected History table, got %+v %v", expr, got, err)
+			}
+			continue
+		}
+		if toAppError(err).Code != want {
+			t.Fatalf("%q: expected %s, got %v", expr, want, err)
+		}
+	}
+}
+
+func TestScrollSwipeVector(t *testing.T) {
+	area := FrameRect{X: 0, Y: 100, W: 400, H: 600}
+	start, end := scrollSwipeVector(area, "down", 0.5)
+	if start.X != 200 || start.Y != 550 || end.Y != 250 {
+		t.Fatalf("unexpected down swipe: %+v -> %+v", start, end)
+	}
+	start, end = scrollSwipeVector(area, "right", 0.5)
+	if start.X != 300 || end.X != 100 || start.Y != 400 {
+		t.Fatalf("unexpected right swipe: %+v -> %+v", start, end)
+	}
+}
+
+func TestPlanSwipe(t *testing.T) {
+	var tr Transform
+	tr.Screen.W = 400
+	tr.Screen.H = 800
+	tr.Scale = 2
+	tr.SafeArea.Top = 50
+
+	plan, err := planSwipe(swipeRequest{Direction: "up", Distance: "25%"}, tr)
+	if err != nil || plan.Start != (FramePoint{X: 200, Y: 425}) || plan.End != (FramePoint{X: 200, Y: 225}) {
+		t.Fatalf("unexpected percent swipe: %+v err=%v", plan, err)
+	}
+	plan, err = planSwipe(swipeRequest{From: "100,600", To: "50%,10%", Unit: "px"}, tr)
+	if err != nil || plan.Start != (FramePoint{X: 50, Y: 300}) || plan.End != (FramePoint{X: 200, Y: 80}) {
+		t.Fatalf("unexpected px swipe: %+v err=%v", plan, err)
+	}
+	plan, err = planSwipe(swipeRequest{Direction: "down", Distance: "0"}, tr)
+	if err != nil || plan.End.Y-plan.Start.Y != defaultSwipeDistance {
+		t.Fatalf("distance 0 must use the default: %+v err=%v", plan, err)
+	}
+	plan, err = planSwipe(swipeRequest{Preset: "back"}, tr)
+	if err != nil || plan.Start.X != 1 || plan.End.X != 280 || plan.Duration != 300*time.Millisecond {
+		t.Fatalf("unexpected back preset: %+v err=%v", plan, err)
+	}
+	if _, err := planSwipe(swipeRequest{Preset: "refresh"}, Transform{}); err == nil {
+		t.Fatal("expected preset without screen size to fail")
+	}
+}
+
+func TestCountTextMatches(t *testing.T) {
+	before := []Element{{Label: "Profile", Enabled: true}, {Label: "Next", Enabled: true}}
+	after := append(append([]Element{}, before...), Element{Label: "Edit profile", Enabled: true}, Element{Label: "Profile photo", Enabled: false})
+	if got := countTextMatches(before, "profile"); got != 1 {
+		t.Fatalf("before: got %d", got)
+	}
+	if got := countTextMatches(after, "profile"); got != 2 {
+		t.Fatalf("after: got %d", got)
+	}
+	if got := countTextMatches(after, ""); got != 0 {
+		t.Fatalf("empty needle must not match, got %d", got)
+	}
+}
+
+func TestDiffElements(t *testing.T) {
+	before := []Element{
+		{Index: 0, Role: "Button", Label: "Send", Enabled: false},
+		{Index: 1, Role: "ActivityIndicator", Label: "Loading"},
+		{Index: 2, Role: "TextField", Label: "Message", Value: "hi"},
+	}
+	after := []Element{
+		{Index: 0, Role: "Button", Label: "Send", Enabled: true},
+		{Index: 1, Role: "TextField", Label: "Message", Value: "hi"},
+		{Index: 2, Role: "StaticText", Label: "Sent"},
+	}
+	diff := diffElements(before, after)
+	if diff["addedCount"] != 1 || diff["removedCount"] != 1 || diff["changedCount"] != 1 {
+		t.Fatalf("unexpected diff counts: %+v", diff)
+	}
+	if removed := diff["removed"].([]map[string]any); removed[0]["label"] != "Loading" {
+		t.Fatalf("unexpected removed: %+v", removed)
+	}
+}
+
+func TestWaitConditionsEvaluate(t *testing.T) {
+	snapshot := elementSnapshot{
+		Elements: []Element{
+			{Index: 0, Role: "Button", Label: "Submit", Enabled: false, Visible: true},
+			{Index: 1, Role: "Cell", Label: "Row 1", Enabled: true, Visible: true},
+			{Index: 2, Role: "Cell", Label: "Row 2", Enabled: true, Visible: true},
+			{Index: 3, Role: "ActivityIndicator", Label: "Loading", Visible: true},
+		},
+		InteractiveCount: 2,
+	}
+	compiled, err := compileWaitConditions(waitConditions{
+		InteractiveMin: -1,
+		GoneText:       "loading",
+		Element:        `label="Submit"`,
+		State:          "visible,enabled",
+		Count:          "role=cell >= 2",
+		Stable:         time.Second,
+	})
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	checks := compiled.evaluate(snapshot, 2*time.Second)
+	got := map[string]bool{}
+	for _, c := range checks {
+		got[c.Name] = c.OK
+	}
+	want := map[string]bool{"goneText": false, "element": false, "count": true, "stable": true}
+	for name, ok := range want {
+		if got[name] != ok {
+			t.Fatalf("condition %s: expected %v, got %v (%+v)", name, ok, got[name], checks)
+		}
+	}
+	if waitChecksMet(checks, false) {
+		t.Fatal("expected --all to fail")
+	}
+	if !waitChecksMet(checks, true) {
+		t.Fatal("expected --any to pass")
+	}
+	for _, tc := range []struct {
+		element, state string
+		want           bool
+	}{
+		{`label="Submit"`, "!exists", false},
+		{`label="Missing"`, "!exists", true},
+		{`label="Submit"`, "!exists,enabled", true},
+		{`label="Submit"`, "!exists,visible", false},
+		{`label="Missing"`, "!exists,visible", true},
+	} {
+		c, err := compileWaitConditions(waitConditions{InteractiveMin: -1, Element: tc.element, State: tc.state})
+		if err != nil {
+			t.Fatalf("compile %s: %v", tc.state, err)
+		}
+		if got := c.evaluate(snapshot, 0)[0].OK; got != tc.want {
+			t.Fatalf("%s --state %s: expected %v, got %v", tc.element, tc.state, tc.want, got)
+		}
+	}
+	if _, err := compileWaitConditions(waitConditions{Element: "button", State: "pressed"}); err == nil {
+		t.Fatal("expected unknown state error")
+	}
+	if _, err := compileWaitConditions(waitConditions{Count: "role=cell"}); err == nil {
+		t.Fatal("expected count syntax error")
+	}
+}
+
+func TestKeyComboEvents(t *testing.T) {
+	combo, err := parseKeyCombo("cmd+shift+z")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	var order []string
+	for _, e := range keyComboEvents(combo) {
+		switch e.Type {
+		case "keydown", "keyup":
+			order = append(order, fmt.Sprintf("%s:%d", e.Type, e.Key))
+		case "delay":
+		default:
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+	cmd, shift, z := hidModifierCodes["cmd"], hidModifierCodes["shift"], hidKeyCodes["z"]
+	want := []string{
+		fmt.Sprintf("keydown:%d", cmd), fmt.Sprintf("keydown:%d", shift),
+		fmt.Sprintf("keydown:%d", z), fmt.Sprintf("keyup:%d", z),
+		fmt.Sprintf("keyup:%d", shift), fmt.Sprintf("keyup:%d", cmd),
+	}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v, want %v", order, want)
+	}
+}
+
+func TestParseKeyCombo(t *testing.T) {
+	combo, err := parseKeyCombo("Return")
+	if err != nil || combo.Key != 40 || len(combo.Modifiers) != 0 {
+		t.Fatalf("return: %+v %v", combo, err)
+	}
+	combo, err = parseKeyCombo("cmd+shift+z")
+	if err != nil || combo.Key != 29 || len(combo.Modifiers) != 2 || combo.Modifiers[0] != 227 || combo.Modifiers[1] != 225 {
+		t.Fatalf("cmd+shift+z: %+v %v", combo, err)
+	}
+	combo, err = parseKeyCombo("76")
+	if err != nil || combo.Key != 76 {
+		t.Fatalf("raw code: %+v %v", combo, err)
+	}
+	combo, err = parseKeyCombo("cmd++")
+	if err != nil || combo.Key != 46 || len(combo.Modifiers) != 2 || combo.Modifiers[0] != 227 || combo.Modifiers[1] != 225 {
+		t.Fatalf("cmd++: %+v %v", combo, err)
+	}
+	combo, err = parseKeyCombo("+")
+	if err != nil || combo.Key != 46 || len(combo.Modifiers) != 1 || combo.Modifiers[0] != 225 {
+		t.Fatalf("plus: %+v %v", combo, err)
+	}
+	for _, bad := range []string{"", "hyper+a", "cmd+nosuchkey"} {
+		if _, err := parseKeyCombo(bad); err == nil || toAppError(err).Code != "USAGE" {
+			t.Fatalf("%q: expected USAGE error, got %v", bad, err)
+		}
+	}
+}
+
+func TestParseInterspersedFlags(t *testing.T) {
+	fs := flag.NewFlagSet("ui key", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	repeat := fs.Int("repeat", 1, "")
+	asJSON := fs.Bool("json", false, "")
+	if err := parseInterspersedFlags(fs, []string{"tab", "--repeat", "2", "--json"}); err != nil {
+		t.Fatal(err)
+	}
+	if *repeat != 2 || !*asJSON || fs.NArg() != 1 || fs.Arg(0) != "tab" {
+		t.Fatalf("unexpected parse: repeat=%d json=%v args=%v", *repeat, *asJSON, fs.Args())
+	}
+	if err := parseInterspersedFlags(fs, []string{"tab", "--nosuch"}); err == nil {
+		t.Fatal("unknown flag after positional must fail")
+	}
+}
+
+func TestFindPasteMenuItem(t *testing.T) {
+	field := Element{ID: "email", Role: "TextField", Frame: FrameRect{X: 20, Y: 300, W: 350, H: 44}}
+	appPaste := Element{ID: "toolbar-paste", Role: "Button", Label: "Paste", Enabled: true, Frame: FrameRect{X: 300, Y: 330, W: 60, H: 30}}
+	farMenu := Element{ID: "far", Role: "MenuItem", Label: "Paste", Enabled: true, Frame: FrameRect{X: 20, Y: 760, W: 80, H: 36}}
+	before := []Element{field, appPaste}
+	cases := []struct {
+		name     string
+		elements []Element
+		want     string
+		ok       bool
+	}{
+		{"in-app button only", []Element{field, appPaste}, "", false},
+		{"menu item near field", []Element{field, appPaste, {ID: "menu", Role: "MenuItem", Label: "ペースト", Enabled: true, Frame: FrameRect{X: 120, Y: 250, W: 80, H: 36}}}, "menu", true},
+		{"new callout button", []Element{field, appPaste, {ID: "callout", Role: "Button", Label: "paste", Enabled: true, Frame: FrameRect{X: 150, Y: 255, W: 70, H: 36}}}, "callout", true},
+		{"menu item far away", []Element{field, farMenu}, "", false},
+		{"disabled item", []Element{field, {ID: "menu", Role: "MenuItem", Label: "Paste", Frame: FrameRect{X: 120, Y: 250, W: 80, H: 36}}}, "", false},
+	}
+	for _, tc := range cases {
+		got, ok := findPasteMenuItem(tc.elements, field, before)
+		if ok != tc.ok || got.ID != tc.want {
+			t.Fatalf("%s: got %q %v, want %q %v", tc.name, got.ID, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestPasteValueLanded(t *testing.T) {
+	cases := []struct {
+		name, text, before string
+		field              Element
+		want               bool
+	}{
+		{"unchanged", "hello", "", Element{Role: "TextField", Value: ""}, false},
+		{"pasted", "hello", "", Element{Role: "TextField", Value: "hello"}, true},
+		{"appended", "world", "hello ", Element{Role: "TextField", Value: "hello world"}, true},
+		{"other text", "hello", "", Element{Role: "TextField", Value: "help"}, false},
+		{"secure change", "secret", "", Element{Role: "SecureTextField", Value: "••••••"}, true},
+	}
+	for _, tc := range cases {
+		if got := pasteValueLanded(tc.text, tc.before, tc.field); got != tc.want {
+			t.Fatalf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPasteboardMatches(t *testing.T) {
+	content := "https://example.com/invite/AB12"
+	cases := []struct {
+		want, mode string
+		ok         bool
+	}{
+		{content, "", true},
+		{"https://example.com", "exact", false},
+		{"/invite/", "contains", true},
+		{`^https://example\.com/invite/[A-Z0-9]+$`, "regex", true},
+		{`^http://`, "regex", false},
+	}
+	for _, tc := range cases {
+		got, err := pasteboardMatches(content, tc.want, tc.mode)
+		if err != nil || got != tc.ok {
+			t.Fatalf("%s %q: got %v %v", tc.mode, tc.want, got, err)
+		}
+	}
+	if _, err := pasteboardMatches(content, "(", "regex"); err == nil || toAppError(err).Code != "USAGE" {
+		t.Fatalf("expected USAGE for bad regex, got %v", err)
+	}
+	if _, err := pasteboardMatches(content, "x", "fuzzy"); err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
+
+func TestSecureMissingSuffix(t *testing.T) {
+	cases := []struct {
+		observed   string
+		baseline   int
+		missing    string
+		comparable bool
+	}{
+		{"••••••••", 0, "", true},
+		{"•••••", 0, "ord", true},
+		{"•••••••d", 0, "", true},
+		{"", 0, "password", true},
+		{"•••••••••••", -1, "", true},
+		{"•••••••••", 0, "", false},
+		{"Password", 0, "", false},
+		// Refocused field with 3 bullets: iOS cleared it on entry, or kept
+		// them and the new text was appended.
+		{"••••••••", 3, "", true},
+		{"•••••••••••", 3, "", true},
+		{"•••••••••", 3, "rd", true},
+		{"•••••", 3, "", false},
+		{"•••••", -1, "", false},
+	}
+	for _, tc := range cases {
+		missing, comparable := secureMissingSuffix("password", tc.observed, tc.baseline)
+		if missing != tc.missing || comparable != tc.comparable {
+			t.Fatalf("%q baseline=%d: got (%q, %v), want (%q, %v)", tc.observed, tc.baseline, missing, comparable, tc.missing, tc.comparable)
+		}
+	}
+	for _, tc := range []struct {
+		observed string
+		baseline int
+		want     bool
+	}{
+		{"••••••••", 0, true},
+		{"••••••••", 8, true},
+		{"••••••••••••••••", 8, true},
+		{"••••••••", -1, true},
+		{"•••••••", 0, false},
+		{"Password", 0, false},
+		{"••••••••••••", 8, false},
+	} {
+		if got := secureTypeVerified("password", tc.observed, tc.baseline); got != tc.want {
+			t.Fatalf("verify %q baseline=%d: got %v, want %v", tc.observed, tc.baseline, got, tc.want)
+		}
+	}
+	for value, want := range map[string]int{"Password": 0, "": 0, "•••": 3, "••d": 3} {
+		if got := secureBaselineFromValue(value); got != want {
+			t.Fatalf("baseline %q: got %d, want %d", value, got, want)
+		}
+	}
+	details := secureTypeDetails("password", "•••", 0)
+	if _, leaked := details["intended"]; leaked || details["intendedLength"] != 8 || details["observedLength"] != 3 {
+		t.Fatalf("unexpected secure details: %+v", details)
+	}
+}
+
+func TestSplitGraphemes(t *testing.T) {
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{"abc", []string{"a", "b", "c"}},
+		{"\r\nx", []string{"\r\n", "x"}},
+		{"👨‍👩‍👧x", []string{"👨‍👩‍👧", "x"}},
+		{"👍🏽👍", []string{"👍🏽", "👍"}},
+		{"🇯🇵🇺🇸🇫", []string{"🇯🇵", "🇺🇸", "🇫"}},
+		{"\u304b\u3099き", []string{"\u304b\u3099", "き"}},
+		{"ｶﾞｷﾞ", []string{"ｶﾞ", "ｷﾞ"}},
+		{"각한", []string{"각", "한"}},
+		{"❤️a", []string{"❤️", "a"}},
+	}
+	for _, tc := range cases {
+		got := splitGraphemes(tc.text)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%q: got %q, want %q", tc.text, got, tc.want)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%q: got %q, want %q", tc.text, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestSplitIntoInputChunksKeepsClusters(t *testing.T) {
+	chunks := splitIntoInputChunks("ab👨‍👩‍👧c🇯🇵d", 2)
+	want := []string{"ab", "👨‍👩‍👧c", "🇯🇵d"}
+	if len(chunks) != len(want) {
+		t.Fatalf("unexpected chunks: %q", chunks)
+	}
+	for i := range want {
+		if chunks[i] != want[i] {
+			t.Fatalf("unexpected chunks: %q", chunks)
+		}
+	}
+	if _, err := newInputChunking(-1, ""); err == nil {
+		t.Fatal("expected error for negative chunk size")
+	}
+	c, err := newInputChunking(0, "0s")
+	if err != nil || c.Size != defaultInputChunking.Size || c.Delay != 0 {
+		t.Fatalf("unexpected chunking: %+v %v", c, err)
+	}
+}
+
+func TestVerifyModeMissingSuffix(t *testing.T) {
+	digits, _ := parseVerifyMode("digits")
+	if missing, ok := digits.missingSuffix("09012345678", "090-1234-56"); !ok || missing != "78" {
+		t.Fatalf("digits: got (%q, %v)", missing, ok)
+	}
+	if missing, ok := digits.missingSuffix("4111 1111 1111 1111", "4111-1111-1111-1111"); !ok || missing != "" {
+		t.Fatalf("digits complete: got (%q, %v)", missing, ok)
+	}
+	loose, _ := parseVerifyMode("loose")
+	if missing, ok := loose.missingSuffix("100-0001", "１００－"); !ok || missing != "0001" {
+		t.Fatalf("loose: got (%q, %v)", missing, ok)
+	}
+	exact, _ := parseVerifyMode("exact")
+	if _, ok := exact.missingSuffix("a b", "ab"); ok {
+		t.Fatal("exact should not ignore whitespace")
+	}
+	re, err := parseVerifyMode(`regex:^\d{3}-\d{4}$`)
+	if err != nil {
+		t.Fatalf("regex: %v", err)
+	}
+	if missing, ok := re.missingSuffix("1000001", "100-0001"); !ok || missing != "" {
+		t.Fatalf("regex match: got (%q, %v)", missing, ok)
+	}
+	if missing, ok := re.missingSuffix("1000001", "100"); !ok || missing != "0001" {
+		t.Fatalf("regex recovery: got (%q, %v)", missing, ok)
+	}
+	if _, ok := re.missingSuffix("1000001", "1000001"); ok {
+		t.Fatal("regex should fail when fully typed value does not match")
+	}
+	if !digits.holds("09012345678", "090-1234-5678") || loose.holds("abc", "a-x") {
+		t.Fatal("unexpected holds result")
+	}
+	if !digits.targetOnly() || !re.targetOnly() || loose.targetOnly() || exact.targetOnly() {
+		t.Fatal("only digits and regex should verify the target field alone")
+	}
+	for _, bad := range []string{"fuzzy", "regex:("} {
+		if _, err := parseVerifyMode(bad); err == nil {
+			t.Fatalf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestClearStrategies(t *testing.T) {
+	if got := clearMethods(clearStrategyAuto); len(got) != 3 || got[0] != "cmd+a" || got[2] != "backspace" {
+		t.Fatalf("unexpected auto methods: %v", got)
+	}
+	if got := clearMethods(clearStrategyBackspace); len(got) != 1 || got[0] != "backspace" {
+		t.Fatalf("unexpected backspace methods: %v", got)
+	}
+	if err := validateClearStrategy("nuke"); err == nil {
+		t.Fatal("expected error for unknown strategy")
+	}
+	cases := []struct {
+		elem Element
+		want bool
+	}{
+		{Element{Role: "TextField", Value: ""}, true},
+		{Element{Role: "TextField", Label: "Email", Value: "Email"}, true},
+		{Element{Role: "TextField", NearbyLabel: "郵便番号", Value: "郵便番号"}, true},
+		{Element{Role: "TextField", Label: "Email", Value: "me@example.com"}, false},
+		{Element{Role: "SecureTextField", Value: "•••"}, false},
+		{Element{Role: "TextField", Label: "Email", Placeholder: "name@example.com", Value: "name@example.com"}, true},
+		// Text the tree does not mark as a placeholder is content, even if
+		// deleting did not change it (read-only field or lost focus).
+		{Element{Role: "TextField", Label: "Email", Value: "name@example.com"}, false},
+	}
+	for _, tc := range cases {
+		if got := inputFieldCleared(tc.elem); got != tc.want {
+			t.Fatalf("%+v: got %v, want %v", tc.elem, got, tc.want)
+		}
+	}
+	elem, ok := elementFromCandidate(candidateNode{Path: "f", Map: map[string]any{
+		"AXLabel": "Email", "AXValue": "name@example.com", "placeholderValue": "name@example.com",
+		"frame": map[string]any{"x": 20.0, "y": 100.0, "width": 350.0, "height": 44.0},
+	}})
+	if !ok || elem.Placeholder != "name@example.com" || !inputFieldCleared(elem) {
+		t.Fatalf("expected exposed placeholder to count as cleared, got %+v", elem)
+	}
+}
+
+func TestPickerHelpers(t *testing.T) {
+	if got := pickerWheelValue(Element{Value: "March, 3 of 12"}); got != "March" {
+		t.Fatalf("unexpected wheel value: %q", got)
+	}
+	for value, want := range map[string]int{"March": 3, "Sep.": 9, "2024年": 2024, "１５日": 15, "08": 8} {
+		if got, ok := pickerOrdinal(value); !ok || got != want {
+			t.Fatalf("%q: got %d %v, want %d", value, got, ok, want)
+		}
+	}
+	if _, ok := pickerOrdinal("Tokyo"); ok {
+		t.Fatal("expected no ordinal for Tokyo")
+	}
+	if rows, ok := pickerRowDelta("January", "March"); !ok || rows != 2 {
+		t.Fatalf("unexpected delta: %d %v", rows, ok)
+	}
+	if _, ok := pickerRowDelta("Tokyo", "Osaka"); ok {
+		t.Fatal("expected search mode for non-ordinal values")
+	}
+
+	wheel := Element{Role: "PickerWheel", Frame: FrameRect{X: 0, Y: 600, W: 130, H: 210}, Center: FramePoint{X: 65, Y: 705}}
+	start, end := pickerDragVector(wheel, 2, 30)
+	if start.Y != 735 || end.Y != 675 || start.X != 65 {
+		t.Fatalf("unexpected vector: %+v -> %+v", start, end)
+	}
+	start, end = pickerDragVector(wheel, -40, 30)
+	if end.Y-start.Y != 150 {
+		t.Fatalf("expected drag capped to 5 rows, got %+v -> %+v", start, end)
+	}
+
+	picker := Element{Role: "Picker", Frame: FrameRect{X: 0, Y: 600, W: 390, H: 210}}
+	elements := []Element{
+		{ID: "year", Role: "PickerWheel", Center: FramePoint{X: 300, Y: 705}},
+		{ID: "month", Role: "PickerWheel", Center: FramePoint{X: 65, Y: 705}},
+		{ID: "other", Role: "PickerWheel", Center: FramePoint{X: 65, Y: 100}},
+	}
+	wheels := pickerWheels(elements, picker)
+	if len(wheels) != 2 || wheels[0].ID != "month" || wheels[1].ID != "year" {
+		t.Fatalf("unexpected wheels: %+v", wheels)
+	}
+}
+
+func TestSliderAndSwitchHelpers(t *testing.T) {
+	for value, want := range map[string]float64{"75%": 0.75, "0.25": 0.25, "50": 0.5, "１００％": 1} {
+		if got, ok := parseSliderValue(value); !ok || math.Abs(got-want) > 1e-9 {
+			t.Fatalf("%q: got %v %v, want %v", value, got, ok, want)
+		}
+	}
+	if _, ok := parseSliderValue("loud"); ok {
+		t.Fatal("expected unreadable slider value")
+	}
+	slider := Element{Frame: FrameRect{X: 20, Y: 400, W: 228, H: 30}, Center: FramePoint{X: 134, Y: 415}}
+	if p := sliderPoint(slider, 0); p.X != 34 || p.Y != 415 {
+		t.Fatalf("unexpected start point: %+v", p)
+	}
+	if p := sliderPoint(slider, 0.75); p.X != 184 {
+		t.Fatalf("unexpected 0.75 point: %+v", p)
+	}
+	for value, want := range map[string]bool{"1": true, "0": false, "On": true, "オフ": false} {
+		if got, ok := parseSwitchState(value); !ok || got != want {
+			t.Fatalf("%q: got %v %v", value, got, ok)
+		}
+	}
+	if _, ok := parseSwitchState("maybe"); ok {
+		t.Fatal("expected unreadable switch state")
+	}
+	row := Element{Frame: FrameRect{X: 0, Y: 100, W: 390, H: 44}, Center: FramePoint{X: 195, Y: 122}}
+	if p := switchTapPoint(row); p.X != 358 {
+		t.Fatalf("expected trailing tap point, got %+v", p)
+	}
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	got, err := splitCommandLine(`tap --label "次へ ボタン" --select 'label="A b"' --json`)
+	want := []string{"tap", "--label", "次へ ボタン", "--select", `label="A b"`, "--json"}
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("got %q %v", got, err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	got, err = splitCommandLine(`type --text a\ b ""`)
+	if err != nil || len(got) != 4 || got[2] != "a b" || got[3] != "" {
+		t.Fatalf("got %q %v", got, err)
+	}
+	if _, err := splitCommandLine(`tap --label "open`); err == nil {
+		t.Fatal("expected error for unterminated quote")
+	}
+}
+
+func TestBatchSessionSnapshotCache(t *testing.T) {
+	b := &batchSession{}
+	b.store("udid", false, elementSnapshot{Hash: "h1"})
+	if _, ok := b.cached("udid", false); ok {
+		t.Fatal("snapshot must not be served before a new line starts")
+	}
+	b.beginLine(1)
+	if _, ok := b.cached("udid", true); ok {
+		t.Fatal("keyboard mismatch must miss")
+	}
+	b.beginLine(2)
+	if s, ok := b.cached("udid", false); !ok || s.Hash != "h1" {
+		t.Fatalf("expected hit, got %+v %v", s, ok)
+	}
+	b.store("udid", false, elementSnapshot{Hash: "h2"})
+	if _, ok := b.cached("udid", false); ok {
+		t.Fatal("captures later in the same line must be live")
+	}
+	b.beginLine(3)
+	b.invalidate()
+	if _, ok := b.cached("udid", false); ok {
+		t.Fatal("invalidated snapshot must miss")
+	}
+	b.store("udid", false, elementSnapshot{Hash: "h3"})
+	b.cachedAt = time.Now().Add(-2 * batchSnapshotTTL)
+	b.beginLine(4)
+	if _, ok := b.cached("udid", false); ok {
+		t.Fatal("stale snapshot must miss")
+	}
+	if b.hits != 1 {
+		t.Fatalf("unexpected hits: %d", b.hits)
+	}
+}
+
+func TestBatchRawLineInvalidatesSnapshot(t *testing.T) {
+	t.Setenv("PATH", "")
+	for _, line := range []string{"raw idb ui tap 10 20", "raw simctl openurl booted https://example.com"} {
+		b := &batchSession{}
+		a := &App{opts: GlobalOptions{Timeout: time.Second}, batch: b}
+		b.store("udid", false, elementSnapshot{Hash: "h1"})
+		b.beginLine(1)
+		_ = a.runBatchLine(SimTarget{UDID: "udid"}, line)
+		if _, ok := b.cached("udid", false); ok {
+			t.Fatalf("%q: raw line must invalidate the cached snapshot", line)
+		}
+	}
+}
+
+func TestHitTestOcclusion(t *testing.T) {
+	screen := FrameRect{W: 390, H: 844}
+	button := Element{ID: "next", Label: "Next", Frame: FrameRect{X: 20, Y: 700, W: 350, H: 50}}
+	point := FramePoint{X: 195, Y: 725}
+	snapshot := elementSnapshot{Screen: screen}
+
+	cases := []struct {
+		name string
+		hit  Element
+		want string
+	}{
+		{"same element", Element{ID: "next", Frame: button.Frame}, ""},
+		{"child label", Element{ID: "axpath:point", Label: "Next", Frame: FrameRect{X: 170, Y: 712, W: 50, H: 26}}, ""},
+		{"cell container", Element{ID: "axpath:point", Frame: FrameRect{X: 0, Y: 690, W: 390, H: 70}}, ""},
+		{"toast", Element{ID: "axpath:point", Label: "Saved", Frame: FrameRect{X: 40, Y: 690, W: 310, H: 60}}, "overlay"},
+		{"dimming view", Element{ID: "axpath:point", Frame: FrameRect{W: 390, H: 844}}, "overlay"},
+	}
+	for _, tc := range cases {
+		if got := hitTestOcclusion(point, button, true, tc.hit, true, snapshot); got != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	kb := FrameRect{X: 0, Y: 500, W: 390, H: 344}
+	withKeyboard := elementSnapshot{Screen: screen, Keyboard: KeyboardState{Visible: true, Frame: &kb}}
+	if got := hitTestOcclusion(point, button, true, button, true, withKeyboard); got != "keyboard" {
+		t.Fatalf("expected keyboard, got %q", got)
+	}
+	withAlert := elementSnapshot{Screen: screen, Alert: &AlertState{Frame: FrameRect{X: 60, Y: 300, W: 270, H: 200}}}
+	if got := hitTestOcclusion(point, button, false, Element{}, false, withAlert); got != "alert" {
+		t.Fatalf("expected alert, got %q", got)
+	}
+	for _, hasTarget := range []bool{true, false} {
+		if got := hitTestOcclusion(point, button, hasTarget, Element{}, false, snapshot); got != "unknown" {
+			t.Fatalf("missing hit (target %v): expected unknown, got %q", hasTarget, got)
+		}
+	}
+}